@@ -0,0 +1,87 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// What happens to messages passed along a hop whose buffer is full.
+const (
+	// BackpressureBlock waits for room, holding up the sender.
+	BackpressureBlock = "block"
+	// BackpressureDropOldest makes room by dropping the oldest buffered
+	// message.
+	BackpressureDropOldest = "drop-oldest"
+	// BackpressureDropNewest drops the message being sent.
+	BackpressureDropNewest = "drop-newest"
+)
+
+// Backpressure configures the buffer of a hop messages are passed along,
+// e.g. from a session to the fanout. The zero value is an unbuffered hop
+// that blocks.
+type Backpressure struct {
+	// Size is how many messages the hop buffers.
+	Size int
+	// Policy is one of BackpressureBlock, BackpressureDropOldest or
+	// BackpressureDropNewest, blank means BackpressureBlock.
+	Policy string
+}
+
+func (b Backpressure) Validate() error {
+	if b.Size < 0 {
+		return errors.New("Buffer size can't be negative")
+	}
+	switch b.Policy {
+	case "", BackpressureBlock:
+	case BackpressureDropOldest, BackpressureDropNewest:
+		if b.Size == 0 {
+			return fmt.Errorf("Buffers dropping messages (%s) can't be empty", b.Policy)
+		}
+	default:
+		return fmt.Errorf("Unknown backpressure policy %q", b.Policy)
+	}
+	return nil
+}
+
+// Channel makes a channel buffering as many messages as the hop does.
+func (b Backpressure) Channel() chan *Message {
+	return make(chan *Message, b.Size)
+}
+
+// Send passes message along ch, which has to be made by Channel, following
+// the policy. Blocking sends give up once done is closed. sent is false if
+// the message didn't make it, dropped counts the messages dropped, the
+// message itself included.
+func (b Backpressure) Send(ch chan *Message, message *Message, done <-chan struct{}) (sent bool, dropped int) {
+	switch b.Policy {
+	case BackpressureDropNewest:
+		select {
+		case ch <- message:
+			return true, 0
+		default:
+			return false, 1
+		}
+	case BackpressureDropOldest:
+		for {
+			select {
+			case ch <- message:
+				return true, dropped
+			default:
+			}
+			// The receiver may have taken the oldest message meanwhile, in
+			// which case there is room now.
+			select {
+			case <-ch:
+				dropped++
+			default:
+			}
+		}
+	default:
+		select {
+		case ch <- message:
+			return true, 0
+		case <-done:
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package fetcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// countryRateWindow is the period country rates are measured over.
+const countryRateWindow = time.Minute
+
+// CountryStats tells where the live tweets of a session were sent from.
+type CountryStats struct {
+	// Countries are the countries tweets were sent from, most tweets first.
+	Countries []CountryCount
+	// Geocoded is how many tweets a country was found for.
+	Geocoded int64
+	// Failures is how many tweets the geocoder failed to find a country
+	// for.
+	Failures int64
+	// Skipped is how many tweets were passed on without asking the geocoder
+	// because its queue was full.
+	Skipped int64
+}
+
+type CountryCount struct {
+	Country string
+	Tweets  int64
+	// Share is the part of the geocoded tweets sent from the country.
+	Share float64
+	// Rate is how many tweets per second were sent from the country over
+	// the last minute.
+	Rate float64
+}
+
+// Countries counts the live tweets of a session by country as the geocode
+// stage finds them.
+type Countries struct {
+	now func() time.Time
+
+	mutex    sync.Mutex
+	totals   map[string]int64
+	recent   *countWindow
+	failures int64
+	skipped  int64
+}
+
+func newCountries() *Countries {
+	return &Countries{
+		now:    time.Now,
+		totals: make(map[string]int64),
+		recent: newCountWindow(countryRateWindow),
+	}
+}
+
+// Add counts a tweet sent from country. Blank countries count as failures.
+func (c *Countries) Add(country string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if country == "" {
+		c.failures++
+		return
+	}
+	c.totals[country]++
+	c.recent.add(c.now(), country)
+}
+
+// Fail counts a tweet the geocoder failed to find a country for.
+func (c *Countries) Fail() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.failures++
+}
+
+// Skip counts a tweet the geocoder wasn't asked about.
+func (c *Countries) Skip() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.skipped++
+}
+
+// Stats returns the counts so far.
+func (c *Countries) Stats() CountryStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := CountryStats{
+		Countries: make([]CountryCount, 0, len(c.totals)),
+		Failures:  c.failures,
+		Skipped:   c.skipped,
+	}
+	for _, tweets := range c.totals {
+		stats.Geocoded += tweets
+	}
+
+	recent := c.recent.counts(c.now())
+	for country, tweets := range c.totals {
+		stats.Countries = append(stats.Countries, CountryCount{
+			Country: country,
+			Tweets:  tweets,
+			Share:   float64(tweets) / float64(stats.Geocoded),
+			Rate:    float64(recent[country]) / countryRateWindow.Seconds(),
+		})
+	}
+	sort.Sort(byTweets(stats.Countries))
+	return stats
+}
+
+type byTweets []CountryCount
+
+func (c byTweets) Len() int      { return len(c) }
+func (c byTweets) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byTweets) Less(i, j int) bool {
+	if c[i].Tweets != c[j].Tweets {
+		return c[i].Tweets > c[j].Tweets
+	}
+	return c[i].Country < c[j].Country
+}
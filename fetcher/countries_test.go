@@ -0,0 +1,50 @@
+package fetcher_test
+
+import (
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Countries", func() {
+	var (
+		now       time.Time
+		countries *fetcher.Countries
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2016, 9, 6, 9, 20, 0, 0, time.UTC)
+		countries = fetcher.NewCountries(func() time.Time { return now })
+	})
+
+	It("keeps totals and the rates of the last minute", func() {
+		countries.Add("Germany")
+		countries.Add("France")
+		now = now.Add(90 * time.Second)
+		countries.Add("Germany")
+		countries.Add("Germany")
+
+		Expect(countries.Stats()).To(Equal(fetcher.CountryStats{
+			Countries: []fetcher.CountryCount{
+				{Country: "Germany", Tweets: 3, Share: 0.75, Rate: 2.0 / 60},
+				{Country: "France", Tweets: 1, Share: 0.25, Rate: 0},
+			},
+			Geocoded: 4,
+		}))
+	})
+
+	It("counts failures and skipped tweets apart", func() {
+		countries.Add("")
+		countries.Fail()
+		countries.Skip()
+
+		stats := countries.Stats()
+		Expect(stats.Countries).To(BeEmpty())
+		Expect(stats.Geocoded).To(Equal(int64(0)))
+		Expect(stats.Failures).To(Equal(int64(2)))
+		Expect(stats.Skipped).To(Equal(int64(1)))
+	})
+})
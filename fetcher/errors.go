@@ -0,0 +1,84 @@
+package fetcher
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Why fetching failed to start, see FetchError.
+const (
+	// ErrorInvalidQuery means the query can't be fetched as it is.
+	ErrorInvalidQuery = "invalid-query"
+	// ErrorUnauthorized means Twitter rejected the app's credentials.
+	ErrorUnauthorized = "unauthorized"
+	// ErrorRateLimited means Twitter wants the app to connect less often.
+	ErrorRateLimited = "rate-limited"
+	// ErrorUnavailable means the source of tweets couldn't be reached.
+	ErrorUnavailable = "unavailable"
+)
+
+// FetchError tells why Fetch failed to start a session. RetryAfter is how
+// long to wait before fetching again when rate limited, zero if unknown.
+type FetchError struct {
+	Kind       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *FetchError) Error() string {
+	return e.Message
+}
+
+func invalidQueryError(err error) *FetchError {
+	return &FetchError{Kind: ErrorInvalidQuery, Message: err.Error()}
+}
+
+// fetchError describes an error opening a source as a FetchError. Missing
+// files, e.g. recordings to replay, are the query's fault, anything else
+// is put down to the source being unavailable.
+func fetchError(err error) *FetchError {
+	switch e := err.(type) {
+	case *FetchError:
+		return e
+	case *ExpressionError:
+		return invalidQueryError(e)
+	}
+	if os.IsNotExist(err) {
+		return &FetchError{Kind: ErrorInvalidQuery, Message: fmt.Sprintf("Not found: %s", err)}
+	}
+	return &FetchError{Kind: ErrorUnavailable, Message: err.Error()}
+}
+
+// responseError describes a failed Twitter API response as a FetchError,
+// nil if it succeeded.
+func responseError(resp *http.Response) *FetchError {
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &FetchError{Kind: ErrorUnauthorized, Message: fmt.Sprintf("Twitter rejected the app's credentials: %s", resp.Status)}
+	case resp.StatusCode == 420 || resp.StatusCode == http.StatusTooManyRequests:
+		return &FetchError{Kind: ErrorRateLimited, Message: fmt.Sprintf("Twitter is rate limiting the app: %s", resp.Status), RetryAfter: retryAfter(resp.Header)}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNotAcceptable:
+		return &FetchError{Kind: ErrorInvalidQuery, Message: fmt.Sprintf("Twitter can't fetch the query: %s", resp.Status)}
+	default:
+		return &FetchError{Kind: ErrorUnavailable, Message: fmt.Sprintf("Twitter is unavailable: %s", resp.Status)}
+	}
+}
+
+// retryAfter reads how long to wait from a Retry-After header in seconds,
+// or an x-rate-limit-reset header holding the Unix time limits reset at.
+func retryAfter(header http.Header) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		if wait := time.Unix(reset, 0).Sub(time.Now()); wait > 0 {
+			return (wait + time.Second - 1).Truncate(time.Second)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package fetcher
+
+import (
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Accepts exposes the local filtering of tweets to tests.
+func (q Query) Accepts(tweet *twitter.Tweet) bool {
+	return q.accepts(tweet)
+}
+
+// Delivers exposes the routing of tweets from the shared stream to tests.
+func (q Query) Delivers(tweet *twitter.Tweet) bool {
+	return q.delivers(tweet)
+}
+
+// NewTrends exposes trends to tests, with now standing in for the clock.
+func NewTrends(options TrendingOptions, query Query, now func() time.Time) *Trends {
+	t := newTrends(options, query)
+	t.now = now
+	return t
+}
+
+// NewHeatmap exposes heatmaps to tests, with now standing in for the clock.
+func NewHeatmap(options HeatmapOptions, now func() time.Time) *Heatmap {
+	h := newHeatmap(options)
+	h.now = now
+	return h
+}
+
+// Geohash exposes geohash encoding to tests.
+func Geohash(c Coordinates, precision int) string {
+	return geohash(c, precision)
+}
+
+// NewCountries exposes country stats to tests, with now standing in for the
+// clock.
+func NewCountries(now func() time.Time) *Countries {
+	c := newCountries()
+	c.now = now
+	return c
+}
@@ -0,0 +1,400 @@
+package fetcher
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Twitter's limits on track terms.
+const (
+	maxTrackTerms     = 400
+	maxTrackTermBytes = 60
+)
+
+// ExpressionError describes where an expression couldn't be parsed. Pos is
+// the 1-based position of the offending character.
+type ExpressionError struct {
+	Pos     int
+	Message string
+}
+
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s at position %d", e.Message, e.Pos)
+}
+
+// expression is a parsed query expression such as
+//
+//	golang AND (docker OR kubernetes) -job "exact phrase"
+//
+// Terms next to each other have to match all, OR binds looser than AND, and
+// - or NOT excludes a term. Words match whole words ignoring case, #tags and
+// @mentions included, phrases match their words next to each other in
+// order. Words joining several, e.g. e-mail, match like phrases.
+type expression interface {
+	// matches reports whether a text matches, given the set of its words
+	// and the words themselves in order, see textWords.
+	matches(words map[string]bool, text []string) bool
+	// terms returns track terms every matching tweet matches at least one
+	// of, each a list of words. ok is false if tweets can match without
+	// containing any particular word, e.g. for negations.
+	terms() (terms [][]string, ok bool)
+}
+
+type wordExpression struct {
+	word string
+}
+
+type phraseExpression struct {
+	words []string
+}
+
+type andExpression struct {
+	left, right expression
+}
+
+type orExpression struct {
+	left, right expression
+}
+
+type notExpression struct {
+	operand expression
+}
+
+func (e *wordExpression) matches(words map[string]bool, text []string) bool {
+	return words[e.word]
+}
+
+func (e *wordExpression) terms() ([][]string, bool) {
+	return [][]string{{e.word}}, true
+}
+
+func (e *phraseExpression) matches(words map[string]bool, text []string) bool {
+	for start := 0; start+len(e.words) <= len(text); start++ {
+		matched := true
+		for i, word := range e.words {
+			if text[start+i] != word && strings.TrimLeft(text[start+i], "#@") != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// terms of a phrase hold all its words, Twitter can't track word order.
+func (e *phraseExpression) terms() ([][]string, bool) {
+	return [][]string{e.words}, true
+}
+
+func (e *andExpression) matches(words map[string]bool, text []string) bool {
+	return e.left.matches(words, text) && e.right.matches(words, text)
+}
+
+// terms combine every term of one side with every term of the other. If
+// that goes over Twitter's limits the side with fewer terms is used, which
+// lets more tweets through to be filtered locally.
+func (e *andExpression) terms() ([][]string, bool) {
+	left, leftOk := e.left.terms()
+	right, rightOk := e.right.terms()
+	if !leftOk {
+		return right, rightOk
+	}
+	if !rightOk {
+		return left, true
+	}
+
+	combined := make([][]string, 0, len(left)*len(right))
+	for _, l := range left {
+		for _, r := range right {
+			term := append(append([]string{}, l...), r...)
+			if len(strings.Join(term, " ")) > maxTrackTermBytes {
+				combined = nil
+				break
+			}
+			combined = append(combined, term)
+		}
+		if combined == nil {
+			break
+		}
+	}
+	if combined != nil && len(combined) <= maxTrackTerms {
+		return combined, true
+	}
+
+	if len(left) <= len(right) {
+		return left, true
+	}
+	return right, true
+}
+
+func (e *orExpression) matches(words map[string]bool, text []string) bool {
+	return e.left.matches(words, text) || e.right.matches(words, text)
+}
+
+func (e *orExpression) terms() ([][]string, bool) {
+	left, leftOk := e.left.terms()
+	right, rightOk := e.right.terms()
+	if !leftOk || !rightOk {
+		return nil, false
+	}
+	return append(left, right...), true
+}
+
+func (e *notExpression) matches(words map[string]bool, text []string) bool {
+	return !e.operand.matches(words, text)
+}
+
+func (e *notExpression) terms() ([][]string, bool) {
+	return nil, false
+}
+
+// trackTerms reduces the expression to track terms, see expression.terms.
+func trackTerms(e expression) ([]string, error) {
+	terms, ok := e.terms()
+	if !ok {
+		return nil, nil
+	}
+	if len(terms) > maxTrackTerms {
+		return nil, fmt.Errorf("Expression needs more than %d track terms", maxTrackTerms)
+	}
+
+	track := make([]string, 0, len(terms))
+	seen := make(map[string]bool)
+	for _, words := range terms {
+		term := strings.Join(words, " ")
+		if len(term) > maxTrackTermBytes {
+			return nil, fmt.Errorf("Track term %q is longer than %d bytes", term, maxTrackTermBytes)
+		}
+		if !seen[term] {
+			seen[term] = true
+			track = append(track, term)
+		}
+	}
+	return track, nil
+}
+
+// matchesText reports whether text matches the expression.
+func matchesText(e expression, text string) bool {
+	words := textWords(text)
+	return e.matches(wordSet(words), words)
+}
+
+// textWords splits text into lower case words, keeping the # of hashtags
+// and the @ of mentions.
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '#' && r != '@'
+	})
+}
+
+// wordSet holds words along with hashtags and mentions without their # or
+// @, so that plain words match them too.
+func wordSet(words []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range words {
+		set[word] = true
+		set[strings.TrimLeft(word, "#@")] = true
+	}
+	return set
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the 1-based position of the token's first character.
+	pos int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func tokenize(input string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")", i + 1})
+			i++
+		case r == '-':
+			tokens = append(tokens, token{tokenNot, "-", i + 1})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &ExpressionError{Pos: i + 1, Message: "unterminated phrase"}
+			}
+			tokens = append(tokens, token{tokenPhrase, string(runes[i+1 : end]), i + 1})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			text := string(runes[i:end])
+			kind := tokenWord
+			switch text {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind, text, i + 1})
+			i = end
+		}
+	}
+
+	return append(tokens, token{tokenEnd, "", len(runes) + 1}), nil
+}
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+// parseExpression parses an expression, reporting errors with their
+// position as *ExpressionError.
+func parseExpression(input string) (expression, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, &ExpressionError{Pos: t.pos, Message: fmt.Sprintf("unexpected %s", t)}
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpression{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.take()
+		case tokenWord, tokenPhrase, tokenNot, tokenOpen:
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpression{left, right}
+	}
+}
+
+func (p *parser) parseUnary() (expression, error) {
+	if p.peek().kind == tokenNot {
+		p.take()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpression{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (expression, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenWord:
+		words := textWords(t.text)
+		switch len(words) {
+		case 0:
+			return nil, &ExpressionError{Pos: t.pos, Message: fmt.Sprintf("no words to match in %s", t)}
+		case 1:
+			return &wordExpression{words[0]}, nil
+		default:
+			return &phraseExpression{words}, nil
+		}
+	case tokenPhrase:
+		words := textWords(t.text)
+		if len(words) == 0 {
+			return nil, &ExpressionError{Pos: t.pos, Message: "empty phrase"}
+		}
+		return &phraseExpression{words}, nil
+	case tokenOpen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != tokenClose {
+			return nil, &ExpressionError{Pos: closing.pos, Message: fmt.Sprintf("expected \")\" instead of %s", closing)}
+		}
+		return e, nil
+	default:
+		return nil, &ExpressionError{Pos: t.pos, Message: fmt.Sprintf("expected a word, phrase or \"(\" instead of %s", t)}
+	}
+}
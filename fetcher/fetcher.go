@@ -1,142 +1,450 @@
 package fetcher
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
 	"time"
-	"unicode/utf8"
 
-	"github.com/dghubble/go-twitter/twitter"
 	log "github.com/inconshreveable/log15"
 	"github.com/quipo/statsd"
 
 	"github.com/Altoros/tweets-fetcher/geocoder"
+	"github.com/Altoros/tweets-fetcher/recorder"
+	"github.com/Altoros/tweets-fetcher/store"
 )
 
+var (
+	ErrSessionNotFound  = errors.New("Session not found")
+	ErrAlreadyRecording = errors.New("Session is already being recorded")
+	ErrNotRecording     = errors.New("Session isn't being recorded")
+)
+
+// Config holds the settings shared by all sessions.
+type Config struct {
+	// RecordingsDir is where recordings of sessions are written to and
+	// replayed from.
+	RecordingsDir string
+	// Stages make up the pipeline of each session, in order. Blank means
+	// DefaultStages.
+	Stages []StageFactory
+	// Geocoding configures the workers geocoding tweets.
+	Geocoding GeocodeOptions
+	// Buffer configures how messages are passed from sessions to their
+	// reader.
+	Buffer Backpressure
+	// MinBackoff is how long sessions wait before connecting again, 5s by
+	// default. The wait doubles with every failure up to MaxBackoff, 320s by
+	// default. Rate limited sessions wait as long as Twitter asks, or at
+	// least a minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Trending configures how sessions keep track of trending terms.
+	Trending TrendingOptions
+	// Heatmap configures how sessions count their tweets in geohash cells.
+	Heatmap HeatmapOptions
+	// Store keeps the active sessions so that Restore can resume them after
+	// a restart. Nil means sessions aren't kept.
+	Store store.Store
+}
+
 type fetcher struct {
-	logger        log.Logger
-	query         string
-	twitterClient *twitter.Client
-	currentStream *twitter.Stream
-	tweets        chan *Tweet
-	statsdClient  statsd.Statsd
-	geocoder      geocoder.Geocoder
+	logger       log.Logger
+	source       Source
+	replaySource Source
+	statsdClient statsd.Statsd
+	geocoder     geocoder.Geocoder
+	config       Config
+
+	mutex     sync.RWMutex
+	sessions  map[string]*session
+	listeners []func(Session)
+	// restoring holds off saving sessions while they are restored, so that
+	// the ones not restored yet aren't dropped from the store.
+	restoring bool
+
+	stateMutex     sync.RWMutex
+	stateListeners []func(StateChange)
 }
 
 type Fetcher interface {
-	Fetch(string)
-	Stop()
-	Tweets() chan *Tweet
-	CurrentQuery() string
+	// Fetch replaces the session's query, or starts a new session. The
+	// current session is stopped before the new one connects, as sessions
+	// share the source's stream. It fails with a *FetchError if the query is
+	// invalid, leaving the current session running, or if the session
+	// couldn't be started, leaving none.
+	Fetch(id string, query Query) (Session, error)
+	// FetchTransient is Fetch for sessions that aren't kept in the store, as
+	// whatever runs them, e.g. a schedule, isn't restored along with them.
+	FetchTransient(id string, query Query) (Session, error)
+	Stop(id string)
+	StopAll()
+	Session(id string) (Session, bool)
+	Sessions() []Session
+	StartRecording(id string, options recorder.Options) (recorder.Status, error)
+	StopRecording(id string) (recorder.Status, error)
+	// OnSessionStart calls listener with every session started from then on,
+	// however it was started.
+	OnSessionStart(listener func(Session))
+	// Restore resumes the sessions kept in the store, returning how many
+	// were resumed. Sessions that fail to connect keep connecting with
+	// backoff and stay in the store, those whose query is invalid are
+	// dropped.
+	Restore() (int, error)
+	// OnStateChange calls listener with every change of state of any
+	// session from then on, in the order they happen for each session. The
+	// listener is called without any lock of the session held, but holds up
+	// its next change of state, so it mustn't block. The server passes the
+	// changes on to the clients of the session.
+	OnStateChange(listener func(StateChange))
 }
 
-func New(logger log.Logger, twitterClient *twitter.Client, statsdClient statsd.Statsd, geocoder geocoder.Geocoder) Fetcher {
+func New(logger log.Logger, source Source, statsdClient statsd.Statsd, geocoder geocoder.Geocoder, config Config) Fetcher {
 	return &fetcher{
-		logger:        logger.New("module", "fetcher"),
-		twitterClient: twitterClient,
-		tweets:        make(chan *Tweet),
-		statsdClient:  statsdClient,
-		geocoder:      geocoder,
+		logger:       logger.New("module", "fetcher"),
+		source:       source,
+		replaySource: newReplaySource(config.RecordingsDir),
+		statsdClient: statsdClient,
+		geocoder:     geocoder,
+		config:       config,
+		sessions:     make(map[string]*session),
 	}
 }
 
-func (f *fetcher) Fetch(query string) {
-	f.logger.Info("Fetch request", "query", query)
+// fetchOptions tell fetch how to treat the session it starts.
+type fetchOptions struct {
+	// transient sessions aren't kept in the store.
+	transient bool
+	// retry keeps a session that failed to connect, connecting again with
+	// backoff, unless its query is invalid. fetch returns it along with
+	// the error then.
+	retry bool
+}
 
-	f.stopFetching()
-	f.query = query
-	err := f.startFetching()
-	if err != nil {
-		f.logger.Error("Fetching tweets", "err", err)
-		return
+func (f *fetcher) Fetch(id string, query Query) (Session, error) {
+	return f.fetch(id, query, fetchOptions{})
+}
+
+func (f *fetcher) FetchTransient(id string, query Query) (Session, error) {
+	return f.fetch(id, query, fetchOptions{transient: true})
+}
+
+func (f *fetcher) fetch(id string, query Query, options fetchOptions) (Session, error) {
+	f.logger.Info("Fetch request", "session", id, "query", query.String(), "transient", options.transient)
+	if err := query.Compile(); err != nil {
+		return nil, f.fetchFailed(id, invalidQueryError(err))
+	}
+	if err := query.Validate(); err != nil {
+		return nil, f.fetchFailed(id, invalidQueryError(err))
+	}
+
+	f.mutex.Lock()
+	current, replaced := f.sessions[id]
+	delete(f.sessions, id)
+	f.mutex.Unlock()
+	if replaced {
+		current.stop()
+	}
+
+	// The new session connects without holding the mutex, as that can take
+	// a while.
+	s := newSession(f, id, query)
+	s.transient = options.transient
+	var fetchErr *FetchError
+	if err := s.start(); err != nil {
+		fetchErr = fetchError(err)
+		if !options.retry || fetchErr.Kind == ErrorInvalidQuery {
+			s.stop()
+			if replaced {
+				f.mutex.Lock()
+				f.save()
+				f.mutex.Unlock()
+			}
+			return nil, f.fetchFailed(id, fetchErr)
+		}
+		f.fetchFailed(id, fetchErr)
+	}
+
+	f.mutex.Lock()
+	current, replaced = f.sessions[id]
+	f.sessions[id] = s
+	f.save()
+	listeners := append([]func(Session){}, f.listeners...)
+	f.mutex.Unlock()
+
+	// Another Fetch of the session may have started one meanwhile.
+	if replaced {
+		current.stop()
+	}
+	for _, listener := range listeners {
+		listener(s)
 	}
 
-	go f.startConsumingCurrentStream()
+	if fetchErr != nil {
+		return s, fetchErr
+	}
+	return s, nil
 }
 
-func (f *fetcher) Stop() {
-	f.stopFetching()
-	f.query = ""
+func (f *fetcher) fetchFailed(id string, err *FetchError) error {
+	f.logger.Error("Failed to start fetching", "session", id, "kind", err.Kind, "err", err)
+	f.incr("fetch.errors." + err.Kind)
+	return err
 }
 
-func (f *fetcher) Tweets() chan *Tweet {
-	return f.tweets
+func (f *fetcher) Stop(id string) {
+	f.mutex.Lock()
+	s, ok := f.sessions[id]
+	if ok {
+		delete(f.sessions, id)
+		f.save()
+	}
+	f.mutex.Unlock()
+
+	if ok {
+		s.stop()
+	}
 }
 
-func (f *fetcher) stopFetching() {
-	if f.currentStream != nil {
-		f.logger.Info("Stop fetching", "query", f.query)
-		f.currentStream.Stop()
-		f.currentStream = nil
+// StopAll stops every session, e.g. on shutdown, leaving them in the store
+// to be restored.
+func (f *fetcher) StopAll() {
+	f.mutex.Lock()
+	sessions := make([]*session, 0, len(f.sessions))
+	for id, s := range f.sessions {
+		sessions = append(sessions, s)
+		delete(f.sessions, id)
+	}
+	f.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.stop()
 	}
 }
 
-func (f *fetcher) startFetching() error {
-	f.logger.Info("Start fetching", "query", f.query)
-	params := &twitter.StreamFilterParams{
-		Track:         []string{f.query},
-		StallWarnings: twitter.Bool(true),
+func (f *fetcher) Session(id string) (Session, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, false
 	}
-	stream, err := f.twitterClient.Streams.Filter(params)
-	if err != nil {
-		return err
+	return s, true
+}
+
+func (f *fetcher) Sessions() []Session {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	ids := make([]string, 0, len(f.sessions))
+	for id := range f.sessions {
+		ids = append(ids, id)
 	}
-	f.currentStream = stream
-	return nil
+	sort.Strings(ids)
+
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		sessions = append(sessions, f.sessions[id])
+	}
+	return sessions
 }
 
-func (f *fetcher) CurrentQuery() string {
-	return f.query
+// StartRecording writes every message the session receives to disk until
+// StopRecording is called or the session is stopped.
+func (f *fetcher) StartRecording(id string, options recorder.Options) (recorder.Status, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return recorder.Status{}, ErrSessionNotFound
+	}
+	return s.startRecording(f.config.RecordingsDir, options)
 }
 
-func (f *fetcher) startConsumingCurrentStream() {
-	for message := range f.currentStream.Messages {
-		switch v := message.(type) {
-		case *twitter.Tweet:
-			f.processTweet(v)
-		case *twitter.StreamLimit:
-			f.logger.Warn("Stream limit", "track", v.Track)
-		}
+func (f *fetcher) StopRecording(id string) (recorder.Status, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return recorder.Status{}, ErrSessionNotFound
 	}
+	return s.stopRecording()
 }
 
-func (f *fetcher) processTweet(tweet *twitter.Tweet) {
-	err := f.statsdClient.Incr("totalTweets", 1)
+func (f *fetcher) OnSessionStart(listener func(Session)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.listeners = append(f.listeners, listener)
+}
+
+func (f *fetcher) Restore() (int, error) {
+	if f.config.Store == nil {
+		return 0, nil
+	}
+
+	saved, err := f.config.Store.Load()
 	if err != nil {
-		f.logger.Warn("Failed to emit metric totalTweets", "err", err)
+		return 0, err
 	}
-	if tweet.Coordinates != nil {
-		f.logger.Debug("Received a tweet", "text", tweet.Text, "coordinates", tweet.Coordinates.Coordinates)
 
-		start := time.Now()
-		country, err := f.geocoder.Country(tweet.Coordinates.Coordinates[1], tweet.Coordinates.Coordinates[0])
-		elapsed := time.Since(start)
+	f.mutex.Lock()
+	f.restoring = true
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
 
-		if err != nil {
-			f.logger.Warn("Failed to geocode coordinates to country", "err", err)
-		} else {
-			f.statsdClient.Incr(fmt.Sprintf("countries.%s", country), 1)
-			f.statsdClient.Timing("googleApiRequestTime", elapsed.Nanoseconds()/1000000)
+		f.restoring = false
+		f.save()
+	}()
+
+	restored := 0
+	for _, session := range saved {
+		var query Query
+		if err := json.Unmarshal(session.Query, &query); err != nil {
+			f.logger.Error("Failed to decode saved query", "session", session.Id, "err", err)
+			f.incr("sessions.restoreErrors")
+			continue
+		}
+		// Track terms are derived from the expression again.
+		if query.Expression != "" {
+			query.Track = nil
 		}
 
-		f.tweets <- &Tweet{
-			Id:   tweet.IDStr,
-			Text: tweet.Text,
-			User: tweet.User.ScreenName,
-			Coordinates: Coordinates{
-				Long: tweet.Coordinates.Coordinates[0],
-				Lat:  tweet.Coordinates.Coordinates[1],
-			},
+		// Sessions that fail to connect stay, connecting again with
+		// backoff, so that they aren't dropped from the store.
+		if s, err := f.fetch(session.Id, query, fetchOptions{retry: true}); err != nil {
+			if s != nil {
+				f.logger.Warn("Restored session failed to connect, connecting again", "session", session.Id, "err", err)
+			}
+			f.incr("sessions.restoreErrors")
+			continue
 		}
+		f.logger.Info("Restored session", "session", session.Id, "query", query.String(), "savedAt", session.SavedAt)
+		f.incr("sessions.restored")
+		restored++
+	}
+	return restored, nil
+}
 
-		err = f.statsdClient.Incr("tweetsWithLocation", 1)
-		if err != nil {
-			f.logger.Warn("Failed to emit metric tweetsWithLocation", "err", err)
+// save keeps the active sessions in the store, but for transient ones. It
+// has to be called with the mutex held.
+func (f *fetcher) save() {
+	if f.config.Store == nil || f.restoring {
+		return
+	}
+
+	now := time.Now()
+	saved := make([]store.Session, 0, len(f.sessions))
+	for id, s := range f.sessions {
+		if s.transient {
+			continue
 		}
-		err = f.statsdClient.Incr("tweetLength", int64(utf8.RuneCountInString(tweet.Text)))
+		query, err := json.Marshal(s.query)
 		if err != nil {
-			f.logger.Warn("Failed to emit metric tweetLength", "err", err)
+			f.logger.Error("Failed to encode query to save", "session", id, "err", err)
+			continue
 		}
-	} else {
-		f.logger.Debug("Received a tweet without location, skipping")
+		saved = append(saved, store.Session{Id: id, Query: query, SavedAt: now})
+	}
+	sort.Sort(sessionsByID(saved))
+
+	if err := f.config.Store.Save(saved); err != nil {
+		f.logger.Error("Failed to save sessions", "err", err)
+		f.incr("sessions.saveErrors")
+	}
+}
+
+type sessionsByID []store.Session
+
+func (s sessionsByID) Len() int           { return len(s) }
+func (s sessionsByID) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s sessionsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (f *fetcher) incr(metric string) {
+	if err := f.statsdClient.Incr(metric, 1); err != nil {
+		f.logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+}
+
+func (f *fetcher) OnStateChange(listener func(StateChange)) {
+	f.stateMutex.Lock()
+	defer f.stateMutex.Unlock()
+
+	f.stateListeners = append(f.stateListeners, listener)
+}
+
+func (f *fetcher) stateChanged(change StateChange) {
+	f.logger.Debug("Session state changed", "session", change.Session, "from", change.From, "to", change.To, "err", change.Err)
+
+	f.stateMutex.RLock()
+	listeners := append([]func(StateChange){}, f.stateListeners...)
+	f.stateMutex.RUnlock()
+
+	for _, listener := range listeners {
+		listener(change)
+	}
+}
+
+func (f *fetcher) backoff() backoff {
+	b := backoff{min: f.config.MinBackoff, max: f.config.MaxBackoff}
+	if b.min == 0 {
+		b.min = 5 * time.Second
+	}
+	if b.max == 0 {
+		b.max = 320 * time.Second
+	}
+	return b
+}
+
+// backoff is how long sessions wait between attempts to connect.
+type backoff struct {
+	min, max time.Duration
+}
+
+// rateLimitBackoff is how long sessions wait at least once rate limited,
+// as Twitter asks apps to.
+const rateLimitBackoff = time.Minute
+
+// after returns how long to wait after a failure to connect with err: as
+// long as Twitter asked for, or at least rateLimitBackoff when rate limited.
+func (b backoff) after(wait time.Duration, err error) time.Duration {
+	fetchErr, ok := err.(*FetchError)
+	if !ok {
+		return wait
+	}
+	if fetchErr.RetryAfter > 0 {
+		return fetchErr.RetryAfter
+	}
+	if fetchErr.Kind == ErrorRateLimited && wait < rateLimitBackoff {
+		return rateLimitBackoff
+	}
+	return wait
+}
+
+func (b backoff) next(wait time.Duration) time.Duration {
+	wait *= 2
+	if wait > b.max {
+		return b.max
+	}
+	return wait
+}
+
+func (f *fetcher) stages() []StageFactory {
+	if f.config.Stages == nil {
+		return DefaultStages()
+	}
+	return f.config.Stages
+}
+
+func (f *fetcher) sourceFor(query Query) Source {
+	if query.IsReplay() {
+		return f.replaySource
 	}
+	return f.source
 }
@@ -0,0 +1,1824 @@
+package fetcher_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/recorder"
+	"github.com/Altoros/tweets-fetcher/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeGeocoder struct {
+	country string
+	err     error
+}
+
+func (fg *fakeGeocoder) Country(lat, lng float64) (string, error) {
+	return fg.country, fg.err
+}
+
+func geotaggedTweet(id string, long, lat float64) *twitter.Tweet {
+	return &twitter.Tweet{
+		IDStr: id,
+		Text:  "tweet " + id,
+		User:  &twitter.User{IDStr: "1", ScreenName: "user"},
+		Coordinates: &twitter.Coordinates{
+			Coordinates: [2]float64{long, lat},
+		},
+	}
+}
+
+// blockingGeocoder answers once released, telling when it has been asked.
+type blockingGeocoder struct {
+	asked   chan struct{}
+	release chan struct{}
+}
+
+func newBlockingGeocoder() *blockingGeocoder {
+	return &blockingGeocoder{
+		asked:   make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (bg *blockingGeocoder) Country(lat, lng float64) (string, error) {
+	bg.asked <- struct{}{}
+	<-bg.release
+	return "Germany", nil
+}
+
+func placeTweet(id string) *twitter.Tweet {
+	return &twitter.Tweet{
+		IDStr: id,
+		Text:  "tweet " + id,
+		User:  &twitter.User{IDStr: "1", ScreenName: "user"},
+		Place: &twitter.Place{
+			Country: "France",
+			BoundingBox: &twitter.BoundingBox{
+				Coordinates: [][][2]float64{{{2.2, 48.8}, {2.2, 48.9}, {2.4, 48.9}, {2.4, 48.8}}},
+			},
+		},
+	}
+}
+
+// fakeStatsd counts the metrics emitted.
+type fakeStatsd struct {
+	statsd.NoopClient
+
+	mutex    sync.Mutex
+	counters map[string]int64
+	timings  map[string]int
+	gauges   map[string][]int64
+}
+
+func newFakeStatsd() *fakeStatsd {
+	return &fakeStatsd{
+		counters: make(map[string]int64),
+		timings:  make(map[string]int),
+		gauges:   make(map[string][]int64),
+	}
+}
+
+func (fs *fakeStatsd) Incr(stat string, count int64) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.counters[stat] += count
+	return nil
+}
+
+func (fs *fakeStatsd) PrecisionTiming(stat string, delta time.Duration) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.timings[stat]++
+	return nil
+}
+
+func (fs *fakeStatsd) Gauge(stat string, value int64) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.gauges[stat] = append(fs.gauges[stat], value)
+	return nil
+}
+
+func (fs *fakeStatsd) gauge(stat string) []int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return append([]int64{}, fs.gauges[stat]...)
+}
+
+func (fs *fakeStatsd) counter(stat string) int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.counters[stat]
+}
+
+func (fs *fakeStatsd) timing(stat string) int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.timings[stat]
+}
+
+// searchingSource backfills sessions with the given tweets.
+type searchingSource struct {
+	*channelSource
+	tweets []*twitter.Tweet
+}
+
+func (s *searchingSource) Search(query fetcher.Query, limit int) ([]*twitter.Tweet, error) {
+	return s.tweets, nil
+}
+
+// flakySource streams a single tweet, after which the stream ends. Once it
+// did, it fails to open the next failures times, with err if set.
+type flakySource struct {
+	mutex    sync.Mutex
+	opened   bool
+	failures int
+	err      error
+}
+
+func (s *flakySource) Open(query fetcher.Query) (fetcher.Stream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.opened && s.failures > 0 {
+		s.failures--
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, errors.New("Service unavailable")
+	}
+	s.opened = true
+	messages := make(chan interface{}, 1)
+	messages <- geotaggedTweet("10", 13.4, 52.5)
+	close(messages)
+	return &endedStream{messages: messages}, nil
+}
+
+type endedStream struct {
+	messages chan interface{}
+}
+
+func (s *endedStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *endedStream) Stop() {
+}
+
+// stateRecorder collects the state changes of sessions.
+type stateRecorder struct {
+	mutex   sync.Mutex
+	changes []fetcher.StateChange
+}
+
+func (r *stateRecorder) record(change fetcher.StateChange) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.changes = append(r.changes, change)
+}
+
+func (r *stateRecorder) states() []fetcher.State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	states := []fetcher.State{}
+	for _, change := range r.changes {
+		states = append(states, change.To)
+	}
+	return states
+}
+
+// failingSource fails to open with err.
+type failingSource struct {
+	err error
+}
+
+func (s *failingSource) Open(query fetcher.Query) (fetcher.Stream, error) {
+	return nil, s.err
+}
+
+// slowSource opens streams of channelSource once released, telling when
+// it is asked to. It fails to open with err if set.
+type slowSource struct {
+	*channelSource
+	opening chan struct{}
+	release chan struct{}
+
+	mutex sync.Mutex
+	err   error
+}
+
+func newSlowSource() *slowSource {
+	return &slowSource{
+		channelSource: newChannelSource(),
+		opening:       make(chan struct{}, 1),
+		release:       make(chan struct{}),
+	}
+}
+
+func (s *slowSource) Open(query fetcher.Query) (fetcher.Stream, error) {
+	select {
+	case s.opening <- struct{}{}:
+	default:
+	}
+	<-s.release
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.channelSource.Open(query)
+}
+
+func (s *slowSource) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+}
+
+// fakeTransport answers every request with status, header and body, or
+// stream if set, or fails with err. It keeps the last request.
+type fakeTransport struct {
+	status  int
+	header  http.Header
+	body    string
+	stream  io.ReadCloser
+	err     error
+	request *http.Request
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.request = req
+	if t.err != nil {
+		return nil, t.err
+	}
+	header := t.header
+	if header == nil {
+		header = http.Header{}
+	}
+	body := t.stream
+	if body == nil && t.body != "" {
+		body = ioutil.NopCloser(strings.NewReader(t.body))
+	} else if body == nil {
+		body = ioutil.NopCloser(strings.NewReader(`{"errors":[]}`))
+	}
+	return &http.Response{
+		StatusCode: t.status,
+		Status:     fmt.Sprintf("%d %s", t.status, http.StatusText(t.status)),
+		Header:     header,
+		Body:       body,
+		Request:    req,
+	}, nil
+}
+
+// streamTransport answers every request with a new stream, keeping the
+// form each was requested with.
+type streamTransport struct {
+	mutex   sync.Mutex
+	forms   []url.Values
+	streams []*transportStream
+}
+
+type transportStream struct {
+	*io.PipeReader
+	writer *io.PipeWriter
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *transportStream) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return s.PipeReader.Close()
+}
+
+func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	stream := &transportStream{PipeReader: reader, writer: writer, closed: make(chan struct{})}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.forms = append(t.forms, req.PostForm)
+	t.streams = append(t.streams, stream)
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: stream, Request: req}, nil
+}
+
+// connections returns how many streams were requested.
+func (t *streamTransport) connections() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.streams)
+}
+
+func (t *streamTransport) form(i int) url.Values {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.forms[i]
+}
+
+func (t *streamTransport) stream(i int) *transportStream {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.streams[i]
+}
+
+// memoryStore keeps saved sessions in memory.
+type memoryStore struct {
+	mutex    sync.Mutex
+	sessions []store.Session
+	saves    int
+}
+
+func (s *memoryStore) Save(sessions []store.Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions = sessions
+	s.saves++
+	return nil
+}
+
+func (s *memoryStore) Load() ([]store.Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sessions, nil
+}
+
+func (s *memoryStore) ids() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := []string{}
+	for _, session := range s.sessions {
+		ids = append(ids, session.Id)
+	}
+	return ids
+}
+
+var _ = Describe("Fetcher", func() {
+	var (
+		source        *channelSource
+		tweetFetcher  fetcher.Fetcher
+		recordingsDir string
+	)
+
+	BeforeEach(func() {
+		logger := log.New()
+		logger.SetHandler(log.DiscardHandler())
+
+		var err error
+		recordingsDir, err = ioutil.TempDir("", "recordings")
+		Expect(err).NotTo(HaveOccurred())
+
+		source = newChannelSource()
+		tweetFetcher = fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+			RecordingsDir: recordingsDir,
+		})
+	})
+
+	AfterEach(func() {
+		tweetFetcher.StopAll()
+		os.RemoveAll(recordingsDir)
+	})
+
+	It("opens the source for the session's query", func() {
+		tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		Eventually(source.Queries()).Should(Receive(Equal(fetcher.Query{Track: []string{"beer"}})))
+	})
+
+	It("delivers geotagged tweets", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		go source.Send(geotaggedTweet("10", 13.4, 52.5))
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageTweet))
+		Expect(message.Tweet.Id).To(Equal("10"))
+		Expect(message.Tweet.Coordinates).To(Equal(fetcher.Coordinates{Lat: 52.5, Long: 13.4}))
+		Expect(message.Tweet.Location).To(Equal(fetcher.LocationExact))
+		Eventually(session.Tweets).Should(Equal(int64(1)))
+	})
+
+	It("delivers what clients show of tweets", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		tweet := geotaggedTweet("10", 13.4, 52.5)
+		tweet.CreatedAt = "Tue Sep 06 09:20:58 +0000 2016"
+		tweet.Lang = "de"
+		tweet.User = &twitter.User{
+			IDStr:                "1",
+			ScreenName:           "user",
+			Name:                 "A User",
+			ProfileImageURLHttps: "https://pbs.twimg.com/profile.png",
+			FollowersCount:       42,
+		}
+		tweet.Place = &twitter.Place{Name: "Berlin", FullName: "Berlin, Germany", Country: "Germany", CountryCode: "DE"}
+		tweet.Entities = &twitter.Entities{
+			Hashtags:     []twitter.HashtagEntity{{Text: "beer"}},
+			UserMentions: []twitter.MentionEntity{{ScreenName: "golang"}},
+			Urls:         []twitter.URLEntity{{ExpandedURL: "https://golang.org"}},
+		}
+		tweet.ExtendedEntities = &twitter.ExtendedEntity{
+			Media: []twitter.MediaEntity{{Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/beer.jpg"}},
+		}
+		tweet.InReplyToStatusIDStr = "9"
+		go source.Send(tweet)
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Version).To(Equal(fetcher.TweetVersion))
+		Expect(message.Tweet.CreatedAt).To(Equal(time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC)))
+		Expect(message.Tweet.Language).To(Equal("de"))
+		Expect(message.Tweet.UserName).To(Equal("A User"))
+		Expect(message.Tweet.ProfileImageURL).To(Equal("https://pbs.twimg.com/profile.png"))
+		Expect(message.Tweet.Followers).To(Equal(42))
+		Expect(message.Tweet.Place).To(Equal(&fetcher.Place{Name: "Berlin", FullName: "Berlin, Germany", Country: "Germany", CountryCode: "DE"}))
+		Expect(message.Tweet.Hashtags).To(Equal([]string{"beer"}))
+		Expect(message.Tweet.Mentions).To(Equal([]string{"golang"}))
+		Expect(message.Tweet.URLs).To(Equal([]string{"https://golang.org"}))
+		Expect(message.Tweet.Media).To(Equal([]fetcher.Media{{
+			Type:         "photo",
+			URL:          "https://pbs.twimg.com/media/beer.jpg",
+			ThumbnailURL: "https://pbs.twimg.com/media/beer.jpg:thumb",
+		}}))
+		Expect(message.Tweet.Reply).To(BeTrue())
+		Expect(message.Tweet.Retweet).To(BeFalse())
+		Expect(message.Tweet.Quote).To(BeFalse())
+	})
+
+	It("locates tweets without coordinates by their place", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		tweet := geotaggedTweet("10", 0, 0)
+		tweet.Coordinates = nil
+		tweet.Place = &twitter.Place{
+			Country: "Germany",
+			BoundingBox: &twitter.BoundingBox{
+				Coordinates: [][][2]float64{{{13, 52}, {14, 52}, {14, 53}, {13, 53}}},
+			},
+		}
+		go source.Send(tweet)
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Coordinates).To(Equal(fetcher.Coordinates{Lat: 52.5, Long: 13.5}))
+		Expect(message.Tweet.Location).To(Equal(fetcher.LocationPlace))
+		Expect(message.Tweet.Accuracy).To(BeNumerically("~", 65000, 1000))
+	})
+
+	It("skips tweets without location", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		tweet := geotaggedTweet("10", 0, 0)
+		tweet.Coordinates = nil
+		source.Send(tweet)
+		go source.Send(geotaggedTweet("11", 13.4, 52.5))
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("11"))
+	})
+
+	It("drops tweets that don't match the expression, whichever source sent them", func() {
+		session, err := tweetFetcher.Fetch("default", fetcher.Query{Expression: "beer -wine"})
+		Expect(err).NotTo(HaveOccurred())
+
+		wine := geotaggedTweet("10", 13.4, 52.5)
+		wine.Text = "beer and wine"
+		beer := geotaggedTweet("11", 13.4, 52.5)
+		beer.Text = "just beer"
+		go func() {
+			source.Send(wine)
+			source.Send(beer)
+		}()
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("11"))
+	})
+
+	It("turns deletions into retractions", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		go source.Send(&twitter.StatusDeletion{IDStr: "10"})
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageRetraction))
+		Expect(message.Retraction.Id).To(Equal("10"))
+		Expect(message.Retraction.Reason).To(Equal(fetcher.RetractionDeleted))
+	})
+
+	It("reports stream limits", func() {
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+		go source.Send(&twitter.StreamLimit{Track: 1234})
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageStatus))
+		Expect(message.Status.Kind).To(Equal(fetcher.StatusLimit))
+		Expect(message.Status.Undelivered).To(Equal(int64(1234)))
+	})
+
+	It("keeps sessions apart", func() {
+		first, _ := tweetFetcher.Fetch("first", fetcher.Query{Track: []string{"beer"}})
+		second, _ := tweetFetcher.Fetch("second", fetcher.Query{Track: []string{"wine"}})
+
+		Expect(tweetFetcher.Sessions()).To(HaveLen(2))
+
+		tweetFetcher.Stop("first")
+		Eventually(first.Messages()).Should(BeClosed())
+		Consistently(second.Messages()).ShouldNot(BeClosed())
+
+		_, ok := tweetFetcher.Session("first")
+		Expect(ok).To(BeFalse())
+		Expect(tweetFetcher.Sessions()).To(HaveLen(1))
+	})
+
+	Describe("recording", func() {
+		It("records every message the session receives", func() {
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			status, err := tweetFetcher.StartRecording("default", recorder.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(status.File)).To(Equal(recordingsDir))
+
+			tweet := geotaggedTweet("10", 0, 0)
+			tweet.Coordinates = nil
+			source.Send(tweet)
+			source.Send(&twitter.StreamLimit{Track: 42})
+
+			session, _ := tweetFetcher.Session("default")
+			Eventually(session.Messages()).Should(Receive())
+
+			status, err = tweetFetcher.StopRecording("default")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Records).To(Equal(int64(2)))
+
+			content, err := ioutil.ReadFile(status.File)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			Expect(lines).To(HaveLen(2))
+
+			var record recorder.Record
+			Expect(json.Unmarshal([]byte(lines[1]), &record)).To(Succeed())
+			Expect(record.Query).To(Equal("beer"))
+			Expect(record.Message).To(MatchJSON(`{"limit": {"track": 42}}`))
+		})
+
+		It("records what Twitter sent as it is, tweets dropped locally included", func() {
+			logger := log.New()
+			logger.SetHandler(log.DiscardHandler())
+			body, stream := io.Pipe()
+			defer stream.Close()
+			source := fetcher.NewTwitterSource(logger, &http.Client{Transport: &fakeTransport{status: http.StatusOK, stream: body}})
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{RecordingsDir: recordingsDir})
+			defer tweetFetcher.StopAll()
+
+			session, err := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}, Locations: []fetcher.BoundingBox{
+				{SouthWest: fetcher.Coordinates{Lat: 52, Long: 13}, NorthEast: fetcher.Coordinates{Lat: 53, Long: 14}},
+			}})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tweetFetcher.StartRecording("default", recorder.Options{})
+			Expect(err).NotTo(HaveOccurred())
+
+			wine := `{"id_str": "10", "text": "wine", "retweet_count": 0, "coordinates": {"coordinates": [13.4, 52.5]}, "unknown": {"kept": true}}`
+			beer := `{"id_str": "11", "text": "beer", "retweet_count": 0, "coordinates": {"coordinates": [13.4, 52.5]}}`
+			go stream.Write([]byte(wine + "\r\n" + beer + "\r\n"))
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+
+			status, err := tweetFetcher.StopRecording("default")
+			Expect(err).NotTo(HaveOccurred())
+			content, err := ioutil.ReadFile(status.File)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			Expect(lines).To(HaveLen(2))
+
+			var record recorder.Record
+			Expect(json.Unmarshal([]byte(lines[0]), &record)).To(Succeed())
+			Expect(record.Message).To(MatchJSON(wine))
+			Expect(record.Dropped).To(BeTrue())
+			record = recorder.Record{}
+			Expect(json.Unmarshal([]byte(lines[1]), &record)).To(Succeed())
+			Expect(record.Dropped).To(BeFalse())
+		})
+
+		It("fails for unknown sessions", func() {
+			_, err := tweetFetcher.StartRecording("missing", recorder.Options{})
+			Expect(err).To(Equal(fetcher.ErrSessionNotFound))
+		})
+
+		It("fails to start recording twice", func() {
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			_, err := tweetFetcher.StartRecording("default", recorder.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tweetFetcher.StartRecording("default", recorder.Options{})
+			Expect(err).To(Equal(fetcher.ErrAlreadyRecording))
+		})
+	})
+
+	Describe("replay", func() {
+		var start time.Time
+
+		writeRecording := func(offsets ...time.Duration) {
+			rec, err := recorder.New(recordingsDir, "recorded", recorder.Options{})
+			Expect(err).NotTo(HaveOccurred())
+
+			start = time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC)
+			for i, offset := range offsets {
+				message, err := json.Marshal(geotaggedTweet(fmt.Sprint(i+1), 13.4, 52.5))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rec.Write(&recorder.Record{
+					Query:      "beer",
+					ReceivedAt: start.Add(offset),
+					Message:    message,
+				})).To(Succeed())
+			}
+			Expect(rec.Close()).To(Succeed())
+			Expect(os.Rename(rec.Status().File, filepath.Join(recordingsDir, "recorded.jsonl"))).To(Succeed())
+		}
+
+		replay := func(speed float64) fetcher.Query {
+			return fetcher.Query{
+				Mode:   fetcher.ModeReplay,
+				Replay: &fetcher.ReplayOptions{File: "recorded.jsonl", Speed: speed},
+			}
+		}
+
+		It("plays back recorded tweets through the session", func() {
+			writeRecording(0, time.Second, 2*time.Second)
+			session, _ := tweetFetcher.Fetch("default", replay(100))
+
+			var message *fetcher.Message
+			for _, id := range []string{"1", "2", "3"} {
+				Eventually(session.Messages()).Should(Receive(&message))
+				Expect(message.Tweet.Id).To(Equal(id))
+				Expect(message.Tweet.Coordinates).To(Equal(fetcher.Coordinates{Lat: 52.5, Long: 13.4}))
+			}
+
+			replay, ok := session.Replay()
+			Expect(ok).To(BeTrue())
+			Eventually(func() bool { return replay.Status().Finished }).Should(BeTrue())
+		})
+
+		It("leaves out tweets the recorded session dropped", func() {
+			rec, err := recorder.New(recordingsDir, "recorded", recorder.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			start := time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC)
+			for i, dropped := range []bool{true, false, true} {
+				message, err := json.Marshal(geotaggedTweet(fmt.Sprint(i+1), 13.4, 52.5))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rec.Write(&recorder.Record{
+					Query:      "beer",
+					ReceivedAt: start.Add(time.Duration(i) * time.Millisecond),
+					Message:    message,
+					Dropped:    dropped,
+				})).To(Succeed())
+			}
+			Expect(rec.Close()).To(Succeed())
+			Expect(os.Rename(rec.Status().File, filepath.Join(recordingsDir, "recorded.jsonl"))).To(Succeed())
+
+			session, _ := tweetFetcher.Fetch("default", replay(1))
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("2"))
+
+			replay, _ := session.Replay()
+			Eventually(func() bool { return replay.Status().Finished }).Should(BeTrue())
+			Consistently(session.Messages(), "50ms").ShouldNot(Receive())
+		})
+
+		It("keeps the recorded timing scaled by speed", func() {
+			writeRecording(0, time.Hour)
+			session, _ := tweetFetcher.Fetch("default", replay(1))
+
+			Eventually(session.Messages()).Should(Receive())
+			Consistently(session.Messages(), "50ms").ShouldNot(Receive())
+		})
+
+		It("seeks and pauses", func() {
+			writeRecording(0, time.Hour, 2*time.Hour)
+			session, _ := tweetFetcher.Fetch("default", replay(1))
+			Eventually(session.Messages()).Should(Receive())
+
+			replay, _ := session.Replay()
+			replay.Seek(2 * time.Hour)
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("3"))
+
+			replay.Seek(time.Hour)
+			replay.Pause()
+			Consistently(session.Messages(), "50ms").ShouldNot(Receive())
+			Expect(replay.Status().Paused).To(BeTrue())
+
+			replay.Resume()
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("2"))
+		})
+
+		It("isn't available for live sessions", func() {
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			_, ok := session.Replay()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("backfill", func() {
+		var logger log.Logger
+
+		BeforeEach(func() {
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+		})
+
+		It("sends historical tweets before live ones", func() {
+			source := &searchingSource{
+				channelSource: newChannelSource(),
+				tweets:        []*twitter.Tweet{geotaggedTweet("1", 13.4, 52.5), geotaggedTweet("2", 13.4, 52.5)},
+			}
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}, Backfill: 10})
+			go source.Send(geotaggedTweet("3", 13.4, 52.5))
+
+			var message *fetcher.Message
+			for _, id := range []string{"1", "2"} {
+				Eventually(session.Messages()).Should(Receive(&message))
+				Expect(message.Tweet.Id).To(Equal(id))
+				Expect(message.Tweet.Historical).To(BeTrue())
+			}
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("3"))
+			Expect(message.Tweet.Historical).To(BeFalse())
+		})
+
+		It("isn't run unless asked for", func() {
+			source := &searchingSource{
+				channelSource: newChannelSource(),
+				tweets:        []*twitter.Tweet{geotaggedTweet("1", 13.4, 52.5)},
+			}
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Consistently(session.Messages(), "50ms").ShouldNot(Receive())
+		})
+
+		It("skips sources that can't search", func() {
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}, Backfill: 10})
+			go source.Send(geotaggedTweet("3", 13.4, 52.5))
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("3"))
+		})
+	})
+
+	Describe("pipeline", func() {
+		var (
+			statsdClient *fakeStatsd
+			logger       log.Logger
+		)
+
+		BeforeEach(func() {
+			statsdClient = newFakeStatsd()
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+		})
+
+		It("runs tweets through the stages in order", func() {
+			seen := make(map[string]bool)
+			dedup := func(session fetcher.StageContext) fetcher.Stage {
+				return fetcher.FilterStage("dedup", func(item *fetcher.Item) bool {
+					if seen[item.Tweet.Text] {
+						return false
+					}
+					seen[item.Tweet.Text] = true
+					return true
+				})
+			}
+			stages := fetcher.DefaultStages()
+			stages = append(stages[:3], append([]fetcher.StageFactory{dedup}, stages[3:]...)...)
+
+			tweetFetcher := fetcher.New(logger, source, statsdClient, &fakeGeocoder{country: "Germany"}, fetcher.Config{Stages: stages})
+			defer tweetFetcher.StopAll()
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			go func() {
+				source.Send(geotaggedTweet("10", 13.4, 52.5))
+				source.Send(geotaggedTweet("10", 13.4, 52.5))
+				source.Send(geotaggedTweet("11", 13.4, 52.5))
+			}()
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("10"))
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+
+			Eventually(func() int64 { return statsdClient.counter("tweetsWithLocation") }).Should(Equal(int64(2)))
+			Expect(statsdClient.counter("totalTweets")).To(Equal(int64(3)))
+			Expect(statsdClient.counter("pipeline.dedup.dropped")).To(Equal(int64(1)))
+			Expect(statsdClient.counter("countries.Germany")).To(Equal(int64(2)))
+			Expect(statsdClient.timing("pipeline.dedup.time")).To(Equal(3))
+			Expect(statsdClient.timing("pipeline.sink.time")).To(Equal(2))
+		})
+
+		It("counts tweets dropped for lack of location", func() {
+			tweetFetcher := fetcher.New(logger, source, statsdClient, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			source.Send(&twitter.Tweet{IDStr: "10", Text: "no location", User: &twitter.User{}})
+
+			Eventually(func() int64 { return statsdClient.counter("pipeline.locate.dropped") }).Should(Equal(int64(1)))
+		})
+
+		It("configures stages per session", func() {
+			onlySamples := func(session fetcher.StageContext) fetcher.Stage {
+				if !session.Query.IsSample() {
+					return nil
+				}
+				return fetcher.FilterStage("nothing", func(item *fetcher.Item) bool { return false })
+			}
+
+			tweetFetcher := fetcher.New(logger, source, statsdClient, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				Stages: append(fetcher.DefaultStages(), onlySamples),
+			})
+			defer tweetFetcher.StopAll()
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			go source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(session.Messages()).Should(Receive())
+			Expect(statsdClient.timing("pipeline.nothing.time")).To(Equal(0))
+		})
+	})
+
+	Describe("geocoding", func() {
+		var (
+			statsdClient *fakeStatsd
+			logger       log.Logger
+			geocoder     *blockingGeocoder
+		)
+
+		BeforeEach(func() {
+			statsdClient = newFakeStatsd()
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+			geocoder = newBlockingGeocoder()
+		})
+
+		fetch := func(options fetcher.GeocodeOptions) (fetcher.Fetcher, fetcher.Session) {
+			tweetFetcher := fetcher.New(logger, source, statsdClient, geocoder, fetcher.Config{Geocoding: options})
+			session, err := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Expect(err).NotTo(HaveOccurred())
+			return tweetFetcher, session
+		}
+
+		It("keeps the order of tweets", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			source.Send(placeTweet("11"))
+			Consistently(session.Messages()).ShouldNot(Receive())
+
+			geocoder.release <- struct{}{}
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("10"))
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+		})
+
+		It("stops waiting for a slow tweet once too many tweets wait for it", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{MaxWaiting: 1})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(geocoder.asked).Should(Receive())
+			source.Send(placeTweet("11"))
+			Consistently(session.Messages()).ShouldNot(Receive())
+			source.Send(placeTweet("12"))
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("12"))
+
+			geocoder.release <- struct{}{}
+			Eventually(func() int64 { return statsdClient.counter("geocode.late") }).Should(Equal(int64(1)))
+			Consistently(session.Messages()).ShouldNot(Receive())
+		})
+
+		It("doesn't let retractions overtake the tweets they retract", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{Unordered: true})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(geocoder.asked).Should(Receive())
+			source.Send(&twitter.StatusDeletion{IDStr: "10"})
+			Consistently(session.Messages()).ShouldNot(Receive())
+
+			geocoder.release <- struct{}{}
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("10"))
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Type).To(Equal(fetcher.MessageRetraction))
+			Expect(message.Retraction.Id).To(Equal("10"))
+		})
+
+		It("lets tweets overtake slow ones when unordered", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{Unordered: true})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			source.Send(placeTweet("11"))
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+			Expect(statsdClient.counter("countries.France")).To(Equal(int64(1)))
+
+			geocoder.release <- struct{}{}
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("10"))
+			Expect(statsdClient.counter("countries.Germany")).To(Equal(int64(1)))
+		})
+
+		It("drops tweets when the queue is full", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{Workers: 1, QueueSize: 1, WhenFull: fetcher.WhenFullDrop})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(geocoder.asked).Should(Receive())
+			source.Send(geotaggedTweet("11", 13.4, 52.5))
+			source.Send(geotaggedTweet("12", 13.4, 52.5))
+			// Once the stream takes 14, the session is done with 12.
+			source.Send(geotaggedTweet("13", 13.4, 52.5))
+			source.Send(geotaggedTweet("14", 13.4, 52.5))
+
+			geocoder.release <- struct{}{}
+			geocoder.release <- struct{}{}
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("10"))
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+			Eventually(func() int64 { return statsdClient.counter("pipeline.geocode.dropped") }).Should(BeNumerically(">=", 1))
+			Expect(statsdClient.gauge("geocode.queueDepth")).To(ContainElement(int64(1)))
+		})
+
+		It("skips geocoding when the queue is full", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{Workers: 1, QueueSize: 1, Unordered: true})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(geocoder.asked).Should(Receive())
+			source.Send(geotaggedTweet("11", 13.4, 52.5))
+			source.Send(geotaggedTweet("12", 13.4, 52.5))
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("12"))
+			Expect(statsdClient.counter("geocode.skipped")).To(Equal(int64(1)))
+			Expect(statsdClient.counter("countries.Germany")).To(Equal(int64(0)))
+			Expect(session.Countries().Skipped).To(Equal(int64(1)))
+		})
+
+		It("keeps stats of the countries of live tweets", func() {
+			geocoder := &fakeGeocoder{country: "Germany"}
+			tweetFetcher := fetcher.New(logger, source, statsdClient, geocoder, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			source.Send(geotaggedTweet("11", 13.4, 52.5))
+			source.Send(placeTweet("12"))
+			for i := 0; i < 3; i++ {
+				Eventually(session.Messages()).Should(Receive())
+			}
+
+			stats := session.Countries()
+			Expect(stats.Geocoded).To(Equal(int64(3)))
+			Expect(stats.Countries).To(HaveLen(2))
+			Expect(stats.Countries[0].Country).To(Equal("Germany"))
+			Expect(stats.Countries[0].Tweets).To(Equal(int64(2)))
+			Expect(stats.Countries[1].Country).To(Equal("France"))
+			Expect(stats.Countries[1].Share).To(BeNumerically("~", 1.0/3, 0.001))
+			Expect(stats.Countries[1].Rate).To(BeNumerically("~", 1.0/60, 0.001))
+		})
+
+		It("counts tweets the geocoder failed on", func() {
+			geocoder := &fakeGeocoder{err: errors.New("Over query limit")}
+			tweetFetcher := fetcher.New(logger, source, statsdClient, geocoder, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(session.Messages()).Should(Receive())
+
+			Expect(session.Countries().Failures).To(Equal(int64(1)))
+			Expect(session.Countries().Countries).To(BeEmpty())
+			Expect(statsdClient.counter("geocode.failures")).To(Equal(int64(1)))
+		})
+
+		It("holds up the stream when the queue is full if asked to", func() {
+			tweetFetcher, session := fetch(fetcher.GeocodeOptions{Workers: 1, QueueSize: 1, WhenFull: fetcher.WhenFullBlock})
+			defer tweetFetcher.StopAll()
+			defer close(geocoder.release)
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			Eventually(geocoder.asked).Should(Receive())
+			source.Send(geotaggedTweet("11", 13.4, 52.5))
+			source.Send(geotaggedTweet("12", 13.4, 52.5))
+			source.Send(geotaggedTweet("13", 13.4, 52.5))
+
+			sent := make(chan struct{})
+			go func() {
+				source.Send(geotaggedTweet("14", 13.4, 52.5))
+				close(sent)
+			}()
+			Consistently(sent).ShouldNot(BeClosed())
+
+			geocoder.release <- struct{}{}
+			Eventually(session.Messages()).Should(Receive())
+			Eventually(sent).Should(BeClosed())
+		})
+
+		It("rejects unknown queue policies", func() {
+			Expect(fetcher.GeocodeOptions{WhenFull: "wait"}.Validate()).To(MatchError(`Unknown geocode queue policy "wait"`))
+		})
+	})
+
+	Describe("buffering", func() {
+		It("counts messages dropped for sessions nobody reads", func() {
+			statsdClient := newFakeStatsd()
+			logger := log.New()
+			logger.SetHandler(log.DiscardHandler())
+			tweetFetcher := fetcher.New(logger, source, statsdClient, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				Buffer: fetcher.Backpressure{Size: 1, Policy: fetcher.BackpressureDropOldest},
+			})
+			defer tweetFetcher.StopAll()
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+
+			source.Send(geotaggedTweet("10", 13.4, 52.5))
+			source.Send(geotaggedTweet("11", 13.4, 52.5))
+			source.Send(geotaggedTweet("12", 13.4, 52.5))
+
+			Eventually(func() int64 { return statsdClient.counter("backpressure.session.dropped") }).Should(Equal(int64(2)))
+			var message *fetcher.Message
+			Expect(session.Messages()).To(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("12"))
+		})
+	})
+
+	Describe("state", func() {
+		var (
+			recorder *stateRecorder
+			logger   log.Logger
+		)
+
+		BeforeEach(func() {
+			recorder = &stateRecorder{}
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+		})
+
+		It("streams once connected and stops", func() {
+			tweetFetcher.OnStateChange(recorder.record)
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Expect(session.State()).To(Equal(fetcher.StateStreaming))
+
+			tweetFetcher.Stop("default")
+			Expect(session.State()).To(Equal(fetcher.StateStopped))
+			Expect(recorder.states()).To(Equal([]fetcher.State{
+				fetcher.StateConnecting, fetcher.StateStreaming, fetcher.StateStopped,
+			}))
+			Expect(recorder.changes[0].From).To(Equal(fetcher.StateIdle))
+			Expect(recorder.changes[0].Session).To(Equal("default"))
+		})
+
+		It("notifies listeners once the session is unlocked", func() {
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			states := make(chan fetcher.State, 1)
+			tweetFetcher.OnStateChange(func(fetcher.StateChange) {
+				states <- session.State()
+			})
+
+			stopped := make(chan struct{})
+			go func() {
+				tweetFetcher.Stop("default")
+				close(stopped)
+			}()
+			Eventually(stopped).Should(BeClosed())
+			Expect(states).To(Receive(Equal(fetcher.StateStopped)))
+		})
+
+		It("stops the current session before connecting its replacement", func() {
+			tweetFetcher.OnStateChange(recorder.record)
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"wine"}})
+
+			Expect(recorder.states()).To(Equal([]fetcher.State{
+				fetcher.StateConnecting, fetcher.StateStreaming, fetcher.StateStopped,
+				fetcher.StateConnecting, fetcher.StateStreaming,
+			}))
+		})
+
+		It("backs off and connects again", func() {
+			tweetFetcher := fetcher.New(logger, &flakySource{failures: 2}, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				MinBackoff: time.Millisecond,
+				MaxBackoff: 5 * time.Millisecond,
+			})
+			defer tweetFetcher.StopAll()
+			tweetFetcher.OnStateChange(recorder.record)
+
+			session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Eventually(session.Messages()).Should(Receive())
+
+			Eventually(func() int { return len(recorder.states()) }).Should(BeNumerically(">=", 9))
+			Expect(recorder.states()[:9]).To(Equal([]fetcher.State{
+				fetcher.StateConnecting, fetcher.StateStreaming,
+				fetcher.StateBackingOff, fetcher.StateConnecting,
+				fetcher.StateBackingOff, fetcher.StateConnecting,
+				fetcher.StateBackingOff, fetcher.StateConnecting,
+				fetcher.StateStreaming,
+			}))
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+			Expect(recorder.changes[2].Err).To(Equal("Stream ended"))
+			Expect(recorder.changes[4].Err).To(Equal("Service unavailable"))
+		})
+
+		It("waits as long as Twitter asks when rate limited", func() {
+			source := &flakySource{failures: 1, err: &fetcher.FetchError{Kind: fetcher.ErrorRateLimited, RetryAfter: 50 * time.Millisecond}}
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				MinBackoff: time.Millisecond,
+				MaxBackoff: 5 * time.Millisecond,
+			})
+			defer tweetFetcher.StopAll()
+			tweetFetcher.OnStateChange(recorder.record)
+
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Eventually(func() int { return len(recorder.states()) }).Should(BeNumerically(">=", 6))
+
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+			Expect(recorder.changes[4].To).To(Equal(fetcher.StateBackingOff))
+			Expect(recorder.changes[5].At.Sub(recorder.changes[4].At)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("waits at least a minute when rate limited", func() {
+			source := &flakySource{failures: 1, err: &fetcher.FetchError{Kind: fetcher.ErrorRateLimited}}
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				MinBackoff: time.Millisecond,
+				MaxBackoff: 5 * time.Millisecond,
+			})
+			defer tweetFetcher.StopAll()
+			tweetFetcher.OnStateChange(recorder.record)
+
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Eventually(func() int { return len(recorder.states()) }).Should(Equal(5))
+			Consistently(func() int { return len(recorder.states()) }, "100ms").Should(Equal(5))
+		})
+
+		It("survives concurrent fetches and stops", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{fmt.Sprint(i)}})
+					session.State()
+					session.Replay()
+					tweetFetcher.Stop("default")
+				}(i)
+			}
+			wg.Wait()
+
+			_, ok := tweetFetcher.Session("default")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("failing to start", func() {
+		var logger log.Logger
+
+		BeforeEach(func() {
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+		})
+
+		fetchWith := func(source fetcher.Source, query fetcher.Query) *fetcher.FetchError {
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			session, err := tweetFetcher.Fetch("default", query)
+			Expect(session).To(BeNil())
+			_, ok := tweetFetcher.Session("default")
+			Expect(ok).To(BeFalse())
+
+			Expect(err).To(BeAssignableToTypeOf(&fetcher.FetchError{}))
+			return err.(*fetcher.FetchError)
+		}
+
+		It("rejects invalid queries", func() {
+			err := fetchWith(source, fetcher.Query{Expression: "golang AND"})
+			Expect(err.Kind).To(Equal(fetcher.ErrorInvalidQuery))
+			Expect(err.Message).To(ContainSubstring("Invalid expression"))
+
+			err = fetchWith(source, fetcher.Query{})
+			Expect(err.Kind).To(Equal(fetcher.ErrorInvalidQuery))
+		})
+
+		It("reports missing recordings as invalid queries", func() {
+			err := fetchWith(source, fetcher.Query{Mode: fetcher.ModeReplay, Replay: &fetcher.ReplayOptions{File: "missing.jsonl"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorInvalidQuery))
+		})
+
+		It("reports sources that can't be opened as unavailable", func() {
+			err := fetchWith(&failingSource{err: errors.New("Connection refused")}, fetcher.Query{Track: []string{"beer"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorUnavailable))
+			Expect(err.Message).To(Equal("Connection refused"))
+		})
+
+		It("leaves the current session alone for invalid queries", func() {
+			old, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			_, err := tweetFetcher.Fetch("default", fetcher.Query{Expression: "beer", Mode: fetcher.ModeSample})
+			Expect(err).To(HaveOccurred())
+			Expect(old.State()).To(Equal(fetcher.StateStreaming))
+		})
+
+		It("stops the current session even if the new one fails to start", func() {
+			source := newSlowSource()
+			close(source.release)
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			old, err := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			source.fail(errors.New("Connection refused"))
+			_, err = tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"wine"}})
+			Expect(err).To(HaveOccurred())
+
+			Expect(old.State()).To(Equal(fetcher.StateStopped))
+			_, ok := tweetFetcher.Session("default")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("doesn't hold up other sessions while connecting", func() {
+			source := newSlowSource()
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+			var release sync.Once
+			defer release.Do(func() { close(source.release) })
+
+			fetched := make(chan struct{})
+			go func() {
+				defer close(fetched)
+				tweetFetcher.Fetch("slow", fetcher.Query{Track: []string{"beer"}})
+			}()
+			Eventually(source.opening).Should(Receive())
+
+			listed := make(chan []fetcher.Session, 1)
+			go func() {
+				tweetFetcher.Stop("other")
+				listed <- tweetFetcher.Sessions()
+			}()
+			Eventually(listed).Should(Receive(BeEmpty()))
+
+			release.Do(func() { close(source.release) })
+			Eventually(fetched).Should(BeClosed())
+			_, ok := tweetFetcher.Session("slow")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("tells why Twitter rejected the stream", func() {
+			twitter := func(status int, header http.Header) fetcher.Source {
+				return fetcher.NewTwitterSource(logger, &http.Client{Transport: &fakeTransport{status: status, header: header}})
+			}
+
+			err := fetchWith(twitter(http.StatusUnauthorized, nil), fetcher.Query{Track: []string{"beer"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorUnauthorized))
+
+			err = fetchWith(twitter(420, http.Header{"Retry-After": {"60"}}), fetcher.Query{Mode: fetcher.ModeSample})
+			Expect(err.Kind).To(Equal(fetcher.ErrorRateLimited))
+			Expect(err.RetryAfter).To(Equal(time.Minute))
+
+			err = fetchWith(twitter(http.StatusServiceUnavailable, nil), fetcher.Query{Track: []string{"beer"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorUnavailable))
+
+			err = fetchWith(twitter(http.StatusNotFound, nil), fetcher.Query{Track: []string{"beer"}, Follow: []string{"nobody"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorInvalidQuery))
+			Expect(err.Message).To(Equal("None of the users to follow exist: nobody"))
+		})
+
+		It("reports failures to connect to Twitter as unavailable", func() {
+			source := fetcher.NewTwitterSource(logger, &http.Client{Transport: &fakeTransport{err: errors.New("connection refused")}})
+
+			err := fetchWith(source, fetcher.Query{Track: []string{"beer"}})
+			Expect(err.Kind).To(Equal(fetcher.ErrorUnavailable))
+			Expect(err.Message).To(ContainSubstring("connection refused"))
+		})
+
+		It("streams what Twitter sends once it accepted the stream", func() {
+			source := fetcher.NewTwitterSource(logger, &http.Client{Transport: &fakeTransport{
+				status: http.StatusOK,
+				body: "\r\n" +
+					`{"id_str": "10", "text": "wine", "retweet_count": 0, "coordinates": {"coordinates": [13.4, 52.5]}}` + "\r\n" +
+					`{"id_str": "11", "text": "beer", "retweet_count": 0, "coordinates": {"coordinates": [13.4, 52.5]}}` + "\r\n",
+			}})
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			session, err := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}, Locations: []fetcher.BoundingBox{
+				{SouthWest: fetcher.Coordinates{Lat: 52, Long: 13}, NorthEast: fetcher.Coordinates{Lat: 53, Long: 14}},
+			}})
+			Expect(err).NotTo(HaveOccurred())
+
+			var message *fetcher.Message
+			Eventually(session.Messages()).Should(Receive(&message))
+			Expect(message.Tweet.Id).To(Equal("11"))
+		})
+
+		It("sends the filter parameters form-encoded in the body", func() {
+			transport := &fakeTransport{status: http.StatusOK}
+			source := fetcher.NewTwitterSource(logger, &http.Client{Transport: transport})
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{})
+			defer tweetFetcher.StopAll()
+
+			_, err := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer", "wine"}, Language: []string{"en"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(transport.request.Method).To(Equal("POST"))
+			Expect(transport.request.URL.RawQuery).To(BeEmpty())
+			Expect(transport.request.Header.Get("Content-Type")).To(Equal("application/x-www-form-urlencoded"))
+			Expect(transport.request.ParseForm()).To(Succeed())
+			Expect(transport.request.PostForm.Get("track")).To(Equal("beer,wine"))
+			Expect(transport.request.PostForm.Get("language")).To(Equal("en"))
+		})
+	})
+
+	Describe("restoring", func() {
+		var (
+			logger       log.Logger
+			sessionStore *memoryStore
+		)
+
+		BeforeEach(func() {
+			logger = log.New()
+			logger.SetHandler(log.DiscardHandler())
+			sessionStore = &memoryStore{}
+		})
+
+		newFetcher := func() fetcher.Fetcher {
+			return fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{Store: sessionStore})
+		}
+
+		It("saves sessions as they start and stop", func() {
+			tweetFetcher := newFetcher()
+			defer tweetFetcher.StopAll()
+
+			tweetFetcher.Fetch("second", fetcher.Query{Track: []string{"wine"}})
+			tweetFetcher.Fetch("first", fetcher.Query{Track: []string{"beer"}})
+			Expect(sessionStore.ids()).To(Equal([]string{"first", "second"}))
+
+			tweetFetcher.Stop("second")
+			Expect(sessionStore.ids()).To(Equal([]string{"first"}))
+		})
+
+		It("doesn't save transient sessions", func() {
+			tweetFetcher := newFetcher()
+			defer tweetFetcher.StopAll()
+
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			tweetFetcher.FetchTransient("demo", fetcher.Query{Track: []string{"wine"}})
+			Expect(sessionStore.ids()).To(Equal([]string{"default"}))
+
+			tweetFetcher.FetchTransient("default", fetcher.Query{Track: []string{"wine"}})
+			Expect(sessionStore.ids()).To(BeEmpty())
+		})
+
+		It("keeps sessions stopped on shutdown", func() {
+			tweetFetcher := newFetcher()
+			tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+			tweetFetcher.StopAll()
+
+			Expect(sessionStore.ids()).To(Equal([]string{"default"}))
+		})
+
+		It("resumes the saved sessions", func() {
+			tweetFetcher := newFetcher()
+			tweetFetcher.Fetch("default", fetcher.Query{Expression: "beer OR wine", Language: []string{"de"}})
+			tweetFetcher.Fetch("sample", fetcher.Query{Mode: fetcher.ModeSample})
+			tweetFetcher.StopAll()
+
+			restarted := newFetcher()
+			defer restarted.StopAll()
+
+			restored, err := restarted.Restore()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(2))
+
+			session, ok := restarted.Session("default")
+			Expect(ok).To(BeTrue())
+			Expect(session.Query().Expression).To(Equal("beer OR wine"))
+			Expect(session.Query().Track).To(Equal([]string{"beer", "wine"}))
+			Expect(session.Query().Language).To(Equal([]string{"de"}))
+
+			_, ok = restarted.Session("sample")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("keeps sessions that fail to connect, connecting again", func() {
+			sessionStore.sessions = []store.Session{
+				{Id: "default", Query: json.RawMessage(`{"Track":["beer"]}`)},
+			}
+			source := newSlowSource()
+			close(source.release)
+			source.fail(errors.New("Connection refused"))
+			tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+				Store:      sessionStore,
+				MinBackoff: time.Millisecond,
+				MaxBackoff: 5 * time.Millisecond,
+			})
+			defer tweetFetcher.StopAll()
+
+			restored, err := tweetFetcher.Restore()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(0))
+			Expect(sessionStore.ids()).To(Equal([]string{"default"}))
+
+			session, ok := tweetFetcher.Session("default")
+			Expect(ok).To(BeTrue())
+			source.fail(nil)
+			Eventually(session.State).Should(Equal(fetcher.StateStreaming))
+		})
+
+		It("drops sessions whose query is invalid", func() {
+			sessionStore.sessions = []store.Session{
+				{Id: "broken", Query: json.RawMessage(`{"Mode":"unknown"}`)},
+				{Id: "default", Query: json.RawMessage(`{"Track":["beer"]}`)},
+			}
+
+			tweetFetcher := newFetcher()
+			defer tweetFetcher.StopAll()
+
+			restored, err := tweetFetcher.Restore()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(1))
+			Expect(sessionStore.ids()).To(Equal([]string{"default"}))
+		})
+	})
+
+	It("replaces the query of an existing session", func() {
+		old, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"beer"}})
+		tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"wine"}})
+
+		Eventually(old.Messages()).Should(BeClosed())
+
+		session, ok := tweetFetcher.Session("default")
+		Expect(ok).To(BeTrue())
+		Expect(session.Query().Track).To(Equal([]string{"wine"}))
+	})
+})
+
+var _ = Describe("Twitter source", func() {
+	var (
+		transport    *streamTransport
+		tweetFetcher fetcher.Fetcher
+	)
+
+	BeforeEach(func() {
+		logger := log.New()
+		logger.SetHandler(log.DiscardHandler())
+
+		transport = &streamTransport{}
+		source := fetcher.NewTwitterSource(logger, &http.Client{Transport: transport})
+		tweetFetcher = fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 5 * time.Millisecond,
+		})
+	})
+
+	AfterEach(func() {
+		tweetFetcher.StopAll()
+	})
+
+	tweetLine := func(id, text string) string {
+		return fmt.Sprintf(`{"id_str": %q, "text": %q, "lang": "en", "retweet_count": 0, "coordinates": {"coordinates": [13.4, 52.5]}}`, id, text) + "\r\n"
+	}
+
+	It("shares a single stream of all queries among sessions", func() {
+		beer, err := tweetFetcher.Fetch("beer", fetcher.Query{Track: []string{"beer"}})
+		Expect(err).NotTo(HaveOccurred())
+		wine, err := tweetFetcher.Fetch("wine", fetcher.Query{Track: []string{"Wine"}, Language: []string{"en"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(transport.connections()).To(Equal(2))
+		Expect(transport.stream(0).closed).To(BeClosed())
+		Expect(transport.form(1).Get("track")).To(Equal("beer,wine"))
+		Expect(transport.form(1).Get("language")).To(BeEmpty())
+
+		go transport.stream(1).writer.Write([]byte(tweetLine("10", "wine") + tweetLine("11", "beer")))
+
+		var message *fetcher.Message
+		Eventually(wine.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("10"))
+		Eventually(beer.Messages()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("11"))
+		Consistently(wine.Messages()).ShouldNot(Receive())
+		Expect(beer.State()).To(Equal(fetcher.StateStreaming))
+	})
+
+	It("keeps the stream for queries it already covers", func() {
+		tweetFetcher.Fetch("both", fetcher.Query{Track: []string{"beer", "wine"}})
+		tweetFetcher.Fetch("wine", fetcher.Query{Track: []string{"wine"}, Language: []string{"en"}})
+
+		Expect(transport.connections()).To(Equal(1))
+	})
+
+	It("closes the stream once the last session stops", func() {
+		tweetFetcher.Fetch("beer", fetcher.Query{Track: []string{"beer"}})
+		tweetFetcher.Fetch("wine", fetcher.Query{Track: []string{"wine"}})
+
+		tweetFetcher.Stop("beer")
+		Consistently(transport.stream(1).closed).ShouldNot(BeClosed())
+		tweetFetcher.Stop("wine")
+		Eventually(transport.stream(1).closed).Should(BeClosed())
+	})
+
+	It("brings sessions back on a single stream once it ends", func() {
+		beer, _ := tweetFetcher.Fetch("beer", fetcher.Query{Track: []string{"beer"}})
+		wine, _ := tweetFetcher.Fetch("wine", fetcher.Query{Track: []string{"wine"}})
+
+		transport.stream(1).writer.Close()
+		Eventually(transport.connections).Should(Equal(3))
+		Eventually(beer.State).Should(Equal(fetcher.StateStreaming))
+		Eventually(wine.State).Should(Equal(fetcher.StateStreaming))
+		Consistently(transport.connections).Should(Equal(3))
+		Expect(transport.form(2).Get("track")).To(Equal("beer,wine"))
+	})
+
+	It("can't stream a sample along with filtered tweets", func() {
+		tweetFetcher.Fetch("beer", fetcher.Query{Track: []string{"beer"}})
+
+		_, err := tweetFetcher.Fetch("sample", fetcher.Query{Mode: fetcher.ModeSample})
+		Expect(err).To(BeAssignableToTypeOf(&fetcher.FetchError{}))
+		Expect(err.(*fetcher.FetchError).Kind).To(Equal(fetcher.ErrorUnavailable))
+		Expect(transport.connections()).To(Equal(1))
+	})
+})
+
+var _ = Describe("File source", func() {
+	var path string
+
+	BeforeEach(func() {
+		file, err := ioutil.TempFile("", "tweets")
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		_, err = file.WriteString(`{"id_str": "10", "text": "beer", "retweet_count": 0}
+{"delete": {"status": {"id_str": "10"}}}
+{"limit": {"track": 42}}
+`)
+		Expect(err).NotTo(HaveOccurred())
+		path = file.Name()
+	})
+
+	AfterEach(func() {
+		os.Remove(path)
+	})
+
+	It("replays stream messages from the file", func() {
+		stream, err := fetcher.NewFileSource(path, time.Millisecond).Open(fetcher.Query{})
+		Expect(err).NotTo(HaveOccurred())
+
+		var messages []interface{}
+		for message := range stream.Messages() {
+			messages = append(messages, message)
+		}
+
+		Expect(messages).To(HaveLen(3))
+		Expect(messages[0]).To(BeAssignableToTypeOf(&twitter.Tweet{}))
+		Expect(messages[0].(*twitter.Tweet).Text).To(Equal("beer"))
+		Expect(messages[1]).To(Equal(&twitter.StatusDeletion{IDStr: "10"}))
+		Expect(messages[2]).To(Equal(&twitter.StreamLimit{Track: 42}))
+	})
+
+	It("fails to open missing files", func() {
+		_, err := fetcher.NewFileSource(path+".missing", time.Millisecond).Open(fetcher.Query{})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Generator source", func() {
+	receive := func(stream fetcher.Stream, n int) []*twitter.Tweet {
+		tweets := []*twitter.Tweet{}
+		for len(tweets) < n {
+			var message interface{}
+			Eventually(stream.Messages()).Should(Receive(&message))
+			tweets = append(tweets, message.(*twitter.Tweet))
+		}
+		return tweets
+	}
+
+	It("generates tweets matching the query", func() {
+		berlin := fetcher.BoundingBox{
+			SouthWest: fetcher.Coordinates{Lat: 52.33, Long: 13.08},
+			NorthEast: fetcher.Coordinates{Lat: 52.67, Long: 13.76},
+		}
+		stream, err := fetcher.NewGeneratorSource(fetcher.GeneratorOptions{Rate: 1000, Seed: 1}).Open(fetcher.Query{
+			Track:     []string{"craft beer"},
+			Locations: []fetcher.BoundingBox{berlin},
+			Language:  []string{"de"},
+			Follow:    []string{"@golang"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer stream.Stop()
+
+		for _, tweet := range receive(stream, 20) {
+			Expect(tweet.Text).To(ContainSubstring("craft beer"))
+			Expect(tweet.Lang).To(Equal("de"))
+			Expect(tweet.User.ScreenName).To(Equal("golang"))
+			Expect(tweet.Place.Country).To(Equal("Germany"))
+			if tweet.Coordinates != nil {
+				Expect(berlin.Contains(fetcher.Coordinates{
+					Long: tweet.Coordinates.Coordinates[0],
+					Lat:  tweet.Coordinates.Coordinates[1],
+				})).To(BeTrue())
+			}
+		}
+	})
+
+	It("generates tweets outside of populated areas", func() {
+		ocean := fetcher.BoundingBox{
+			SouthWest: fetcher.Coordinates{Lat: -40, Long: -30},
+			NorthEast: fetcher.Coordinates{Lat: -30, Long: -20},
+		}
+		stream, err := fetcher.NewGeneratorSource(fetcher.GeneratorOptions{Rate: 1000, Seed: 1}).Open(fetcher.Query{
+			Locations: []fetcher.BoundingBox{ocean},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer stream.Stop()
+
+		for _, tweet := range receive(stream, 5) {
+			Expect(tweet.Coordinates).NotTo(BeNil())
+			Expect(ocean.Contains(fetcher.Coordinates{
+				Long: tweet.Coordinates.Coordinates[0],
+				Lat:  tweet.Coordinates.Coordinates[1],
+			})).To(BeTrue())
+		}
+	})
+
+	It("feeds sessions like live tweets", func() {
+		logger := log.New()
+		logger.SetHandler(log.DiscardHandler())
+		source := fetcher.NewGeneratorSource(fetcher.GeneratorOptions{Rate: 1000})
+		tweetFetcher := fetcher.New(logger, source, &statsd.NoopClient{}, &fakeGeocoder{}, fetcher.Config{})
+		defer tweetFetcher.StopAll()
+
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Mode: fetcher.ModeSample})
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageTweet))
+		Expect(message.Tweet.Location).To(Or(Equal(fetcher.LocationExact), Equal(fetcher.LocationPlace)))
+	})
+
+	It("makes up recent tweets to backfill with", func() {
+		searcher := fetcher.NewGeneratorSource(fetcher.GeneratorOptions{Seed: 1}).(fetcher.Searcher)
+
+		tweets, err := searcher.Search(fetcher.Query{Track: []string{"beer"}}, 5)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tweets).To(HaveLen(5))
+		Expect(tweets[0].ID).To(BeNumerically("<", tweets[4].ID))
+		Expect(tweets[0].Text).To(ContainSubstring("beer"))
+	})
+
+	It("bursts", func() {
+		stream, err := fetcher.NewGeneratorSource(fetcher.GeneratorOptions{
+			BurstRate:   1000,
+			BurstEvery:  time.Hour,
+			BurstLength: time.Minute,
+		}).Open(fetcher.Query{Mode: fetcher.ModeSample})
+		Expect(err).NotTo(HaveOccurred())
+		defer stream.Stop()
+
+		Expect(receive(stream, 10)).To(HaveLen(10))
+	})
+})
+
+var _ = Describe("Backpressure", func() {
+	var (
+		first, second *fetcher.Message
+		done          chan struct{}
+	)
+
+	BeforeEach(func() {
+		first = &fetcher.Message{Type: fetcher.MessageTweet, Tweet: &fetcher.Tweet{Id: "1"}}
+		second = &fetcher.Message{Type: fetcher.MessageTweet, Tweet: &fetcher.Tweet{Id: "2"}}
+		done = make(chan struct{})
+	})
+
+	It("drops the oldest messages", func() {
+		buffer := fetcher.Backpressure{Size: 1, Policy: fetcher.BackpressureDropOldest}
+		ch := buffer.Channel()
+
+		Expect(buffer.Send(ch, first, done)).To(BeTrue())
+		sent, dropped := buffer.Send(ch, second, done)
+		Expect(sent).To(BeTrue())
+		Expect(dropped).To(Equal(1))
+		Expect(ch).To(Receive(Equal(second)))
+	})
+
+	It("drops the newest messages", func() {
+		buffer := fetcher.Backpressure{Size: 1, Policy: fetcher.BackpressureDropNewest}
+		ch := buffer.Channel()
+
+		buffer.Send(ch, first, done)
+		sent, dropped := buffer.Send(ch, second, done)
+		Expect(sent).To(BeFalse())
+		Expect(dropped).To(Equal(1))
+		Expect(ch).To(Receive(Equal(first)))
+	})
+
+	It("blocks until done", func() {
+		buffer := fetcher.Backpressure{Size: 1}
+		ch := buffer.Channel()
+		buffer.Send(ch, first, done)
+
+		result := make(chan bool)
+		go func() {
+			sent, _ := buffer.Send(ch, second, done)
+			result <- sent
+		}()
+		Consistently(result).ShouldNot(Receive())
+
+		close(done)
+		Eventually(result).Should(Receive(BeFalse()))
+	})
+
+	It("validates policies", func() {
+		Expect(fetcher.Backpressure{}.Validate()).To(Succeed())
+		Expect(fetcher.Backpressure{Policy: "drop-random"}.Validate()).To(MatchError(`Unknown backpressure policy "drop-random"`))
+		Expect(fetcher.Backpressure{Policy: fetcher.BackpressureDropOldest}.Validate()).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"time"
+)
+
+type fileSource struct {
+	path     string
+	interval time.Duration
+}
+
+// NewFileSource replays a file holding one Twitter stream message per
+// line, e.g. saved from the streaming API with curl. Messages are sent one
+// every interval, whichever query the source is opened for.
+func NewFileSource(path string, interval time.Duration) Source {
+	return &fileSource{
+		path:     path,
+		interval: interval,
+	}
+}
+
+func (s *fileSource) Open(query Query) (Stream, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &fileStream{
+		file:     file,
+		interval: s.interval,
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+	}
+	go stream.replay()
+	return stream, nil
+}
+
+type fileStream struct {
+	file     *os.File
+	interval time.Duration
+	messages chan interface{}
+	done     chan struct{}
+}
+
+func (s *fileStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *fileStream) Stop() {
+	close(s.done)
+}
+
+func (s *fileStream) replay() {
+	defer close(s.messages)
+	defer s.file.Close()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	scanner := bufio.NewScanner(s.file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		select {
+		case s.messages <- decodeMessage(line):
+		case <-s.done:
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		select {
+		case s.messages <- err:
+		case <-s.done:
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package fetcher
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// GeneratorOptions control how many tweets a generator source makes up.
+type GeneratorOptions struct {
+	// Rate is the average number of tweets per second.
+	Rate float64
+	// BurstRate replaces Rate for BurstLength once every BurstEvery. Zero
+	// BurstEvery means no bursts.
+	BurstRate   float64
+	BurstEvery  time.Duration
+	BurstLength time.Duration
+	// Seed makes the generated tweets repeatable, zero picks a random one.
+	Seed int64
+}
+
+// city is a populated area tweets are generated in, weighted by population
+// in millions.
+type city struct {
+	name    string
+	country string
+	code    string
+	lat     float64
+	long    float64
+	weight  float64
+}
+
+var cities = []city{
+	{"Tokyo", "Japan", "JP", 35.68, 139.69, 37.4},
+	{"Delhi", "India", "IN", 28.70, 77.10, 28.5},
+	{"Shanghai", "China", "CN", 31.23, 121.47, 25.6},
+	{"São Paulo", "Brazil", "BR", -23.55, -46.63, 21.7},
+	{"Mexico City", "Mexico", "MX", 19.43, -99.13, 21.6},
+	{"Cairo", "Egypt", "EG", 30.04, 31.24, 20.1},
+	{"Mumbai", "India", "IN", 19.08, 72.88, 20.0},
+	{"New York", "United States", "US", 40.71, -74.01, 18.8},
+	{"Buenos Aires", "Argentina", "AR", -34.60, -58.38, 15.0},
+	{"Istanbul", "Turkey", "TR", 41.01, 28.98, 14.8},
+	{"Lagos", "Nigeria", "NG", 6.52, 3.38, 13.5},
+	{"Manila", "Philippines", "PH", 14.60, 120.98, 13.5},
+	{"Rio de Janeiro", "Brazil", "BR", -22.91, -43.17, 13.3},
+	{"Los Angeles", "United States", "US", 34.05, -118.24, 12.5},
+	{"Moscow", "Russia", "RU", 55.76, 37.62, 12.4},
+	{"Paris", "France", "FR", 48.86, 2.35, 10.9},
+	{"Jakarta", "Indonesia", "ID", -6.21, 106.85, 10.5},
+	{"London", "United Kingdom", "GB", 51.51, -0.13, 9.0},
+	{"Chicago", "United States", "US", 41.88, -87.63, 8.9},
+	{"Madrid", "Spain", "ES", 40.42, -3.70, 6.5},
+	{"Toronto", "Canada", "CA", 43.65, -79.38, 6.1},
+	{"Berlin", "Germany", "DE", 52.52, 13.40, 3.6},
+	{"Sydney", "Australia", "AU", -33.87, 151.21, 4.9},
+	{"Minsk", "Belarus", "BY", 53.90, 27.56, 2.0},
+	{"San Francisco", "United States", "US", 37.77, -122.42, 3.3},
+}
+
+var (
+	generatedTopics = []string{"coffee", "music", "football", "weather", "traffic", "pizza", "sunset", "golang", "concert", "beer"}
+	generatedTexts  = []string{
+		"Can't stop thinking about %s today in %s",
+		"%s is all anyone here in %s talks about",
+		"Best %s I've had in a long time. Love %s!",
+		"Bored of %s yet, %s?",
+		"Just %s and chill, %s style",
+	}
+	generatedUsers = []string{"early_bird", "night_owl", "city_walker", "coffee_addict", "demo_user", "metrics_fan", "grafana_lover", "cf_pusher"}
+)
+
+// generatedPlaceShare is the share of tweets located only by their place,
+// the rest carries exact coordinates as well.
+const generatedPlaceShare = 0.3
+
+type generatorSource struct {
+	options GeneratorOptions
+	lastID  int64
+}
+
+// NewGeneratorSource makes up geotagged tweets in populated areas, so the
+// app can be demoed without access to Twitter. Tweets match the query they
+// are generated for and are tagged with a place, so they don't need to be
+// geocoded.
+func NewGeneratorSource(options GeneratorOptions) Source {
+	return &generatorSource{
+		options: options,
+		lastID:  (time.Now().UnixNano() / int64(time.Millisecond)) << 22,
+	}
+}
+
+func (s *generatorSource) Open(query Query) (Stream, error) {
+	stream := s.newStream(query)
+	go stream.generate()
+	return stream, nil
+}
+
+// Search makes up limit tweets sent during the last hour.
+func (s *generatorSource) Search(query Query, limit int) ([]*twitter.Tweet, error) {
+	stream := s.newStream(query)
+	now := time.Now()
+
+	tweets := make([]*twitter.Tweet, 0, limit)
+	for i := limit; i > 0; i-- {
+		tweets = append(tweets, stream.tweet(now.Add(-time.Duration(i)*time.Hour/time.Duration(limit+1))))
+	}
+	return tweets, nil
+}
+
+func (s *generatorSource) newStream(query Query) *generatorStream {
+	seed := s.options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	stream := &generatorStream{
+		source:   s,
+		query:    query,
+		options:  s.options,
+		random:   rand.New(rand.NewSource(seed)),
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+	}
+	stream.cities = stream.citiesWithin()
+	return stream
+}
+
+func (s *generatorSource) nextID() int64 {
+	return atomic.AddInt64(&s.lastID, 1)
+}
+
+type generatorStream struct {
+	source   *generatorSource
+	query    Query
+	options  GeneratorOptions
+	random   *rand.Rand
+	cities   []city
+	messages chan interface{}
+	done     chan struct{}
+}
+
+func (s *generatorStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *generatorStream) Stop() {
+	close(s.done)
+}
+
+func (s *generatorStream) generate() {
+	defer close(s.messages)
+
+	started := time.Now()
+	for {
+		rate := s.rate(time.Since(started))
+		if rate <= 0 {
+			<-s.done
+			return
+		}
+
+		// Tweets arrive independently of each other, so the time between
+		// them is exponentially distributed.
+		wait := time.Duration(s.random.ExpFloat64() / rate * float64(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
+
+		select {
+		case s.messages <- s.tweet(time.Now()):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *generatorStream) rate(elapsed time.Duration) float64 {
+	if s.options.BurstEvery > 0 && elapsed%s.options.BurstEvery < s.options.BurstLength {
+		return s.options.BurstRate
+	}
+	return s.options.Rate
+}
+
+func (s *generatorStream) tweet(sentAt time.Time) *twitter.Tweet {
+	id := s.source.nextID()
+	location := s.location()
+
+	userIndex := s.random.Intn(len(generatedUsers))
+	user := generatedUsers[userIndex]
+	if names := s.query.screenNames(); len(names) > 0 {
+		userIndex = s.random.Intn(len(names))
+		user = names[userIndex]
+	}
+
+	tweet := &twitter.Tweet{
+		ID:        id,
+		IDStr:     strconv.FormatInt(id, 10),
+		CreatedAt: sentAt.UTC().Format(time.RubyDate),
+		Text:      fmt.Sprintf(generatedTexts[s.random.Intn(len(generatedTexts))], s.topic(), location.name),
+		Lang:      s.language(),
+		User: &twitter.User{
+			ID:         int64(userIndex + 1),
+			IDStr:      strconv.Itoa(userIndex + 1),
+			ScreenName: user,
+			Name:       strings.Replace(user, "_", " ", -1),
+			// Follower counts are spread the way they are on Twitter, most
+			// accounts have few, some have a lot.
+			FollowersCount: int(s.random.ExpFloat64() * 500),
+		},
+		Place: s.place(location),
+	}
+	if tweet.Place == nil || s.random.Float64() >= generatedPlaceShare {
+		tweet.Coordinates = &twitter.Coordinates{
+			Type:        "Point",
+			Coordinates: [2]float64{location.long, location.lat},
+		}
+	}
+	return tweet
+}
+
+// location picks a point around one of the cities, so that tweets cluster
+// the way real ones do.
+func (s *generatorStream) location() city {
+	if len(s.cities) == 0 {
+		// None of the cities is within the query's locations, so the point
+		// is picked anywhere within them instead.
+		box := s.query.Locations[s.random.Intn(len(s.query.Locations))]
+		return city{
+			name: "the area",
+			lat:  box.SouthWest.Lat + s.random.Float64()*(box.NorthEast.Lat-box.SouthWest.Lat),
+			long: box.SouthWest.Long + s.random.Float64()*(box.NorthEast.Long-box.SouthWest.Long),
+		}
+	}
+
+	total := 0.0
+	for _, c := range s.cities {
+		total += c.weight
+	}
+	pick := s.random.Float64() * total
+	chosen := s.cities[len(s.cities)-1]
+	for _, c := range s.cities {
+		if pick < c.weight {
+			chosen = c
+			break
+		}
+		pick -= c.weight
+	}
+
+	point := chosen
+	for i := 0; i < 10; i++ {
+		point.lat = chosen.lat + s.random.NormFloat64()*0.05
+		point.long = chosen.long + s.random.NormFloat64()*0.05
+		if s.withinQuery(Coordinates{Lat: point.lat, Long: point.long}) {
+			return point
+		}
+	}
+	point.lat, point.long = chosen.lat, chosen.long
+	return point
+}
+
+// citiesWithin returns the cities within the query's locations.
+func (s *generatorStream) citiesWithin() []city {
+	within := []city{}
+	for _, c := range cities {
+		if s.withinQuery(Coordinates{Lat: c.lat, Long: c.long}) {
+			within = append(within, c)
+		}
+	}
+	return within
+}
+
+func (s *generatorStream) withinQuery(coordinates Coordinates) bool {
+	if len(s.query.Locations) == 0 {
+		return true
+	}
+	for _, box := range s.query.Locations {
+		if box.Contains(coordinates) {
+			return true
+		}
+	}
+	return false
+}
+
+// place tags tweets in a city with the city as Twitter would, tweets
+// elsewhere aren't tagged.
+func (s *generatorStream) place(location city) *twitter.Place {
+	if location.country == "" {
+		return nil
+	}
+
+	const size = 0.15
+	return &twitter.Place{
+		Name:        location.name,
+		FullName:    location.name + ", " + location.country,
+		Country:     location.country,
+		CountryCode: location.code,
+		PlaceType:   "city",
+		BoundingBox: &twitter.BoundingBox{
+			Type: "Polygon",
+			Coordinates: [][][2]float64{{
+				{location.long - size, location.lat - size},
+				{location.long - size, location.lat + size},
+				{location.long + size, location.lat + size},
+				{location.long + size, location.lat - size},
+			}},
+		},
+	}
+}
+
+// topic returns one of the query's track terms, so that generated tweets
+// match it.
+func (s *generatorStream) topic() string {
+	if len(s.query.Track) > 0 {
+		return strings.TrimSpace(s.query.Track[s.random.Intn(len(s.query.Track))])
+	}
+	return generatedTopics[s.random.Intn(len(generatedTopics))]
+}
+
+func (s *generatorStream) language() string {
+	if len(s.query.Language) > 0 {
+		return strings.TrimSpace(s.query.Language[s.random.Intn(len(s.query.Language))])
+	}
+	return "en"
+}
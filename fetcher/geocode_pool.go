@@ -0,0 +1,311 @@
+package fetcher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// What the geocode stage does with tweets when its queue is full.
+const (
+	// WhenFullBlock waits for room in the queue, holding up the stream.
+	WhenFullBlock = "block"
+	// WhenFullDrop drops the tweet.
+	WhenFullDrop = "drop"
+	// WhenFullSkip passes the tweet on without its country.
+	WhenFullSkip = "skip"
+)
+
+// GeocodeOptions configure the workers geocoding each session's tweets.
+// Zero values pick the defaults.
+type GeocodeOptions struct {
+	// Workers is how many geocoder requests a session makes at once, 4 by
+	// default.
+	Workers int
+	// QueueSize is how many tweets can wait for a worker, 100 by default.
+	QueueSize int
+	// Unordered lets tweets that were quicker to geocode overtake others.
+	Unordered bool
+	// MaxWaiting is how many tweets can wait for a slower one to leave the
+	// stage first, 1000 by default. Once they do, the stage stops waiting.
+	MaxWaiting int
+	// WhenFull is one of WhenFullBlock, WhenFullDrop or WhenFullSkip, the
+	// latter by default.
+	WhenFull string
+}
+
+func (o GeocodeOptions) Validate() error {
+	switch o.WhenFull {
+	case "", WhenFullBlock, WhenFullDrop, WhenFullSkip:
+	default:
+		return fmt.Errorf("Unknown geocode queue policy %q", o.WhenFull)
+	}
+	if o.Workers < 0 || o.QueueSize < 0 || o.MaxWaiting < 0 {
+		return fmt.Errorf("Geocode workers, queue size and max waiting can't be negative")
+	}
+	return nil
+}
+
+func (o GeocodeOptions) withDefaults() GeocodeOptions {
+	if o.Workers == 0 {
+		o.Workers = 4
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = 100
+	}
+	if o.MaxWaiting == 0 {
+		o.MaxWaiting = 1000
+	}
+	if o.WhenFull == "" {
+		o.WhenFull = WhenFullSkip
+	}
+	return o
+}
+
+// ConcurrentStage is a stage that processes items on goroutines of its
+// own. The stages after it run on those goroutines as well.
+type ConcurrentStage interface {
+	Stage
+	// Submit hands the item to the stage, which calls done with whether to
+	// keep it once processed.
+	Submit(item *Item, done func(keep bool))
+	// Then calls f once the items submitted before have been processed and
+	// handed on, or dropped.
+	Then(f func())
+	// Close waits for the submitted items to be processed.
+	Close()
+}
+
+// geocodeJob is an item to geocode, or a function to call in turn when
+// item is nil.
+type geocodeJob struct {
+	seq  int64
+	item *Item
+	keep bool
+	done func(keep bool)
+}
+
+// geocodeStage takes the country of tweets from their place, or has one of
+// its workers ask the geocoder, so that slow requests don't hold up the
+// stream. Unless unordered, tweets leave the stage in the order they came.
+type geocodeStage struct {
+	session StageContext
+	options GeocodeOptions
+
+	queue   chan *geocodeJob
+	results chan *geocodeJob
+	workers sync.WaitGroup
+	emitted chan struct{}
+
+	mutex   sync.Mutex
+	nextSeq int64
+}
+
+func newGeocodeStage(session StageContext) Stage {
+	s := &geocodeStage{
+		session: session,
+		options: session.Geocoding.withDefaults(),
+		emitted: make(chan struct{}),
+	}
+	s.queue = make(chan *geocodeJob, s.options.QueueSize)
+	// Tweets that aren't queued, as their place has the country or the
+	// queue is full, go straight to results. It has room for them besides
+	// what the queue and the workers hold and what waits for a slow tweet,
+	// so that they don't hold up the stream while the workers catch up.
+	s.results = make(chan *geocodeJob, s.options.QueueSize+s.options.Workers+s.options.MaxWaiting)
+
+	for i := 0; i < s.options.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+	go s.emit()
+	return s
+}
+
+func (s *geocodeStage) Name() string {
+	return "geocode"
+}
+
+func (s *geocodeStage) newJob(item *Item, done func(keep bool)) *geocodeJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job := &geocodeJob{seq: s.nextSeq, item: item, keep: true, done: done}
+	s.nextSeq++
+	return job
+}
+
+func (s *geocodeStage) Submit(item *Item, done func(keep bool)) {
+	job := s.newJob(item, done)
+	if s.placeCountry(item) {
+		s.results <- job
+		return
+	}
+
+	if s.options.WhenFull == WhenFullBlock {
+		s.queue <- job
+		s.gaugeQueue()
+		return
+	}
+
+	select {
+	case s.queue <- job:
+		s.gaugeQueue()
+	default:
+		if s.options.WhenFull == WhenFullDrop {
+			job.keep = false
+		} else {
+			s.incr(item.Metric("geocode.skipped"))
+			if s.counted(item) {
+				s.session.Countries.Skip()
+			}
+		}
+		s.results <- job
+	}
+}
+
+func (s *geocodeStage) Then(f func()) {
+	s.results <- s.newJob(nil, func(bool) { f() })
+}
+
+func (s *geocodeStage) Close() {
+	close(s.queue)
+	s.workers.Wait()
+	close(s.results)
+	<-s.emitted
+}
+
+func (s *geocodeStage) work() {
+	defer s.workers.Done()
+
+	for job := range s.queue {
+		s.gaugeQueue()
+		s.geocode(job.item)
+		s.results <- job
+	}
+}
+
+// emit hands processed items on, in the order they were submitted unless
+// the stage is unordered. Functions given to Then wait for the items
+// before them either way. Once more than MaxWaiting jobs wait for the one
+// at the head, the stage stops waiting for it. A late item is dropped,
+// counted as geocode.late, unless the stage is unordered.
+func (s *geocodeStage) emit() {
+	defer close(s.emitted)
+
+	next := int64(0)
+	waiting := make(map[int64]*geocodeJob)
+	for job := range s.results {
+		if s.options.Unordered && job.item != nil {
+			job.done(job.keep)
+			job.done = nil
+		}
+
+		if job.seq < next {
+			s.late(job)
+			continue
+		}
+
+		waiting[job.seq] = job
+		if len(waiting) > s.options.MaxWaiting {
+			next = firstWaiting(waiting)
+		}
+		for {
+			ready, ok := waiting[next]
+			if !ok {
+				break
+			}
+			delete(waiting, next)
+			next++
+			if ready.done != nil {
+				ready.done(ready.keep)
+			}
+		}
+	}
+}
+
+// late hands on a job the stage stopped waiting for.
+func (s *geocodeStage) late(job *geocodeJob) {
+	switch {
+	case job.done == nil:
+	case job.item == nil:
+		job.done(true)
+	default:
+		s.incr(job.item.Metric("geocode.late"))
+		job.done(false)
+	}
+}
+
+// firstWaiting returns the lowest sequence number of the waiting jobs.
+func firstWaiting(waiting map[int64]*geocodeJob) int64 {
+	first := int64(-1)
+	for seq := range waiting {
+		if first < 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+func (s *geocodeStage) gaugeQueue() {
+	if err := s.session.Statsd.Gauge("geocode.queueDepth", int64(len(s.queue))); err != nil {
+		s.session.Logger.Warn("Failed to emit metric geocode.queueDepth", "err", err)
+	}
+}
+
+func (s *geocodeStage) incr(metric string) {
+	if err := s.session.Statsd.Incr(metric, 1); err != nil {
+		s.session.Logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+}
+
+// placeCountry takes the country from the tweet's place, which needs no
+// geocoder request.
+func (s *geocodeStage) placeCountry(item *Item) bool {
+	country := placeCountry(item.Raw)
+	if country == "" {
+		return false
+	}
+	s.setCountry(item, country)
+	return true
+}
+
+func (s *geocodeStage) geocode(item *Item) {
+	if s.placeCountry(item) {
+		return
+	}
+
+	coordinates := item.Tweet.Coordinates
+	start := time.Now()
+	country, err := s.session.Geocoder.Country(coordinates.Lat, coordinates.Long)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		s.session.Logger.Warn("Failed to geocode coordinates to country", "err", err)
+		s.incr(item.Metric("geocode.failures"))
+		if s.counted(item) {
+			s.session.Countries.Fail()
+		}
+		return
+	}
+	s.setCountry(item, country)
+	if err := s.session.Statsd.Timing("googleApiRequestTime", elapsed.Nanoseconds()/1000000); err != nil {
+		s.session.Logger.Warn("Failed to emit metric googleApiRequestTime", "err", err)
+	}
+}
+
+// setCountry sets the country of the tweet, emitting it as
+// countries.<country> and counting it in the session's country stats.
+func (s *geocodeStage) setCountry(item *Item, country string) {
+	item.Country = country
+	s.incr(item.Metric(fmt.Sprintf("countries.%s", country)))
+	if s.counted(item) {
+		s.session.Countries.Add(country)
+	}
+}
+
+// counted tells whether the item counts towards the session's country
+// stats, which only live tweets do.
+func (s *geocodeStage) counted(item *Item) bool {
+	return s.session.Countries != nil && !item.Historical
+}
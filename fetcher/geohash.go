@@ -0,0 +1,77 @@
+package fetcher
+
+import "strings"
+
+// MaxGeohashPrecision is the longest geohash cells are counted at, cells
+// about 5 by 5 meters.
+const MaxGeohashPrecision = 9
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes coordinates as a geohash of precision characters. Each
+// character narrows the cell down by 5 bits, alternating between
+// longitude and latitude.
+func geohash(c Coordinates, precision int) string {
+	latRange := [2]float64{-90, 90}
+	longRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	even := true
+	bits, char := 0, 0
+	for len(hash) < precision {
+		if even {
+			char = char<<1 | halve(&longRange, c.Long)
+		} else {
+			char = char<<1 | halve(&latRange, c.Lat)
+		}
+		even = !even
+
+		bits++
+		if bits == 5 {
+			hash = append(hash, geohashAlphabet[char])
+			bits, char = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// halve narrows r down to the half value is in, returning 1 for the upper
+// half.
+func halve(r *[2]float64, value float64) int {
+	mid := (r[0] + r[1]) / 2
+	if value >= mid {
+		r[0] = mid
+		return 1
+	}
+	r[1] = mid
+	return 0
+}
+
+// geohashBox returns the area a geohash covers.
+func geohashBox(hash string) BoundingBox {
+	latRange := [2]float64{-90, 90}
+	longRange := [2]float64{-180, 180}
+
+	even := true
+	for i := 0; i < len(hash); i++ {
+		char := strings.IndexByte(geohashAlphabet, hash[i])
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &longRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if char>>uint(bit)&1 == 1 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+
+	return BoundingBox{
+		SouthWest: Coordinates{Lat: latRange[0], Long: longRange[0]},
+		NorthEast: Coordinates{Lat: latRange[1], Long: longRange[1]},
+	}
+}
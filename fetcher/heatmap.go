@@ -0,0 +1,238 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultHeatmapInterval = 2 * time.Second
+
+var (
+	defaultHeatmapPrecisions = []int{3, 4, 5}
+	defaultHeatmapWindows    = []time.Duration{5 * time.Minute, time.Hour}
+)
+
+// HeatmapOptions configure how sessions count their tweets in geohash
+// cells.
+type HeatmapOptions struct {
+	// Precisions are the geohash lengths cells are counted at, 3, 4 and 5 by
+	// default: cells of about 156km, 39km and 5km.
+	Precisions []int
+	// Windows are the periods tweets are counted over, 5m and 1h by default.
+	Windows []time.Duration
+	// Interval is how often sessions send the cells that changed to
+	// clients, 2s by default.
+	Interval time.Duration
+}
+
+func (o HeatmapOptions) Validate() error {
+	for _, precision := range o.Precisions {
+		if precision < 1 || precision > MaxGeohashPrecision {
+			return fmt.Errorf("Heatmap precisions have to be between 1 and %d", MaxGeohashPrecision)
+		}
+	}
+	for _, window := range o.Windows {
+		if err := validateWindow(window); err != nil {
+			return err
+		}
+	}
+	if o.Interval < 0 {
+		return errors.New("Heatmap interval can't be negative")
+	}
+	return nil
+}
+
+func (o HeatmapOptions) withDefaults() HeatmapOptions {
+	if len(o.Precisions) == 0 {
+		o.Precisions = defaultHeatmapPrecisions
+	}
+	if len(o.Windows) == 0 {
+		o.Windows = defaultHeatmapWindows
+	}
+	if o.Interval == 0 {
+		o.Interval = defaultHeatmapInterval
+	}
+	return o
+}
+
+// HeatmapFrame holds the counted cells of a window at a precision, most
+// counted first.
+type HeatmapFrame struct {
+	// Window is the period tweets were counted over, e.g. "5m".
+	Window    string
+	Precision int
+	Cells     []HeatmapCell
+	// Snapshot frames hold all the cells of the frame. The others only hold
+	// the cells that changed, with a count of 0 for cells that emptied.
+	Snapshot bool `json:",omitempty"`
+}
+
+// HeatmapCell is a geohash cell and how many tweets were sent from it.
+// Lat and Long are the center of the cell.
+type HeatmapCell struct {
+	Geohash string
+	Lat     float64
+	Long    float64
+	Count   int64
+}
+
+// Heatmap counts the tweets of a session in geohash cells over sliding
+// windows.
+type Heatmap struct {
+	precisions []int
+	// finest is the precision cells are counted at. Coarser cells are
+	// prefixes of them.
+	finest int
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	windows []*countWindow
+	// reported are the counts Deltas last returned, by frame.
+	reported map[heatmapKey]map[string]int64
+}
+
+type heatmapKey struct {
+	window    string
+	precision int
+}
+
+func newHeatmap(options HeatmapOptions) *Heatmap {
+	options = options.withDefaults()
+
+	h := &Heatmap{
+		precisions: options.Precisions,
+		now:        time.Now,
+		reported:   make(map[heatmapKey]map[string]int64),
+	}
+	for _, precision := range options.Precisions {
+		if precision > h.finest {
+			h.finest = precision
+		}
+	}
+	for _, window := range options.Windows {
+		h.windows = append(h.windows, newCountWindow(window))
+	}
+	return h
+}
+
+// Add counts a tweet sent from coordinates.
+func (h *Heatmap) Add(coordinates Coordinates) {
+	hash := geohash(coordinates, h.finest)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.now()
+	for _, window := range h.windows {
+		window.add(now, hash)
+	}
+}
+
+// Frame returns all the cells of a window at a precision, blank meaning
+// the first ones configured. It returns false if either wasn't configured.
+func (h *Heatmap) Frame(window string, precision int) (HeatmapFrame, bool) {
+	if window == "" {
+		window = windowName(h.windows[0].length)
+	}
+	if precision == 0 {
+		precision = h.precisions[0]
+	}
+	if !h.hasPrecision(precision) {
+		return HeatmapFrame{}, false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, w := range h.windows {
+		if windowName(w.length) == window {
+			counts := cellCounts(w.counts(h.now()), precision)
+			return HeatmapFrame{Window: window, Precision: precision, Cells: heatmapCells(counts), Snapshot: true}, true
+		}
+	}
+	return HeatmapFrame{}, false
+}
+
+// Deltas returns the cells whose counts changed since Deltas was last
+// called, for every window and precision that has any. Cells that emptied
+// are returned with a count of 0.
+func (h *Heatmap) Deltas() []HeatmapFrame {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.now()
+	frames := []HeatmapFrame{}
+	for _, w := range h.windows {
+		window := windowName(w.length)
+		for _, precision := range h.precisions {
+			key := heatmapKey{window, precision}
+			counts := cellCounts(w.counts(now), precision)
+			reported := h.reported[key]
+
+			changed := make(map[string]int64)
+			for hash, count := range counts {
+				if reported[hash] != count {
+					changed[hash] = count
+				}
+			}
+			for hash := range reported {
+				if _, ok := counts[hash]; !ok {
+					changed[hash] = 0
+				}
+			}
+			h.reported[key] = counts
+
+			if len(changed) > 0 {
+				frames = append(frames, HeatmapFrame{Window: window, Precision: precision, Cells: heatmapCells(changed)})
+			}
+		}
+	}
+	return frames
+}
+
+func (h *Heatmap) hasPrecision(precision int) bool {
+	for _, p := range h.precisions {
+		if p == precision {
+			return true
+		}
+	}
+	return false
+}
+
+// cellCounts sums up counts of finer cells by their cells at precision.
+func cellCounts(counts map[string]int64, precision int) map[string]int64 {
+	cells := make(map[string]int64)
+	for hash, count := range counts {
+		cells[hash[:precision]] += count
+	}
+	return cells
+}
+
+func heatmapCells(counts map[string]int64) []HeatmapCell {
+	cells := make([]HeatmapCell, 0, len(counts))
+	for hash, count := range counts {
+		box := geohashBox(hash)
+		cells = append(cells, HeatmapCell{
+			Geohash: hash,
+			Lat:     (box.SouthWest.Lat + box.NorthEast.Lat) / 2,
+			Long:    (box.SouthWest.Long + box.NorthEast.Long) / 2,
+			Count:   count,
+		})
+	}
+	sort.Sort(byCellCount(cells))
+	return cells
+}
+
+type byCellCount []HeatmapCell
+
+func (c byCellCount) Len() int      { return len(c) }
+func (c byCellCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCellCount) Less(i, j int) bool {
+	if c[i].Count != c[j].Count {
+		return c[i].Count > c[j].Count
+	}
+	return c[i].Geohash < c[j].Geohash
+}
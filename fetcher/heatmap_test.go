@@ -0,0 +1,122 @@
+package fetcher_test
+
+import (
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Heatmap", func() {
+	var (
+		now     time.Time
+		heatmap *fetcher.Heatmap
+	)
+
+	var (
+		berlin  = fetcher.Coordinates{Lat: 52.52, Long: 13.40}
+		potsdam = fetcher.Coordinates{Lat: 52.40, Long: 13.06}
+		denver  = fetcher.Coordinates{Lat: 39.74, Long: -104.99}
+	)
+
+	clock := func() time.Time {
+		return now
+	}
+
+	cells := func(frame fetcher.HeatmapFrame) map[string]int64 {
+		counts := make(map[string]int64)
+		for _, cell := range frame.Cells {
+			counts[cell.Geohash] = cell.Count
+		}
+		return counts
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2016, 9, 6, 9, 20, 0, 0, time.UTC)
+		heatmap = fetcher.NewHeatmap(fetcher.HeatmapOptions{Precisions: []int{3, 5}, Windows: []time.Duration{time.Minute, time.Hour}}, clock)
+	})
+
+	It("encodes geohashes", func() {
+		Expect(fetcher.Geohash(fetcher.Coordinates{Lat: 57.64911, Long: 10.40744}, 11)).To(Equal("u4pruydqqvj"))
+		Expect(fetcher.Geohash(berlin, 5)).To(Equal("u33db"))
+		Expect(fetcher.Geohash(denver, 3)).To(Equal("9xj"))
+	})
+
+	It("counts tweets in cells at every precision", func() {
+		heatmap.Add(berlin)
+		heatmap.Add(berlin)
+		heatmap.Add(potsdam)
+		heatmap.Add(denver)
+
+		frame, ok := heatmap.Frame("1m", 3)
+		Expect(ok).To(BeTrue())
+		Expect(frame.Snapshot).To(BeTrue())
+		Expect(frame.Cells).To(HaveLen(2))
+		Expect(frame.Cells[0].Geohash).To(Equal("u33"))
+		Expect(frame.Cells[0].Count).To(Equal(int64(3)))
+		// Cells are located at their center.
+		Expect(frame.Cells[0].Lat).To(BeNumerically("~", 52.73, 0.01))
+		Expect(frame.Cells[0].Long).To(BeNumerically("~", 13.36, 0.01))
+
+		frame, _ = heatmap.Frame("1h", 5)
+		Expect(cells(frame)).To(Equal(map[string]int64{"u33db": 2, "u3361": 1, "9xj64": 1}))
+	})
+
+	It("defaults to the first window and precision", func() {
+		heatmap.Add(berlin)
+
+		frame, ok := heatmap.Frame("", 0)
+		Expect(ok).To(BeTrue())
+		Expect(frame.Window).To(Equal("1m"))
+		Expect(frame.Precision).To(Equal(3))
+
+		_, ok = heatmap.Frame("5m", 3)
+		Expect(ok).To(BeFalse())
+		_, ok = heatmap.Frame("1m", 4)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("forgets tweets once they leave a window", func() {
+		heatmap.Add(berlin)
+		now = now.Add(90 * time.Second)
+		heatmap.Add(denver)
+
+		frame, _ := heatmap.Frame("1m", 3)
+		Expect(cells(frame)).To(Equal(map[string]int64{"9xj": 1}))
+		frame, _ = heatmap.Frame("1h", 3)
+		Expect(cells(frame)).To(Equal(map[string]int64{"u33": 1, "9xj": 1}))
+	})
+
+	It("reports the cells that changed", func() {
+		heatmap.Add(berlin)
+		deltas := heatmap.Deltas()
+		Expect(deltas).To(HaveLen(4))
+		Expect(deltas[0].Window).To(Equal("1m"))
+		Expect(deltas[0].Precision).To(Equal(3))
+		Expect(deltas[0].Snapshot).To(BeFalse())
+		Expect(cells(deltas[0])).To(Equal(map[string]int64{"u33": 1}))
+
+		Expect(heatmap.Deltas()).To(BeEmpty())
+
+		now = now.Add(90 * time.Second)
+		heatmap.Add(potsdam)
+		deltas = heatmap.Deltas()
+		// Potsdam took Berlin's place in the coarse cell of the short window,
+		// which didn't change.
+		Expect(deltas).To(HaveLen(3))
+		Expect(deltas[0].Precision).To(Equal(5))
+		Expect(cells(deltas[0])).To(Equal(map[string]int64{"u33db": 0, "u3361": 1}))
+		Expect(cells(deltas[1])).To(Equal(map[string]int64{"u33": 2}))
+		Expect(cells(deltas[2])).To(Equal(map[string]int64{"u3361": 1}))
+	})
+
+	It("rejects invalid options", func() {
+		Expect(fetcher.HeatmapOptions{Precisions: []int{0}}.Validate()).To(HaveOccurred())
+		Expect(fetcher.HeatmapOptions{Precisions: []int{fetcher.MaxGeohashPrecision + 1}}.Validate()).To(HaveOccurred())
+		Expect(fetcher.HeatmapOptions{Windows: []time.Duration{time.Second}}.Validate()).To(HaveOccurred())
+		Expect(fetcher.HeatmapOptions{Interval: -time.Second}.Validate()).To(HaveOccurred())
+		Expect(fetcher.HeatmapOptions{Precisions: []int{4}, Windows: []time.Duration{time.Hour}}.Validate()).NotTo(HaveOccurred())
+	})
+})
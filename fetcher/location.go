@@ -0,0 +1,76 @@
+package fetcher
+
+import (
+	"math"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const earthRadius = 6371000.0
+
+// tweetLocation returns the point a tweet should be shown at, whether it is
+// exact and how far from it the tweet may have actually been sent. Tweets
+// without exact coordinates fall back to the centroid of their place's
+// bounding box.
+func tweetLocation(tweet *twitter.Tweet) (coordinates Coordinates, location string, accuracy float64, ok bool) {
+	if tweet.Coordinates != nil {
+		coordinates = Coordinates{
+			Long: tweet.Coordinates.Coordinates[0],
+			Lat:  tweet.Coordinates.Coordinates[1],
+		}
+		return coordinates, LocationExact, 0, true
+	}
+
+	if tweet.Place == nil || tweet.Place.BoundingBox == nil || len(tweet.Place.BoundingBox.Coordinates) == 0 {
+		return Coordinates{}, "", 0, false
+	}
+
+	ring := tweet.Place.BoundingBox.Coordinates[0]
+	if len(ring) == 0 {
+		return Coordinates{}, "", 0, false
+	}
+
+	minLong, minLat := ring[0][0], ring[0][1]
+	maxLong, maxLat := minLong, minLat
+	for _, point := range ring[1:] {
+		minLong = math.Min(minLong, point[0])
+		maxLong = math.Max(maxLong, point[0])
+		minLat = math.Min(minLat, point[1])
+		maxLat = math.Max(maxLat, point[1])
+	}
+
+	coordinates = Coordinates{
+		Long: (minLong + maxLong) / 2,
+		Lat:  (minLat + maxLat) / 2,
+	}
+	for _, point := range ring {
+		accuracy = math.Max(accuracy, distance(coordinates, Coordinates{Long: point[0], Lat: point[1]}))
+	}
+
+	return coordinates, LocationPlace, accuracy, true
+}
+
+// placeCountry returns the country of the place a tweet is tagged with, if any.
+func placeCountry(tweet *twitter.Tweet) string {
+	if tweet.Place == nil {
+		return ""
+	}
+	if tweet.Place.Country != "" {
+		return tweet.Place.Country
+	}
+	return tweet.Place.CountryCode
+}
+
+// distance returns the great-circle distance between two points in meters.
+func distance(a, b Coordinates) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLong := radians(b.Long - a.Long)
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
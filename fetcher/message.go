@@ -0,0 +1,161 @@
+package fetcher
+
+import (
+	"strconv"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	MessageTweet      = "tweet"
+	MessageRetraction = "retraction"
+	MessageStatus     = "status"
+	MessageTrending   = "trending"
+	MessageHeatmap    = "heatmap"
+)
+
+const (
+	RetractionDeleted         = "deleted"
+	RetractionLocationDeleted = "location deleted"
+	RetractionWithheld        = "withheld"
+)
+
+const (
+	// StatusLimit is sent when Twitter holds back tweets matching the query.
+	StatusLimit = "limit"
+	// StatusStall is sent when the session falls behind reading the stream.
+	StatusStall = "stall"
+	// StatusDisconnect is sent when Twitter closes the stream.
+	StatusDisconnect = "disconnect"
+	// StatusState is sent when the session changes state, e.g. backs off.
+	StatusState = "state"
+)
+
+// Message is what sessions deliver to their subscribers. Type tells which
+// of the other fields is set.
+type Message struct {
+	Type       string
+	Tweet      *Tweet      `json:",omitempty"`
+	Retraction *Retraction `json:",omitempty"`
+	Status     *Status     `json:",omitempty"`
+	Trending   []Trending  `json:",omitempty"`
+	// Heatmap holds the cells that changed since the last heatmap message.
+	Heatmap []HeatmapFrame `json:",omitempty"`
+}
+
+// Retraction asks subscribers to forget tweets they've been sent. It
+// either names a single tweet by Id, or all tweets of UserId up to and
+// including UpToId.
+type Retraction struct {
+	Id     string `json:",omitempty"`
+	UserId string `json:",omitempty"`
+	UpToId string `json:",omitempty"`
+	Reason string
+}
+
+// Status reports the health of a session's stream.
+type Status struct {
+	Kind string
+	// Undelivered is how many matching tweets Twitter held back since the
+	// stream was connected.
+	Undelivered int64 `json:",omitempty"`
+	// PercentFull is how full Twitter's queue of tweets for the session is.
+	PercentFull int    `json:",omitempty"`
+	Code        string `json:",omitempty"`
+	Message     string `json:",omitempty"`
+	// State is the state the session changed to.
+	State State `json:",omitempty"`
+}
+
+func newTweetMessage(tweet *Tweet) *Message {
+	return &Message{Type: MessageTweet, Tweet: tweet}
+}
+
+func newRetractionMessage(retraction *Retraction) *Message {
+	return &Message{Type: MessageRetraction, Retraction: retraction}
+}
+
+func newStatusMessage(status *Status) *Message {
+	return &Message{Type: MessageStatus, Status: status}
+}
+
+func newTrendingMessage(trending []Trending) *Message {
+	return &Message{Type: MessageTrending, Trending: trending}
+}
+
+func newHeatmapMessage(frames []HeatmapFrame) *Message {
+	return &Message{Type: MessageHeatmap, Heatmap: frames}
+}
+
+func streamLimitStatus(limit *twitter.StreamLimit) *Status {
+	return &Status{
+		Kind:        StatusLimit,
+		Undelivered: limit.Track,
+	}
+}
+
+func stallWarningStatus(warning *twitter.StallWarning) *Status {
+	return &Status{
+		Kind:        StatusStall,
+		PercentFull: warning.PercentFull,
+		Code:        warning.Code,
+		Message:     warning.Message,
+	}
+}
+
+func streamDisconnectStatus(disconnect *twitter.StreamDisconnect) *Status {
+	return &Status{
+		Kind:    StatusDisconnect,
+		Code:    strconv.FormatInt(disconnect.Code, 10),
+		Message: disconnect.Reason,
+	}
+}
+
+func statusDeletionRetraction(deletion *twitter.StatusDeletion) *Retraction {
+	return &Retraction{
+		Id:     idString(deletion.IDStr, deletion.ID),
+		Reason: RetractionDeleted,
+	}
+}
+
+func locationDeletionRetraction(deletion *twitter.LocationDeletion) *Retraction {
+	return &Retraction{
+		UserId: idString(deletion.UserIDStr, deletion.UserID),
+		UpToId: idString(deletion.UpToStatusIDStr, deletion.UpToStatusID),
+		Reason: RetractionLocationDeleted,
+	}
+}
+
+func statusWithheldRetraction(withheld *twitter.StatusWithheld) *Retraction {
+	return &Retraction{
+		Id:     strconv.FormatInt(withheld.ID, 10),
+		Reason: RetractionWithheld,
+	}
+}
+
+// Retracts reports whether tweet is one of the tweets the retraction is for.
+func (r *Retraction) Retracts(tweet *Tweet) bool {
+	if r.Id != "" {
+		return r.Id == tweet.Id
+	}
+	if r.UserId != tweet.UserId {
+		return false
+	}
+
+	upTo, err := strconv.ParseInt(r.UpToId, 10, 64)
+	if err != nil {
+		return false
+	}
+	id, err := strconv.ParseInt(tweet.Id, 10, 64)
+	if err != nil {
+		return false
+	}
+	return id <= upTo
+}
+
+func idString(idStr string, id int64) string {
+	if idStr != "" {
+		return idStr
+	}
+	return strconv.FormatInt(id, 10)
+}
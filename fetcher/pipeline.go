@@ -0,0 +1,215 @@
+package fetcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/geocoder"
+)
+
+// Item is a tweet passing through a session's pipeline. Stages fill in
+// what later ones need.
+type Item struct {
+	Raw *twitter.Tweet
+	// Tweet is what clients are sent, built by the enrich stage.
+	Tweet *Tweet
+	// Country is set by the geocode stage if the tweet could be geocoded.
+	Country string
+	// Historical marks tweets found to backfill the session.
+	Historical bool
+	// Unmatched is set by the match stage on tweets it drops, so that
+	// recordings can mark them.
+	Unmatched bool
+}
+
+// Metric returns the name to emit a metric about the item under. Metrics
+// of historical tweets are prefixed with backfill., so they don't add to
+// the live rates.
+func (i *Item) Metric(name string) string {
+	if i.Historical {
+		return "backfill." + name
+	}
+	return name
+}
+
+// Stage is a step tweets go through in a session, e.g. filtering,
+// enriching, geocoding, emitting metrics or sending tweets to clients.
+// Stages are either a SyncStage or a ConcurrentStage.
+type Stage interface {
+	Name() string
+}
+
+// SyncStage is a stage that processes items on the goroutine handing them
+// over.
+type SyncStage interface {
+	Stage
+	// Process returns false to drop the item, so that later stages don't
+	// see it.
+	Process(item *Item) bool
+}
+
+// StageContext is what stages are configured with for a session.
+type StageContext struct {
+	Session  string
+	Query    Query
+	Logger   log.Logger
+	Statsd   statsd.Statsd
+	Geocoder geocoder.Geocoder
+	// Geocoding configures the geocode stage.
+	Geocoding GeocodeOptions
+	// Send delivers a message to the session's clients. It returns false
+	// once the session is stopped.
+	Send func(*Message) bool
+	// Trends keeps track of what's trending in the session.
+	Trends *Trends
+	// Heatmap counts the session's tweets by where they were sent from.
+	Heatmap *Heatmap
+	// Countries counts the session's tweets by the country the geocode stage
+	// finds.
+	Countries *Countries
+}
+
+// StageFactory builds a stage for a session. It returns nil to leave the
+// stage out of the session's pipeline.
+type StageFactory func(session StageContext) Stage
+
+// DefaultStages make up the pipeline sessions use unless Config.Stages is
+// given: tweets are matched against the query, counted, enriched, counted towards trends, dropped if
+// they have no location, counted on the heatmap, geocoded, sent to clients
+// and counted again once shown.
+func DefaultStages() []StageFactory {
+	return []StageFactory{
+		newMatchStage,
+		newCountStage,
+		newEnrichStage,
+		newTrendStage,
+		newLocateStage,
+		newHeatmapStage,
+		newGeocodeStage,
+		newSinkStage,
+		newShownStage,
+	}
+}
+
+// pipeline runs items through stages in order. It emits how long each
+// stage takes as pipeline.<stage>.time and how many items it drops as
+// pipeline.<stage>.dropped.
+type pipeline struct {
+	stages       []Stage
+	logger       log.Logger
+	statsdClient statsd.Statsd
+}
+
+func newPipeline(factories []StageFactory, context StageContext) *pipeline {
+	p := &pipeline{logger: context.Logger, statsdClient: context.Statsd}
+	for _, factory := range factories {
+		stage := factory(context)
+		switch stage.(type) {
+		case nil:
+			continue
+		case SyncStage, ConcurrentStage:
+		default:
+			panic(fmt.Sprintf("Stage %s neither processes nor submits items", stage.Name()))
+		}
+		p.stages = append(p.stages, stage)
+	}
+	return p
+}
+
+func (p *pipeline) process(item *Item) {
+	p.run(0, item)
+}
+
+// then calls f once the items processed before have been through the
+// pipeline, or dropped.
+func (p *pipeline) then(f func()) {
+	p.thenFrom(0, f)
+}
+
+func (p *pipeline) thenFrom(from int, f func()) {
+	for i := from; i < len(p.stages); i++ {
+		if concurrent, ok := p.stages[i].(ConcurrentStage); ok {
+			next := i + 1
+			concurrent.Then(func() { p.thenFrom(next, f) })
+			return
+		}
+	}
+	f()
+}
+
+// run processes the item from the given stage on. At a concurrent stage
+// the rest of the stages are left to run once the stage is done with the
+// item.
+func (p *pipeline) run(from int, item *Item) {
+	for i := from; i < len(p.stages); i++ {
+		stage := p.stages[i]
+		start := time.Now()
+
+		if concurrent, ok := stage.(ConcurrentStage); ok {
+			next := i + 1
+			concurrent.Submit(item, func(keep bool) {
+				if p.processed(stage, start, keep) {
+					p.run(next, item)
+				}
+			})
+			return
+		}
+
+		if !p.processed(stage, start, stage.(SyncStage).Process(item)) {
+			return
+		}
+	}
+}
+
+func (p *pipeline) processed(stage Stage, start time.Time, keep bool) bool {
+	metric := fmt.Sprintf("pipeline.%s.time", stage.Name())
+	if err := p.statsdClient.PrecisionTiming(metric, time.Since(start)); err != nil {
+		p.logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+	if !keep {
+		metric = fmt.Sprintf("pipeline.%s.dropped", stage.Name())
+		if err := p.statsdClient.Incr(metric, 1); err != nil {
+			p.logger.Warn("Failed to emit metric "+metric, "err", err)
+		}
+	}
+	return keep
+}
+
+// close waits for the items concurrent stages are still processing.
+func (p *pipeline) close() {
+	for _, stage := range p.stages {
+		if concurrent, ok := stage.(ConcurrentStage); ok {
+			concurrent.Close()
+		}
+	}
+}
+
+// FilterStage drops the tweets keep returns false for.
+func FilterStage(name string, keep func(item *Item) bool) Stage {
+	return &funcStage{name: name, process: keep}
+}
+
+// MetricStage emits metrics about tweets and keeps all of them.
+func MetricStage(name string, emit func(item *Item)) Stage {
+	return &funcStage{name: name, process: func(item *Item) bool {
+		emit(item)
+		return true
+	}}
+}
+
+type funcStage struct {
+	name    string
+	process func(item *Item) bool
+}
+
+func (s *funcStage) Name() string {
+	return s.name
+}
+
+func (s *funcStage) Process(item *Item) bool {
+	return s.process(item)
+}
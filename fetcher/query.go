@@ -0,0 +1,441 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	// ModeFilter fetches tweets matching the query's filters.
+	ModeFilter = "filter"
+	// ModeSample fetches a small random sample of all public tweets.
+	ModeSample = "sample"
+	// ModeReplay plays back a recording of an earlier session.
+	ModeReplay = "replay"
+
+	// MaxBackfill is the most recent tweets a session can be backfilled with.
+	MaxBackfill = 100
+)
+
+// Query describes what a session fetches. Twitter matches tweets against
+// Track OR Locations OR Follow, so when several of them are given the
+// session additionally drops tweets that don't match all of them. Language
+// is applied by Twitter on top of the rest.
+type Query struct {
+	// Mode is one of ModeFilter, ModeSample or ModeReplay, blank means
+	// ModeFilter.
+	Mode string
+	// Expression is a boolean query such as `golang AND (docker OR
+	// kubernetes) -job`. Compile derives Track from it, and tweets are
+	// checked against the whole expression locally.
+	Expression string `json:",omitempty"`
+	Track      []string
+	Locations  []BoundingBox
+	// Language holds BCP 47 language codes, e.g. "en".
+	Language []string
+	// Follow holds screen names of the accounts whose tweets to fetch.
+	Follow []string
+	// Replay picks the recording to play back in ModeReplay.
+	Replay *ReplayOptions `json:",omitempty"`
+	// Backfill is how many recent matching tweets to search for and show
+	// before live ones in ModeFilter, at most MaxBackfill.
+	Backfill int `json:",omitempty"`
+
+	expression expression
+}
+
+// BoundingBox is an area given by its south-west and north-east corners.
+type BoundingBox struct {
+	SouthWest Coordinates
+	NorthEast Coordinates
+}
+
+// Compile parses Expression and replaces Track with the terms derived from
+// it. Queries without an expression are left as they are.
+func (q *Query) Compile() error {
+	if q.Expression == "" || q.expression != nil {
+		return nil
+	}
+	if q.Mode != "" && q.Mode != ModeFilter {
+		return fmt.Errorf("Expressions can't be used in %s mode", q.Mode)
+	}
+	if len(q.Track) > 0 {
+		return errors.New("Track terms can't be given along with an expression")
+	}
+
+	e, err := parseExpression(q.Expression)
+	if err != nil {
+		return err
+	}
+	track, err := trackTerms(e)
+	if err != nil {
+		return err
+	}
+
+	q.expression = e
+	q.Track = track
+	return nil
+}
+
+func (q Query) Validate() error {
+	if q.Expression != "" && q.expression == nil {
+		if err := q.Compile(); err != nil {
+			return err
+		}
+	}
+	if q.Backfill < 0 || q.Backfill > MaxBackfill {
+		return fmt.Errorf("Backfill has to be between 0 and %d", MaxBackfill)
+	}
+	if q.Backfill > 0 && (q.IsSample() || q.IsReplay()) {
+		return fmt.Errorf("Backfill isn't available in %s mode", q.Mode)
+	}
+
+	switch q.Mode {
+	case "", ModeFilter:
+	case ModeSample:
+		if len(q.Track) > 0 || len(q.Locations) > 0 || len(q.Follow) > 0 {
+			return errors.New("Sample mode can only be filtered by language")
+		}
+		return q.validateLanguage()
+	case ModeReplay:
+		if len(q.Track) > 0 || len(q.Locations) > 0 || len(q.Follow) > 0 || len(q.Language) > 0 {
+			return errors.New("Replay mode can't be filtered")
+		}
+		if q.Replay == nil {
+			return errors.New("Recording to replay can't be blank")
+		}
+		return q.Replay.Validate()
+	default:
+		return fmt.Errorf("Unknown mode %q", q.Mode)
+	}
+
+	if len(q.Track) == 0 && len(q.Locations) == 0 && len(q.Follow) == 0 {
+		if q.Expression != "" {
+			return errors.New("Expression has to require some words unless locations or accounts to follow are given")
+		}
+		return errors.New("Query can't be blank")
+	}
+	for _, term := range q.Track {
+		if strings.TrimSpace(term) == "" {
+			return errors.New("Track terms can't be blank")
+		}
+	}
+	for _, box := range q.Locations {
+		if err := box.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, name := range q.Follow {
+		if strings.TrimSpace(strings.TrimPrefix(name, "@")) == "" {
+			return errors.New("Screen names to follow can't be blank")
+		}
+	}
+	return q.validateLanguage()
+}
+
+func (q Query) validateLanguage() error {
+	for _, language := range q.Language {
+		if strings.TrimSpace(language) == "" {
+			return errors.New("Languages can't be blank")
+		}
+	}
+	return nil
+}
+
+func (q Query) IsSample() bool {
+	return q.Mode == ModeSample
+}
+
+func (q Query) IsReplay() bool {
+	return q.Mode == ModeReplay
+}
+
+func (q Query) String() string {
+	parts := []string{}
+	if q.IsSample() {
+		parts = append(parts, "a sample of all tweets")
+	}
+	if q.IsReplay() && q.Replay != nil {
+		parts = append(parts, fmt.Sprintf("replay of %s at %gx", q.Replay.File, q.Replay.speed()))
+	}
+	if q.Expression != "" {
+		parts = append(parts, q.Expression)
+	} else if len(q.Track) > 0 {
+		parts = append(parts, strings.Join(q.Track, ", "))
+	}
+	if len(q.Locations) > 0 {
+		boxes := make([]string, 0, len(q.Locations))
+		for _, box := range q.Locations {
+			boxes = append(boxes, box.String())
+		}
+		parts = append(parts, "within "+strings.Join(boxes, ", "))
+	}
+	if len(q.Follow) > 0 {
+		parts = append(parts, "by @"+strings.Join(q.screenNames(), ", @"))
+	}
+	if len(q.Language) > 0 {
+		parts = append(parts, "in "+strings.Join(q.Language, ", "))
+	}
+	return strings.Join(parts, " ")
+}
+
+// screenNames returns the accounts to follow without leading @.
+func (q Query) screenNames() []string {
+	names := make([]string, 0, len(q.Follow))
+	for _, name := range q.Follow {
+		names = append(names, strings.TrimPrefix(strings.TrimSpace(name), "@"))
+	}
+	return names
+}
+
+// filterParams builds stream parameters for the query. follow holds the IDs
+// the screen names in Follow were resolved to.
+func (q Query) filterParams(follow []int64) *twitter.StreamFilterParams {
+	params := &twitter.StreamFilterParams{
+		Track:         q.Track,
+		Language:      q.Language,
+		StallWarnings: twitter.Bool(true),
+	}
+	for _, id := range follow {
+		params.Follow = append(params.Follow, strconv.FormatInt(id, 10))
+	}
+	for _, box := range q.Locations {
+		params.Locations = append(params.Locations,
+			fmt.Sprint(box.SouthWest.Long),
+			fmt.Sprint(box.SouthWest.Lat),
+			fmt.Sprint(box.NorthEast.Long),
+			fmt.Sprint(box.NorthEast.Lat),
+		)
+	}
+	return params
+}
+
+// searchQueries builds search parameters for the query. Search takes a
+// single circle to search within, so one search is made per bounding box.
+func (q Query) searchQueries(count int) []url.Values {
+	terms := []string{}
+	for _, term := range q.Track {
+		term = strings.TrimSpace(term)
+		if strings.Contains(term, " ") {
+			// Search ORs terms before ANDing their words.
+			term = "(" + term + ")"
+		}
+		terms = append(terms, term)
+	}
+	for _, name := range q.screenNames() {
+		terms = append(terms, "from:"+name)
+	}
+
+	params := url.Values{}
+	params.Set("q", strings.Join(terms, " OR "))
+	params.Set("count", strconv.Itoa(count))
+	params.Set("result_type", "recent")
+	if len(q.Language) == 1 {
+		params.Set("lang", strings.TrimSpace(q.Language[0]))
+	}
+
+	if len(q.Locations) == 0 {
+		return []url.Values{params}
+	}
+
+	queries := make([]url.Values, 0, len(q.Locations))
+	for _, box := range q.Locations {
+		center := Coordinates{
+			Lat:  (box.SouthWest.Lat + box.NorthEast.Lat) / 2,
+			Long: (box.SouthWest.Long + box.NorthEast.Long) / 2,
+		}
+		radius := distance(center, box.NorthEast) / 1000
+
+		boxParams := url.Values{}
+		for key, values := range params {
+			boxParams[key] = values
+		}
+		boxParams.Set("geocode", fmt.Sprintf("%g,%g,%gkm", center.Lat, center.Long, math.Ceil(radius)))
+		queries = append(queries, boxParams)
+	}
+	return queries
+}
+
+func sampleParams() *twitter.StreamSampleParams {
+	return &twitter.StreamSampleParams{
+		StallWarnings: twitter.Bool(true),
+	}
+}
+
+// accepts reports whether a tweet received for the query has to be shown.
+// The sample stream can't be filtered by Twitter, so languages are checked
+// locally.
+func (q Query) accepts(tweet *twitter.Tweet) bool {
+	if q.IsSample() {
+		return q.matchesLanguage(tweet)
+	}
+	if q.expression == nil && !q.combined() {
+		return true
+	}
+	return q.matches(tweet)
+}
+
+// delivers reports whether Twitter would send a tweet on a stream of the
+// query alone: one matching any of its track terms, locations or accounts,
+// in one of its languages. Sessions share a stream of all their queries,
+// which tweets are routed from with it.
+func (q Query) delivers(tweet *twitter.Tweet) bool {
+	if q.IsSample() {
+		return true
+	}
+	if !q.matchesLanguage(tweet) {
+		return false
+	}
+	return len(q.Track) > 0 && q.matchesTrack(tweet) ||
+		len(q.Locations) > 0 && q.matchesLocations(tweet) ||
+		len(q.Follow) > 0 && q.matchesFollow(tweet)
+}
+
+// combined reports whether Twitter ORs several parts of the query, so that
+// tweets have to be checked against all of them locally.
+func (q Query) combined() bool {
+	parts := 0
+	for _, n := range []int{len(q.Track), len(q.Locations), len(q.Follow)} {
+		if n > 0 {
+			parts++
+		}
+	}
+	return parts > 1
+}
+
+// matches reports whether a tweet satisfies every part of the query.
+func (q Query) matches(tweet *twitter.Tweet) bool {
+	return q.matchesExpression(tweet) && q.matchesTrack(tweet) && q.matchesLocations(tweet) && q.matchesFollow(tweet)
+}
+
+func (q Query) matchesExpression(tweet *twitter.Tweet) bool {
+	return q.expression == nil || matchesText(q.expression, tweet.Text)
+}
+
+// matchesTrack follows Twitter's track semantics: a tweet matches if it
+// contains every word of at least one term as a whole word, ignoring case.
+// Plain words match hashtags and mentions too. Like Twitter, it looks at
+// the text of retweeted and quoted tweets, links and the author's screen
+// name as well.
+func (q Query) matchesTrack(tweet *twitter.Tweet) bool {
+	if len(q.Track) == 0 {
+		return true
+	}
+
+	words := wordSet(textWords(trackText(tweet)))
+	for _, term := range q.Track {
+		termWords := textWords(term)
+		matched := len(termWords) > 0
+		for _, word := range termWords {
+			if !words[word] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (q Query) matchesLocations(tweet *twitter.Tweet) bool {
+	if len(q.Locations) == 0 {
+		return true
+	}
+
+	coordinates, _, _, ok := tweetLocation(tweet)
+	if !ok {
+		return false
+	}
+	for _, box := range q.Locations {
+		if box.Contains(coordinates) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q Query) matchesLanguage(tweet *twitter.Tweet) bool {
+	if len(q.Language) == 0 {
+		return true
+	}
+	for _, language := range q.Language {
+		if strings.EqualFold(strings.TrimSpace(language), tweet.Lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFollow matches accounts by screen name, which all sources know,
+// rather than by the IDs Twitter is asked for. Like Twitter, it matches
+// tweets by the accounts, retweets of their tweets and replies to them.
+func (q Query) matchesFollow(tweet *twitter.Tweet) bool {
+	if len(q.Follow) == 0 {
+		return true
+	}
+
+	accounts := []string{tweet.InReplyToScreenName}
+	if tweet.User != nil {
+		accounts = append(accounts, tweet.User.ScreenName)
+	}
+	if tweet.RetweetedStatus != nil && tweet.RetweetedStatus.User != nil {
+		accounts = append(accounts, tweet.RetweetedStatus.User.ScreenName)
+	}
+	for _, name := range q.screenNames() {
+		for _, account := range accounts {
+			if account != "" && strings.EqualFold(name, account) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trackText joins the parts of a tweet Twitter matches track terms
+// against.
+func trackText(tweet *twitter.Tweet) string {
+	parts := []string{tweet.Text}
+	if tweet.User != nil {
+		parts = append(parts, tweet.User.ScreenName)
+	}
+	if tweet.Entities != nil {
+		for _, link := range tweet.Entities.Urls {
+			parts = append(parts, link.ExpandedURL, link.DisplayURL)
+		}
+	}
+	for _, other := range []*twitter.Tweet{tweet.RetweetedStatus, tweet.QuotedStatus} {
+		if other != nil {
+			parts = append(parts, other.Text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (b BoundingBox) Validate() error {
+	for _, c := range []Coordinates{b.SouthWest, b.NorthEast} {
+		if c.Lat < -90 || c.Lat > 90 || c.Long < -180 || c.Long > 180 {
+			return fmt.Errorf("Bounding box %s is out of range", b)
+		}
+	}
+	if b.SouthWest.Lat >= b.NorthEast.Lat || b.SouthWest.Long >= b.NorthEast.Long {
+		return fmt.Errorf("Bounding box %s must go from south-west to north-east", b)
+	}
+	return nil
+}
+
+func (b BoundingBox) Contains(c Coordinates) bool {
+	return c.Lat >= b.SouthWest.Lat && c.Lat <= b.NorthEast.Lat &&
+		c.Long >= b.SouthWest.Long && c.Long <= b.NorthEast.Long
+}
+
+func (b BoundingBox) String() string {
+	return fmt.Sprintf("[%g,%g,%g,%g]", b.SouthWest.Long, b.SouthWest.Lat, b.NorthEast.Long, b.NorthEast.Lat)
+}
@@ -0,0 +1,130 @@
+package fetcher_test
+
+import (
+	"github.com/dghubble/go-twitter/twitter"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query", func() {
+	It("matches track terms on whole words", func() {
+		query := fetcher.Query{
+			Track:     []string{"go", "craft beer"},
+			Locations: []fetcher.BoundingBox{{SouthWest: fetcher.Coordinates{Lat: 52, Long: 13}, NorthEast: fetcher.Coordinates{Lat: 53, Long: 14}}},
+		}
+		accepts := func(text string) bool {
+			return query.Accepts(&twitter.Tweet{
+				Text:        text,
+				Coordinates: &twitter.Coordinates{Coordinates: [2]float64{13.4, 52.5}},
+			})
+		}
+
+		Expect(accepts("Let's Go!")).To(BeTrue())
+		Expect(accepts("#go meetup")).To(BeTrue())
+		Expect(accepts("beer, but craft")).To(BeTrue())
+		Expect(accepts("I google it")).To(BeFalse())
+		Expect(accepts("aircraft beers")).To(BeFalse())
+	})
+
+	It("delivers what Twitter would for the query alone", func() {
+		query := fetcher.Query{Track: []string{"golang"}, Follow: []string{"@gopher"}, Language: []string{"en"}}
+		gopher := &twitter.User{ScreenName: "Gopher"}
+
+		Expect(query.Delivers(&twitter.Tweet{Text: "Golang 1.8 is out", Lang: "en"})).To(BeTrue())
+		Expect(query.Delivers(&twitter.Tweet{Text: "Golang 1.8 is out", Lang: "de"})).To(BeFalse())
+		Expect(query.Delivers(&twitter.Tweet{Text: "See the release notes", Lang: "en", Entities: &twitter.Entities{
+			Urls: []twitter.URLEntity{{ExpandedURL: "https://golang.org/doc/go1.8"}},
+		}})).To(BeTrue())
+		Expect(query.Delivers(&twitter.Tweet{Text: "Hello", Lang: "en", User: gopher})).To(BeTrue())
+		Expect(query.Delivers(&twitter.Tweet{Text: "RT Hello", Lang: "en", RetweetedStatus: &twitter.Tweet{User: gopher}})).To(BeTrue())
+		Expect(query.Delivers(&twitter.Tweet{Text: "Hi there", Lang: "en", InReplyToScreenName: "gopher"})).To(BeTrue())
+		Expect(query.Delivers(&twitter.Tweet{Text: "Hello", Lang: "en", User: &twitter.User{ScreenName: "someone"}})).To(BeFalse())
+	})
+})
+
+var _ = Describe("Query expressions", func() {
+	compile := func(expression string) fetcher.Query {
+		query := fetcher.Query{Expression: expression}
+		Expect(query.Compile()).To(Succeed())
+		return query
+	}
+
+	accepts := func(query fetcher.Query, text string) bool {
+		return query.Accepts(&twitter.Tweet{Text: text})
+	}
+
+	It("derives track terms", func() {
+		Expect(compile("golang").Track).To(Equal([]string{"golang"}))
+		Expect(compile("golang docker").Track).To(Equal([]string{"golang docker"}))
+		Expect(compile("golang AND (docker OR kubernetes) -job").Track).To(Equal([]string{"golang docker", "golang kubernetes"}))
+		Expect(compile(`"craft beer" OR wine`).Track).To(Equal([]string{"craft beer", "wine"}))
+		Expect(compile("#golang OR @golang").Track).To(Equal([]string{"#golang", "@golang"}))
+	})
+
+	It("falls back to broader terms when combining them gets too long", func() {
+		query := compile("(aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa OR b) (cccccccccccccccccccccccccc OR d OR e)")
+		Expect(query.Track).To(Equal([]string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "b"}))
+		Expect(accepts(query, "b d")).To(BeTrue())
+		Expect(accepts(query, "b")).To(BeFalse())
+	})
+
+	It("filters tweets by the whole expression", func() {
+		query := compile("golang AND (docker OR kubernetes) -job")
+
+		Expect(accepts(query, "Running Golang in Docker")).To(BeTrue())
+		Expect(accepts(query, "#golang on #kubernetes")).To(BeTrue())
+		Expect(accepts(query, "golang docker job offer")).To(BeFalse())
+		Expect(accepts(query, "golang only")).To(BeFalse())
+		Expect(accepts(query, "golangdocker")).To(BeFalse())
+	})
+
+	It("matches phrases in order", func() {
+		query := compile(`"craft beer" -ipa`)
+
+		Expect(accepts(query, "Great  craft\nbeer tonight")).To(BeTrue())
+		Expect(accepts(query, "beer, craft")).To(BeFalse())
+		Expect(accepts(query, "craft beer IPA")).To(BeFalse())
+		Expect(accepts(query, "aircraft beers")).To(BeFalse())
+		Expect(accepts(query, "#craft beer!")).To(BeTrue())
+	})
+
+	It("matches words joining several like phrases", func() {
+		query := compile("e-mail")
+
+		Expect(query.Track).To(Equal([]string{"e mail"}))
+		Expect(accepts(query, "Send me an E-Mail")).To(BeTrue())
+		Expect(accepts(query, "mail me, e.g. today")).To(BeFalse())
+	})
+
+	It("reports the position of parse errors", func() {
+		for expression, position := range map[string]int{
+			"golang AND":         11,
+			"(golang":            8,
+			"golang)":            7,
+			`golang "craft beer`: 8,
+			"golang OR OR go":    11,
+			`""`:                 1,
+		} {
+			query := fetcher.Query{Expression: expression}
+			err := query.Compile()
+			Expect(err).To(BeAssignableToTypeOf(&fetcher.ExpressionError{}), expression)
+			Expect(err.(*fetcher.ExpressionError).Pos).To(Equal(position), expression)
+		}
+	})
+
+	It("can't be combined with track terms", func() {
+		query := fetcher.Query{Expression: "golang", Track: []string{"docker"}}
+		Expect(query.Compile()).NotTo(Succeed())
+	})
+
+	It("needs some words unless filtered otherwise", func() {
+		Expect(compile("-job").Validate()).NotTo(Succeed())
+
+		query := compile("-job")
+		query.Follow = []string{"golang"}
+		Expect(query.Validate()).To(Succeed())
+	})
+})
@@ -0,0 +1,360 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/recorder"
+)
+
+// ReplayOptions pick the recording a replay session plays back.
+type ReplayOptions struct {
+	// File is the name of a recording in the recordings directory.
+	File string
+	// Speed scales the time between messages, 2 plays twice as fast. Zero
+	// means 1.
+	Speed float64
+}
+
+// Replay controls a session playing back a recording.
+type Replay interface {
+	Pause()
+	Resume()
+	// Seek continues playing from position, measured from the first message
+	// of the recording.
+	Seek(position time.Duration)
+	Status() ReplayStatus
+}
+
+type ReplayStatus struct {
+	File     string
+	Speed    float64
+	Paused   bool
+	Finished bool
+	Position time.Duration
+}
+
+// ParseSpeed parses replay speeds such as "10x", "0.5x" or "2".
+func ParseSpeed(speed string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(speed), "x"), 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid speed %q", speed)
+	}
+	return value, nil
+}
+
+func (o *ReplayOptions) Validate() error {
+	if o.File == "" {
+		return errors.New("Recording to replay can't be blank")
+	}
+	if o.File != filepath.Base(o.File) || o.File == ".." {
+		return fmt.Errorf("Recording %q has to be a file name", o.File)
+	}
+	if o.Speed < 0 {
+		return fmt.Errorf("Invalid speed %g", o.Speed)
+	}
+	return nil
+}
+
+func (o *ReplayOptions) speed() float64 {
+	if o.Speed == 0 {
+		return 1
+	}
+	return o.Speed
+}
+
+type replaySource struct {
+	dir string
+}
+
+// newReplaySource plays back recordings from dir, keeping the time between
+// messages they were received with.
+func newReplaySource(dir string) Source {
+	return &replaySource{dir: dir}
+}
+
+func (s *replaySource) Open(query Query) (Stream, error) {
+	if query.Replay == nil {
+		return nil, errors.New("Nothing to replay")
+	}
+
+	stream := &replayStream{
+		path:     filepath.Join(s.dir, query.Replay.File),
+		file:     query.Replay.File,
+		speed:    query.Replay.speed(),
+		messages: make(chan interface{}),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		seekTo:   -1,
+	}
+	if err := stream.open(); err != nil {
+		return nil, err
+	}
+
+	go stream.play()
+	return stream, nil
+}
+
+// replayStream sends each recorded message once its replay clock reaches
+// the offset the message was received at. The clock runs at speed times
+// wall time and stands still while paused.
+type replayStream struct {
+	path     string
+	file     string
+	speed    float64
+	messages chan interface{}
+	wake     chan struct{}
+	done     chan struct{}
+
+	reader *recorder.Reader
+	first  time.Time
+
+	mutex     sync.Mutex
+	paused    bool
+	finished  bool
+	seekTo    time.Duration
+	clockPos  time.Duration
+	clockBase time.Time
+}
+
+func (s *replayStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *replayStream) Stop() {
+	close(s.done)
+}
+
+func (s *replayStream) Pause() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.paused {
+		s.clockPos = s.position()
+		s.paused = true
+	}
+	s.notify()
+}
+
+func (s *replayStream) Resume() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.paused {
+		s.clockBase = time.Now()
+		s.paused = false
+	}
+	s.notify()
+}
+
+func (s *replayStream) Seek(position time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if position < 0 {
+		position = 0
+	}
+	s.seekTo = position
+	s.notify()
+}
+
+func (s *replayStream) Status() ReplayStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return ReplayStatus{
+		File:     s.file,
+		Speed:    s.speed,
+		Paused:   s.paused,
+		Finished: s.finished,
+		Position: s.position(),
+	}
+}
+
+// position has to be called with the mutex held.
+func (s *replayStream) position() time.Duration {
+	if s.paused || s.finished {
+		return s.clockPos
+	}
+	return s.clockPos + time.Duration(float64(time.Since(s.clockBase))*s.speed)
+}
+
+func (s *replayStream) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *replayStream) open() error {
+	reader, err := recorder.Open(s.path)
+	if err != nil {
+		return err
+	}
+	s.reader = reader
+	return nil
+}
+
+func (s *replayStream) play() {
+	defer close(s.messages)
+	defer func() {
+		s.reader.Close()
+	}()
+
+	record, err := s.reader.Next()
+	if err != nil {
+		s.finish(err)
+		return
+	}
+	s.first = record.ReceivedAt
+	if record.Dropped {
+		record, err = s.next()
+	}
+
+	s.mutex.Lock()
+	s.clockBase = time.Now()
+	s.mutex.Unlock()
+
+	for {
+		if err == io.EOF {
+			// The replay stays open at the end of the recording, so it can
+			// be played again by seeking back.
+			s.finish(err)
+			record = nil
+		} else if err != nil {
+			s.finish(err)
+			return
+		}
+
+		var seek, ok bool
+		if record != nil {
+			seek, ok = s.wait(record.ReceivedAt.Sub(s.first))
+		} else {
+			seek, ok = s.waitForSeek()
+		}
+		if !ok {
+			return
+		}
+
+		if seek {
+			record, err = s.seek()
+		} else {
+			select {
+			case s.messages <- decodeMessage(record.Message):
+			case <-s.done:
+				return
+			}
+			record, err = s.next()
+		}
+	}
+}
+
+// next reads the next record to play, leaving out the tweets the recorded
+// session dropped.
+func (s *replayStream) next() (*recorder.Record, error) {
+	for {
+		record, err := s.reader.Next()
+		if err != nil || !record.Dropped {
+			return record, err
+		}
+	}
+}
+
+// wait blocks until the replay clock reaches offset. It returns early if a
+// seek was requested, and false if the stream was stopped.
+func (s *replayStream) wait(offset time.Duration) (seek bool, ok bool) {
+	for {
+		s.mutex.Lock()
+		if s.seekTo >= 0 {
+			s.mutex.Unlock()
+			return true, true
+		}
+		paused := s.paused
+		remaining := offset - s.position()
+		s.mutex.Unlock()
+
+		if !paused && remaining <= 0 {
+			return false, true
+		}
+
+		var timer <-chan time.Time
+		if !paused {
+			timer = time.After(time.Duration(float64(remaining) / s.speed))
+		}
+
+		select {
+		case <-timer:
+		case <-s.wake:
+		case <-s.done:
+			return false, false
+		}
+	}
+}
+
+// waitForSeek blocks at the end of the recording until a seek is requested.
+// It returns false if the stream was stopped.
+func (s *replayStream) waitForSeek() (seek bool, ok bool) {
+	for {
+		s.mutex.Lock()
+		seek = s.seekTo >= 0
+		s.mutex.Unlock()
+
+		if seek {
+			return true, true
+		}
+
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return false, false
+		}
+	}
+}
+
+// seek reopens the recording and skips the records received before the
+// requested position.
+func (s *replayStream) seek() (*recorder.Record, error) {
+	s.mutex.Lock()
+	position := s.seekTo
+	s.seekTo = -1
+	s.finished = false
+	s.clockPos = position
+	s.clockBase = time.Now()
+	s.mutex.Unlock()
+
+	s.reader.Close()
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	for {
+		record, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if record.ReceivedAt.Sub(s.first) >= position {
+			return record, nil
+		}
+	}
+}
+
+func (s *replayStream) finish(err error) {
+	s.mutex.Lock()
+	s.clockPos = s.position()
+	s.finished = true
+	s.mutex.Unlock()
+
+	if err == io.EOF {
+		return
+	}
+	select {
+	case s.messages <- err:
+	case <-s.done:
+	}
+}
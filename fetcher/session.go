@@ -0,0 +1,551 @@
+package fetcher
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/geocoder"
+	"github.com/Altoros/tweets-fetcher/recorder"
+)
+
+var errStreamEnded = errors.New("Stream ended")
+
+// Session is a single named query whose matching tweets and retractions
+// are delivered on their own channel. The channel is closed once the
+// session is stopped.
+type Session interface {
+	ID() string
+	Query() Query
+	Messages() chan *Message
+	Recording() (recorder.Status, bool)
+	// Replay controls the playback of ModeReplay sessions.
+	Replay() (Replay, bool)
+	State() State
+	// Tweets is how many tweets the session has delivered so far.
+	Tweets() int64
+	// Trending returns the top terms of the session's live tweets for each
+	// window.
+	Trending() []Trending
+	// Heatmap returns the geohash cells of the session's live tweets for a
+	// window and precision, blank meaning the first ones configured. It
+	// returns false if they weren't configured.
+	Heatmap(window string, precision int) (HeatmapFrame, bool)
+	// Countries tells which countries the session's live tweets were sent
+	// from.
+	Countries() CountryStats
+}
+
+type session struct {
+	id           string
+	query        Query
+	logger       log.Logger
+	source       Source
+	statsdClient statsd.Statsd
+	geocoder     geocoder.Geocoder
+	backoff      backoff
+	messages     chan *Message
+	buffer       Backpressure
+	done         chan struct{}
+	consumed     chan struct{}
+	pipeline     *pipeline
+	state        *lifecycle
+	tweets       int64
+	trends       *Trends
+	heatmap      *Heatmap
+	countries    *Countries
+	// trendInterval and heatmapInterval are how often trends and heatmap
+	// changes are reported, until reported is closed.
+	trendInterval   time.Duration
+	heatmapInterval time.Duration
+	reported        chan struct{}
+	// transient sessions aren't kept in the store.
+	transient bool
+
+	// streamMutex guards stream along with the state changes that start
+	// and end it.
+	streamMutex sync.Mutex
+	stream      Stream
+
+	recorderMutex sync.Mutex
+	recorder      *recorder.Recorder
+}
+
+func newSession(f *fetcher, id string, query Query) *session {
+	s := &session{
+		id:           id,
+		query:        query,
+		logger:       f.logger.New("session", id),
+		source:       f.sourceFor(query),
+		statsdClient: f.statsdClient,
+		geocoder:     f.geocoder,
+		backoff:      f.backoff(),
+		messages:     f.config.Buffer.Channel(),
+		buffer:       f.config.Buffer,
+		done:         make(chan struct{}),
+		consumed:     make(chan struct{}),
+		state:        newLifecycle(id, f.stateChanged),
+		trends:       newTrends(f.config.Trending, query),
+		heatmap:      newHeatmap(f.config.Heatmap),
+		countries:    newCountries(),
+		reported:     make(chan struct{}),
+	}
+	s.trendInterval = f.config.Trending.withDefaults().Interval
+	s.heatmapInterval = f.config.Heatmap.withDefaults().Interval
+	s.pipeline = newPipeline(f.stages(), StageContext{
+		Session:   id,
+		Query:     query,
+		Logger:    s.logger,
+		Statsd:    s.statsdClient,
+		Geocoder:  s.geocoder,
+		Geocoding: f.config.Geocoding,
+		Send:      s.send,
+		Trends:    s.trends,
+		Heatmap:   s.heatmap,
+		Countries: s.countries,
+	})
+	return s
+}
+
+func (s *session) ID() string {
+	return s.id
+}
+
+func (s *session) Query() Query {
+	return s.query
+}
+
+func (s *session) Messages() chan *Message {
+	return s.messages
+}
+
+func (s *session) State() State {
+	return s.state.current()
+}
+
+func (s *session) Tweets() int64 {
+	return atomic.LoadInt64(&s.tweets)
+}
+
+func (s *session) Trending() []Trending {
+	return s.trends.Top()
+}
+
+func (s *session) Heatmap(window string, precision int) (HeatmapFrame, bool) {
+	return s.heatmap.Frame(window, precision)
+}
+
+func (s *session) Countries() CountryStats {
+	return s.countries.Stats()
+}
+
+// start connects to the source and keeps the session streaming in the
+// background, connecting again whenever that fails or the stream ends. The
+// error of the first attempt is returned.
+func (s *session) start() error {
+	s.logger.Info("Start fetching", "query", s.query.String())
+
+	go s.reportAggregates()
+	err := s.connect()
+	go s.run(err)
+	return err
+}
+
+func (s *session) stop() {
+	s.logger.Info("Stop fetching", "query", s.query.String())
+
+	s.streamMutex.Lock()
+	s.state.transition(StateStopped, nil)
+	stream := s.stream
+	s.stream = nil
+	s.streamMutex.Unlock()
+	s.state.flush()
+
+	close(s.done)
+	if stream != nil {
+		stream.Stop()
+	}
+	<-s.consumed
+	<-s.reported
+	s.pipeline.close()
+	close(s.messages)
+
+	if _, err := s.stopRecording(); err != nil && err != ErrNotRecording {
+		s.logger.Error("Failed to stop recording", "err", err)
+	}
+}
+
+func (s *session) Replay() (Replay, bool) {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+
+	replay, ok := s.stream.(Replay)
+	return replay, ok
+}
+
+func (s *session) connect() error {
+	defer s.state.flush()
+	if !s.state.transition(StateConnecting, nil) {
+		return nil
+	}
+	s.state.flush()
+
+	stream, err := s.source.Open(s.query)
+	if err != nil {
+		s.state.transition(StateBackingOff, err)
+		return err
+	}
+
+	// State changes are flushed once the mutex is unlocked.
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+
+	if !s.state.transition(StateStreaming, nil) {
+		// The session was stopped while connecting.
+		stream.Stop()
+		return nil
+	}
+	s.stream = stream
+	return nil
+}
+
+// disconnect backs off from a stream that ended by itself, returning false
+// if the session was stopped instead.
+func (s *session) disconnect() bool {
+	s.streamMutex.Lock()
+	if !s.state.transition(StateBackingOff, errStreamEnded) {
+		s.streamMutex.Unlock()
+		return false
+	}
+	stream := s.stream
+	s.stream = nil
+	s.streamMutex.Unlock()
+	s.state.flush()
+
+	s.logger.Warn("Stream ended, connecting again", "in", s.backoff.min)
+	stream.Stop()
+	return true
+}
+
+// run consumes the session's streams until it is stopped. err is the
+// outcome of the first connection.
+func (s *session) run(err error) {
+	defer close(s.consumed)
+
+	wait := s.backoff.min
+	backfilled := false
+	for {
+		if err == nil && s.State() == StateStreaming {
+			if !backfilled {
+				s.backfill()
+				backfilled = true
+			}
+			s.consume(s.currentStream())
+			if !s.disconnect() {
+				return
+			}
+			wait = s.backoff.min
+		} else if s.State() == StateStopped {
+			return
+		}
+
+		wait = s.backoff.after(wait, err)
+		if err != nil {
+			s.logger.Error("Fetching tweets", "err", err, "retryIn", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
+		wait = s.backoff.next(wait)
+
+		err = s.connect()
+	}
+}
+
+func (s *session) currentStream() Stream {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+
+	return s.stream
+}
+
+func (s *session) Recording() (recorder.Status, bool) {
+	s.recorderMutex.Lock()
+	defer s.recorderMutex.Unlock()
+
+	if s.recorder == nil {
+		return recorder.Status{}, false
+	}
+	return s.recorder.Status(), true
+}
+
+func (s *session) startRecording(dir string, options recorder.Options) (recorder.Status, error) {
+	s.recorderMutex.Lock()
+	defer s.recorderMutex.Unlock()
+
+	if s.recorder != nil {
+		return recorder.Status{}, ErrAlreadyRecording
+	}
+
+	rec, err := recorder.New(dir, s.id, options)
+	if err != nil {
+		return recorder.Status{}, err
+	}
+	s.recorder = rec
+
+	status := rec.Status()
+	s.logger.Info("Start recording", "file", status.File)
+	return status, nil
+}
+
+func (s *session) stopRecording() (recorder.Status, error) {
+	s.recorderMutex.Lock()
+	defer s.recorderMutex.Unlock()
+
+	if s.recorder == nil {
+		return recorder.Status{}, ErrNotRecording
+	}
+
+	status := s.recorder.Status()
+	err := s.recorder.Close()
+	s.recorder = nil
+
+	s.logger.Info("Stop recording", "files", len(status.Files), "records", status.Records)
+	return status, err
+}
+
+// record writes a message to the session's recording, if there is one.
+// Messages received as raw lines are written as they are, dropped marks
+// tweets the session didn't match.
+func (s *session) record(message interface{}, receivedAt time.Time, dropped bool) {
+	s.recorderMutex.Lock()
+	defer s.recorderMutex.Unlock()
+
+	if s.recorder == nil {
+		return
+	}
+
+	var line []byte
+	if raw, ok := message.(*rawMessage); ok {
+		line = raw.line
+	} else {
+		var err error
+		line, err = encodeMessage(message)
+		if err != nil {
+			s.logger.Warn("Failed to encode message for recording", "err", err)
+			return
+		}
+	}
+
+	err := s.recorder.Write(&recorder.Record{
+		Query:      s.query.String(),
+		ReceivedAt: receivedAt,
+		Message:    line,
+		Dropped:    dropped,
+	})
+	if err != nil {
+		s.logger.Warn("Failed to record message", "err", err)
+	}
+}
+
+func (s *session) consume(stream Stream) {
+	if stream == nil {
+		return
+	}
+
+	for message := range stream.Messages() {
+		receivedAt := time.Now()
+		received := message
+		if raw, ok := message.(*rawMessage); ok {
+			message = raw.message
+		}
+
+		// Tweets are recorded once the match stage tells whether they were
+		// dropped.
+		if tweet, ok := message.(*twitter.Tweet); ok {
+			matched := s.processTweet(tweet, false)
+			s.record(received, receivedAt, !matched)
+			continue
+		}
+		if _, ok := message.(error); !ok {
+			s.record(received, receivedAt, false)
+		}
+
+		switch v := message.(type) {
+		case *twitter.StatusDeletion:
+			s.retract(statusDeletionRetraction(v))
+		case *twitter.LocationDeletion:
+			s.retract(locationDeletionRetraction(v))
+		case *twitter.StatusWithheld:
+			s.retract(statusWithheldRetraction(v))
+		case *twitter.StreamLimit:
+			s.logger.Warn("Stream limit", "track", v.Track)
+			s.gauge("stream.undeliveredTweets", v.Track)
+			s.report(streamLimitStatus(v), "stream.limits")
+		case *twitter.StallWarning:
+			s.logger.Warn("Stall warning", "code", v.Code, "message", v.Message, "percentFull", v.PercentFull)
+			s.gauge("stream.stallPercentFull", int64(v.PercentFull))
+			s.report(stallWarningStatus(v), "stream.stallWarnings")
+		case *twitter.StreamDisconnect:
+			s.logger.Warn("Stream disconnected", "code", v.Code, "reason", v.Reason)
+			s.report(streamDisconnectStatus(v), "stream.disconnects")
+		case error:
+			s.logger.Error("Stream error", "err", v)
+		}
+	}
+}
+
+// report counts a stream status event in metric and tells the session's
+// subscribers about it.
+func (s *session) report(status *Status, metric string) {
+	err := s.statsdClient.Incr(metric, 1)
+	if err != nil {
+		s.logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+	s.send(newStatusMessage(status))
+}
+
+// reportAggregates reports trends every trendInterval and heatmap changes
+// every heatmapInterval, until the session is stopped.
+func (s *session) reportAggregates() {
+	defer close(s.reported)
+
+	trendTicker := time.NewTicker(s.trendInterval)
+	defer trendTicker.Stop()
+	heatmapTicker := time.NewTicker(s.heatmapInterval)
+	defer heatmapTicker.Stop()
+
+	for {
+		select {
+		case <-trendTicker.C:
+			s.reportTrends()
+		case <-heatmapTicker.C:
+			if frames := s.heatmap.Deltas(); len(frames) > 0 {
+				s.send(newHeatmapMessage(frames))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reportTrends sends what's trending to the session's subscribers. For
+// each window and kind of term it gauges the count of the top term as
+// top and the counts of all the top terms as total, rather than a gauge
+// per term, so that the number of metrics doesn't grow with the terms.
+func (s *session) reportTrends() {
+	trending := s.trends.Top()
+	empty := true
+	for _, window := range trending {
+		for kind := 0; kind < trendKinds; kind++ {
+			var top, total int64
+			for i, trend := range window.terms(kind) {
+				if i == 0 {
+					top = trend.Count
+				}
+				total += trend.Count
+			}
+			s.gauge(trendMetric(window.Window, kind, "top"), top)
+			s.gauge(trendMetric(window.Window, kind, "total"), total)
+		}
+		empty = empty && window.empty()
+	}
+
+	if !empty {
+		s.send(newTrendingMessage(trending))
+	}
+}
+
+func (s *session) gauge(metric string, value int64) {
+	err := s.statsdClient.Gauge(metric, value)
+	if err != nil {
+		s.logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+}
+
+// send delivers a message to the session's subscribers unless the session
+// is stopped first.
+func (s *session) send(message *Message) bool {
+	sent, dropped := s.buffer.Send(s.messages, message, s.done)
+	if dropped > 0 {
+		err := s.statsdClient.Incr("backpressure.session.dropped", int64(dropped))
+		if err != nil {
+			s.logger.Warn("Failed to emit metric backpressure.session.dropped", "err", err)
+		}
+	}
+	if sent && message.Type == MessageTweet {
+		atomic.AddInt64(&s.tweets, 1)
+	}
+	return sent
+}
+
+// retract tells the session's clients to take back tweets, once the tweets
+// that came before are through the pipeline so that it doesn't overtake
+// them.
+func (s *session) retract(retraction *Retraction) {
+	s.pipeline.then(func() { s.sendRetraction(retraction) })
+}
+
+func (s *session) sendRetraction(retraction *Retraction) {
+	s.logger.Debug("Retracting tweets", "id", retraction.Id, "user", retraction.UserId, "upTo", retraction.UpToId, "reason", retraction.Reason)
+
+	if !s.send(newRetractionMessage(retraction)) {
+		return
+	}
+
+	err := s.statsdClient.Incr("retractions", 1)
+	if err != nil {
+		s.logger.Warn("Failed to emit metric retractions", "err", err)
+	}
+}
+
+// backfill shows recent tweets matching the query before live ones, if the
+// query asks for it and the source can search.
+func (s *session) backfill() {
+	if s.query.Backfill == 0 {
+		return
+	}
+	searcher, ok := s.source.(Searcher)
+	if !ok {
+		s.logger.Warn("Source can't search for tweets to backfill with")
+		return
+	}
+
+	start := time.Now()
+	tweets, err := searcher.Search(s.query, s.query.Backfill)
+	if err := s.statsdClient.Timing("backfill.searchTime", time.Since(start).Nanoseconds()/1000000); err != nil {
+		s.logger.Warn("Failed to emit metric backfill.searchTime", "err", err)
+	}
+	if err != nil {
+		s.logger.Error("Failed to backfill", "err", err)
+		if err := s.statsdClient.Incr("backfill.errors", 1); err != nil {
+			s.logger.Warn("Failed to emit metric backfill.errors", "err", err)
+		}
+		return
+	}
+
+	s.logger.Info("Backfilling", "tweets", len(tweets))
+	for _, tweet := range tweets {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		s.processTweet(tweet, true)
+	}
+}
+
+// processTweet runs the tweet through the session's pipeline. It returns
+// false if the tweet didn't match the query.
+func (s *session) processTweet(tweet *twitter.Tweet, historical bool) bool {
+	item := &Item{Raw: tweet, Historical: historical}
+	s.pipeline.process(item)
+	return !item.Unmatched
+}
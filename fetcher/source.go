@@ -0,0 +1,25 @@
+package fetcher
+
+import "github.com/dghubble/go-twitter/twitter"
+
+// Source opens streams of tweets for queries.
+type Source interface {
+	Open(query Query) (Stream, error)
+}
+
+// Searcher is implemented by sources that can look up recent tweets, which
+// sessions are backfilled with when they start.
+type Searcher interface {
+	// Search returns up to limit recent geotagged tweets matching the query,
+	// oldest first.
+	Search(query Query, limit int) ([]*twitter.Tweet, error)
+}
+
+// Stream delivers the same messages go-twitter streams do: *twitter.Tweet,
+// stream notices such as *twitter.StatusDeletion or *twitter.StallWarning,
+// and errors. Streams of Twitter deliver them wrapped in *rawMessage. Messages
+// is closed once the stream ends or is stopped.
+type Stream interface {
+	Messages() <-chan interface{}
+	Stop()
+}
@@ -0,0 +1,71 @@
+package fetcher_test
+
+import "github.com/Altoros/tweets-fetcher/fetcher"
+
+// channelSource streams whatever is sent to it, whichever query it is
+// opened for.
+type channelSource struct {
+	messages chan interface{}
+	queries  chan fetcher.Query
+}
+
+func newChannelSource() *channelSource {
+	return &channelSource{
+		messages: make(chan interface{}),
+		queries:  make(chan fetcher.Query, 16),
+	}
+}
+
+func (s *channelSource) Open(query fetcher.Query) (fetcher.Stream, error) {
+	select {
+	case s.queries <- query:
+	default:
+	}
+
+	stream := &channelStream{
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+	}
+	go stream.forward(s.messages)
+	return stream, nil
+}
+
+// Send blocks until a stream opened from the source takes message.
+func (s *channelSource) Send(message interface{}) {
+	s.messages <- message
+}
+
+// Queries returns the queries the source was opened for.
+func (s *channelSource) Queries() <-chan fetcher.Query {
+	return s.queries
+}
+
+type channelStream struct {
+	messages chan interface{}
+	done     chan struct{}
+}
+
+func (s *channelStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *channelStream) Stop() {
+	close(s.done)
+}
+
+func (s *channelStream) forward(input chan interface{}) {
+	defer close(s.messages)
+
+	for {
+		select {
+		case message := <-input:
+			select {
+			case s.messages <- message:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package fetcher
+
+import "unicode/utf8"
+
+// newMatchStage drops the tweets that don't match the session's query,
+// whichever source they came from. Twitter matches the parts of a query
+// separately, so tweets it sends can still miss the expression or another
+// part.
+func newMatchStage(session StageContext) Stage {
+	return FilterStage("match", func(item *Item) bool {
+		item.Unmatched = !session.Query.accepts(item.Raw)
+		return !item.Unmatched
+	})
+}
+
+func newCountStage(session StageContext) Stage {
+	return MetricStage("count", func(item *Item) {
+		err := session.Statsd.Incr(item.Metric("totalTweets"), 1)
+		if err != nil {
+			session.Logger.Warn("Failed to emit metric totalTweets", "err", err)
+		}
+	})
+}
+
+func newEnrichStage(session StageContext) Stage {
+	return MetricStage("enrich", func(item *Item) {
+		item.Tweet = newTweet(item.Raw)
+		item.Tweet.Historical = item.Historical
+	})
+}
+
+// newTrendStage counts the terms of live tweets towards what's trending in
+// the session.
+func newTrendStage(session StageContext) Stage {
+	if session.Trends == nil {
+		return nil
+	}
+	return MetricStage("trend", func(item *Item) {
+		if !item.Historical {
+			session.Trends.Add(item.Tweet)
+		}
+	})
+}
+
+func newLocateStage(session StageContext) Stage {
+	return FilterStage("locate", func(item *Item) bool {
+		coordinates, location, accuracy, ok := tweetLocation(item.Raw)
+		if !ok {
+			session.Logger.Debug("Received a tweet without location, skipping")
+			return false
+		}
+
+		session.Logger.Debug("Received a tweet", "text", item.Raw.Text, "coordinates", coordinates, "location", location)
+		item.Tweet.Coordinates = coordinates
+		item.Tweet.Location = location
+		item.Tweet.Accuracy = accuracy
+		return true
+	})
+}
+
+// newHeatmapStage counts live tweets in the geohash cells of the session's
+// heatmap.
+func newHeatmapStage(session StageContext) Stage {
+	if session.Heatmap == nil {
+		return nil
+	}
+	return MetricStage("heatmap", func(item *Item) {
+		if !item.Historical {
+			session.Heatmap.Add(item.Tweet.Coordinates)
+		}
+	})
+}
+
+// newSinkStage sends tweets to the session's clients. Tweets are dropped
+// once the session is stopped.
+func newSinkStage(session StageContext) Stage {
+	return FilterStage("sink", func(item *Item) bool {
+		return session.Send(newTweetMessage(item.Tweet))
+	})
+}
+
+func newShownStage(session StageContext) Stage {
+	return MetricStage("shown", func(item *Item) {
+		err := session.Statsd.Incr(item.Metric("tweetsWithLocation"), 1)
+		if err != nil {
+			session.Logger.Warn("Failed to emit metric tweetsWithLocation", "err", err)
+		}
+		if item.Tweet.Location == LocationPlace {
+			err = session.Statsd.Incr(item.Metric("tweetsWithPlaceLocation"), 1)
+			if err != nil {
+				session.Logger.Warn("Failed to emit metric tweetsWithPlaceLocation", "err", err)
+			}
+		}
+		err = session.Statsd.Incr(item.Metric("tweetLength"), int64(utf8.RuneCountInString(item.Raw.Text)))
+		if err != nil {
+			session.Logger.Warn("Failed to emit metric tweetLength", "err", err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package fetcher
+
+import (
+	"sync"
+	"time"
+)
+
+// State is where a session is in its lifecycle.
+type State string
+
+const (
+	// StateIdle sessions haven't been started yet.
+	StateIdle State = "idle"
+	// StateConnecting sessions are opening their source.
+	StateConnecting State = "connecting"
+	// StateStreaming sessions are receiving messages.
+	StateStreaming State = "streaming"
+	// StateBackingOff sessions failed to open their source, or lost their
+	// stream, and wait before connecting again.
+	StateBackingOff State = "backing-off"
+	// StateStopped sessions are done for good.
+	StateStopped State = "stopped"
+)
+
+// transitions lists the states each state can change to.
+var transitions = map[State][]State{
+	StateIdle:       {StateConnecting, StateStopped},
+	StateConnecting: {StateStreaming, StateBackingOff, StateStopped},
+	StateStreaming:  {StateBackingOff, StateStopped},
+	StateBackingOff: {StateConnecting, StateStopped},
+}
+
+// StateChange tells that a session went from one state to another. Err
+// holds the reason sessions back off.
+type StateChange struct {
+	Session string
+	From    State
+	To      State
+	Err     string `json:",omitempty"`
+	At      time.Time
+}
+
+// lifecycle guards the state of a session, allowing only the transitions
+// above. Changes are queued as they happen and notified by flush, which
+// callers run once they don't hold any locks, so that listeners can't
+// hold up the session or deadlock on it.
+type lifecycle struct {
+	session string
+	notify  func(StateChange)
+
+	mutex   sync.Mutex
+	state   State
+	pending []StateChange
+
+	// notifyMutex keeps changes flushed from several goroutines in order.
+	notifyMutex sync.Mutex
+}
+
+func newLifecycle(session string, notify func(StateChange)) *lifecycle {
+	return &lifecycle{
+		session: session,
+		notify:  notify,
+		state:   StateIdle,
+	}
+}
+
+func (l *lifecycle) current() State {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.state
+}
+
+// transition changes the state to to, returning false if the current state
+// can't change to it, e.g. once stopped. The change is notified by the
+// next flush.
+func (l *lifecycle) transition(to State, err error) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	allowed := false
+	for _, state := range transitions[l.state] {
+		if state == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	change := StateChange{
+		Session: l.session,
+		From:    l.state,
+		To:      to,
+		At:      time.Now(),
+	}
+	if err != nil {
+		change.Err = err.Error()
+	}
+	l.state = to
+	l.pending = append(l.pending, change)
+	return true
+}
+
+// flush notifies the changes since the last flush in the order they
+// happened.
+func (l *lifecycle) flush() {
+	l.notifyMutex.Lock()
+	defer l.notifyMutex.Unlock()
+
+	l.mutex.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mutex.Unlock()
+
+	for _, change := range pending {
+		l.notify(change)
+	}
+}
+
+// Message tells the clients of the session about the change, as a status
+// of kind StatusState.
+func (c StateChange) Message() *Message {
+	return newStatusMessage(&Status{Kind: StatusState, State: c.To, Message: c.Err})
+}
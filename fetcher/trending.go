@@ -0,0 +1,341 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultTrendSize     = 10
+	defaultTrendCapacity = 100
+	defaultTrendInterval = 10 * time.Second
+)
+
+var defaultTrendWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// TrendingOptions configure how sessions keep track of trending terms.
+type TrendingOptions struct {
+	// Windows are the periods terms are counted over, 1m, 5m and 1h by
+	// default.
+	Windows []time.Duration
+	// Size is how many top terms of each kind are reported, 10 by default.
+	Size int
+	// Capacity is how many terms of each kind every part of a window counts
+	// at most, 100 by default. Terms seen less often make room for new
+	// ones, so counts of terms outside the top can be too high.
+	Capacity int
+	// Interval is how often sessions send what's trending to clients and
+	// emit it as gauges, 10s by default.
+	Interval time.Duration
+}
+
+func (o TrendingOptions) Validate() error {
+	for _, window := range o.Windows {
+		if err := validateWindow(window); err != nil {
+			return err
+		}
+	}
+	if o.Size < 0 || o.Capacity < 0 || o.Interval < 0 {
+		return errors.New("Trending size, capacity and interval can't be negative")
+	}
+	if o.Size > 0 && o.Capacity > 0 && o.Capacity < o.Size {
+		return errors.New("Trending capacity can't be less than the size")
+	}
+	return nil
+}
+
+func (o TrendingOptions) withDefaults() TrendingOptions {
+	if len(o.Windows) == 0 {
+		o.Windows = defaultTrendWindows
+	}
+	if o.Size == 0 {
+		o.Size = defaultTrendSize
+	}
+	if o.Capacity == 0 {
+		o.Capacity = defaultTrendCapacity
+	}
+	if o.Interval == 0 {
+		o.Interval = defaultTrendInterval
+	}
+	return o
+}
+
+// Trending holds the top terms of a window, most counted first.
+type Trending struct {
+	// Window is the period terms were counted over, e.g. "5m".
+	Window   string
+	Hashtags []Trend
+	Mentions []Trend
+	Words    []Trend
+}
+
+type Trend struct {
+	Term  string
+	Count int64
+}
+
+func (t Trending) empty() bool {
+	return len(t.Hashtags) == 0 && len(t.Mentions) == 0 && len(t.Words) == 0
+}
+
+const (
+	trendHashtags = iota
+	trendMentions
+	trendWords
+	trendKinds
+)
+
+// trendKindNames name the kinds of terms in metrics.
+var trendKindNames = [trendKinds]string{"hashtags", "mentions", "words"}
+
+// Trends counts the hashtags, mentions and significant words of a
+// session's tweets over sliding windows.
+type Trends struct {
+	size    int
+	ignored map[string]bool
+	now     func() time.Time
+
+	mutex   sync.Mutex
+	windows []*trendWindow
+}
+
+// newTrends keeps track of trends in tweets matching query. The words of
+// the query are left out, as every tweet has them.
+func newTrends(options TrendingOptions, query Query) *Trends {
+	options = options.withDefaults()
+
+	t := &Trends{
+		size:    options.Size,
+		ignored: make(map[string]bool),
+		now:     time.Now,
+	}
+	for _, term := range query.Track {
+		for _, word := range significantWords(term, nil) {
+			t.ignored[word] = true
+		}
+	}
+	for _, window := range options.Windows {
+		t.windows = append(t.windows, newTrendWindow(window, options.Capacity))
+	}
+	return t
+}
+
+// Add counts the terms of a tweet.
+func (t *Trends) Add(tweet *Tweet) {
+	terms := [trendKinds][]string{
+		trendHashtags: lowerAll(tweet.Hashtags),
+		trendMentions: lowerAll(tweet.Mentions),
+		trendWords:    significantWords(tweet.Text, t.ignored),
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	for _, window := range t.windows {
+		window.add(now, terms)
+	}
+}
+
+// Top returns the top terms of every window, shortest window first.
+func (t *Trends) Top() []Trending {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	trending := make([]Trending, 0, len(t.windows))
+	for _, window := range t.windows {
+		trending = append(trending, Trending{
+			Window:   windowName(window.length),
+			Hashtags: window.top(now, trendHashtags, t.size),
+			Mentions: window.top(now, trendMentions, t.size),
+			Words:    window.top(now, trendWords, t.size),
+		})
+	}
+	return trending
+}
+
+// trendWindow is a ring of buckets, each counting the terms added during
+// a part of the window.
+type trendWindow struct {
+	ring
+	capacity int
+	buckets  []*trendBucket
+}
+
+type trendBucket [trendKinds]*spaceSaving
+
+func newTrendWindow(length time.Duration, capacity int) *trendWindow {
+	w := &trendWindow{
+		ring:     ring{length: length},
+		capacity: capacity,
+		buckets:  make([]*trendBucket, windowBuckets),
+	}
+	for i := range w.buckets {
+		w.buckets[i] = w.newBucket()
+	}
+	return w
+}
+
+func (w *trendWindow) newBucket() *trendBucket {
+	b := &trendBucket{}
+	for kind := range b {
+		b[kind] = newSpaceSaving(w.capacity)
+	}
+	return b
+}
+
+func (w *trendWindow) add(now time.Time, terms [trendKinds][]string) {
+	w.advance(now, w.clear)
+	for kind, kindTerms := range terms {
+		for _, term := range kindTerms {
+			w.buckets[w.head][kind].add(term)
+		}
+	}
+}
+
+func (w *trendWindow) clear(bucket int) {
+	w.buckets[bucket] = w.newBucket()
+}
+
+func (w *trendWindow) top(now time.Time, kind int, size int) []Trend {
+	w.advance(now, w.clear)
+
+	counts := make(map[string]int64)
+	for _, bucket := range w.buckets {
+		for term, count := range bucket[kind].counts {
+			counts[term] += count
+		}
+	}
+
+	trends := make([]Trend, 0, len(counts))
+	for term, count := range counts {
+		trends = append(trends, Trend{Term: term, Count: count})
+	}
+	sort.Sort(byCount(trends))
+	if len(trends) > size {
+		trends = trends[:size]
+	}
+	return trends
+}
+
+// spaceSaving counts at most capacity terms. A new term takes the place of
+// the least counted one, starting from its count, so that frequent terms
+// are kept even if they first showed up late.
+type spaceSaving struct {
+	capacity int
+	counts   map[string]int64
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counts: make(map[string]int64)}
+}
+
+func (s *spaceSaving) add(term string) {
+	if _, ok := s.counts[term]; ok || len(s.counts) < s.capacity {
+		s.counts[term]++
+		return
+	}
+
+	minTerm, minCount := "", int64(-1)
+	for t, count := range s.counts {
+		if minCount < 0 || count < minCount || (count == minCount && t > minTerm) {
+			minTerm, minCount = t, count
+		}
+	}
+	delete(s.counts, minTerm)
+	s.counts[term] = minCount + 1
+}
+
+type byCount []Trend
+
+func (t byCount) Len() int      { return len(t) }
+func (t byCount) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byCount) Less(i, j int) bool {
+	if t[i].Count != t[j].Count {
+		return t[i].Count > t[j].Count
+	}
+	return t[i].Term < t[j].Term
+}
+
+// stopWords are left out of trending words.
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+		a about after all also am an and any are as at be because been but by can
+		could did do does for from get got had has have he her here him his how i if
+		in into is it its just like me more my no not now of on one or our out over
+		rt she so some than that the their them then there these they this to too up
+		us was we were what when where which who why will with would you your amp
+		via new de la el en es que los las un una le les des et du il je pas por con
+		der die das und ist ich nicht mit`) {
+		stopWords[word] = true
+	}
+}
+
+// significantWords returns the words of text worth counting: not links,
+// hashtags, mentions, numbers, stop words or ignored words, and at least
+// three letters long.
+func significantWords(text string, ignored map[string]bool) []string {
+	words := []string{}
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") ||
+			strings.HasPrefix(field, "#") || strings.HasPrefix(field, "@") {
+			continue
+		}
+
+		for _, word := range strings.FieldsFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+		}) {
+			word = strings.Trim(word, "'")
+			if len([]rune(word)) < 3 || stopWords[word] || ignored[word] || !hasLetter(word) {
+				continue
+			}
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+func hasLetter(word string) bool {
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(terms []string) []string {
+	lowered := make([]string, 0, len(terms))
+	for _, term := range terms {
+		lowered = append(lowered, strings.ToLower(term))
+	}
+	return lowered
+}
+
+// trendMetric names a gauge of the trends of a kind, e.g.
+// trending.5m.hashtags.top. Dots in windows like 1m30.5s would add path
+// levels, so they are replaced.
+func trendMetric(window string, kind int, name string) string {
+	window = strings.Replace(window, ".", "_", -1)
+	return fmt.Sprintf("trending.%s.%s.%s", window, trendKindNames[kind], name)
+}
+
+// terms returns the trends of a kind.
+func (t Trending) terms(kind int) []Trend {
+	switch kind {
+	case trendHashtags:
+		return t.Hashtags
+	case trendMentions:
+		return t.Mentions
+	default:
+		return t.Words
+	}
+}
@@ -0,0 +1,110 @@
+package fetcher_test
+
+import (
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Trends", func() {
+	var (
+		now    time.Time
+		trends *fetcher.Trends
+	)
+
+	clock := func() time.Time {
+		return now
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2016, 9, 6, 9, 20, 0, 0, time.UTC)
+		trends = fetcher.NewTrends(fetcher.TrendingOptions{Windows: []time.Duration{time.Minute, time.Hour}, Size: 2}, fetcher.Query{Track: []string{"golang"}}, clock)
+	})
+
+	It("counts hashtags, mentions and significant words", func() {
+		trends.Add(&fetcher.Tweet{Text: "Golang meetup in Denver tonight! https://t.co/x #gophercon @golang", Hashtags: []string{"GopherCon"}, Mentions: []string{"golang"}})
+		trends.Add(&fetcher.Tweet{Text: "The meetup was great, see you at the next 2016 meetup #gophercon", Hashtags: []string{"gophercon"}})
+		trends.Add(&fetcher.Tweet{Text: "Denver is lovely", Hashtags: []string{"denver"}})
+
+		top := trends.Top()
+		Expect(top).To(HaveLen(2))
+		Expect(top[0].Window).To(Equal("1m"))
+		Expect(top[1].Window).To(Equal("1h"))
+
+		Expect(top[0].Hashtags).To(Equal([]fetcher.Trend{{Term: "gophercon", Count: 2}, {Term: "denver", Count: 1}}))
+		Expect(top[0].Mentions).To(Equal([]fetcher.Trend{{Term: "golang", Count: 1}}))
+		// The query's own words and stop words don't trend.
+		Expect(top[0].Words).To(Equal([]fetcher.Trend{{Term: "meetup", Count: 3}, {Term: "denver", Count: 2}}))
+	})
+
+	It("forgets terms once they leave a window", func() {
+		trends.Add(&fetcher.Tweet{Text: "", Hashtags: []string{"early"}})
+		now = now.Add(30 * time.Second)
+		trends.Add(&fetcher.Tweet{Text: "", Hashtags: []string{"late"}})
+
+		now = now.Add(40 * time.Second)
+		top := trends.Top()
+		Expect(top[0].Hashtags).To(Equal([]fetcher.Trend{{Term: "late", Count: 1}}))
+		Expect(top[1].Hashtags).To(Equal([]fetcher.Trend{{Term: "early", Count: 1}, {Term: "late", Count: 1}}))
+
+		now = now.Add(2 * time.Hour)
+		top = trends.Top()
+		Expect(top[0].Hashtags).To(BeEmpty())
+		Expect(top[1].Hashtags).To(BeEmpty())
+	})
+
+	It("keeps frequent terms when counting more terms than it has room for", func() {
+		trends = fetcher.NewTrends(fetcher.TrendingOptions{Windows: []time.Duration{time.Minute}, Size: 1, Capacity: 5}, fetcher.Query{}, clock)
+
+		for i := 0; i < 100; i++ {
+			trends.Add(&fetcher.Tweet{Hashtags: []string{"golang"}})
+			trends.Add(&fetcher.Tweet{Hashtags: []string{string(rune('a'+i%26)) + "tag"}})
+		}
+
+		top := trends.Top()
+		Expect(top[0].Hashtags).To(HaveLen(1))
+		Expect(top[0].Hashtags[0].Term).To(Equal("golang"))
+		Expect(top[0].Hashtags[0].Count).To(BeNumerically(">=", 100))
+	})
+
+	It("rejects invalid options", func() {
+		Expect(fetcher.TrendingOptions{}.Validate()).To(Succeed())
+		Expect(fetcher.TrendingOptions{Windows: []time.Duration{time.Second}}.Validate()).NotTo(Succeed())
+		Expect(fetcher.TrendingOptions{Size: -1}.Validate()).NotTo(Succeed())
+		Expect(fetcher.TrendingOptions{Size: 10, Capacity: 5}.Validate()).NotTo(Succeed())
+	})
+
+	It("is reported by sessions", func() {
+		logger := log.New()
+		logger.SetHandler(log.DiscardHandler())
+		statsdClient := newFakeStatsd()
+		source := newChannelSource()
+
+		tweetFetcher := fetcher.New(logger, source, statsdClient, &fakeGeocoder{country: "Germany"}, fetcher.Config{
+			Trending: fetcher.TrendingOptions{Interval: 10 * time.Millisecond},
+		})
+		defer tweetFetcher.StopAll()
+		session, _ := tweetFetcher.Fetch("default", fetcher.Query{Track: []string{"golang"}})
+
+		// Tweets without location trend as well, they just aren't shown.
+		go source.Send(&twitter.Tweet{IDStr: "10", Text: "Off to #GopherCon", Entities: &twitter.Entities{Hashtags: []twitter.HashtagEntity{{Text: "GopherCon"}}}})
+
+		var message *fetcher.Message
+		Eventually(session.Messages()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageTrending))
+		Expect(message.Trending).To(HaveLen(3))
+		Expect(message.Trending[1].Window).To(Equal("5m"))
+		Expect(message.Trending[1].Hashtags).To(Equal([]fetcher.Trend{{Term: "gophercon", Count: 1}}))
+
+		Expect(session.Trending()[2].Words).To(Equal([]fetcher.Trend{{Term: "off", Count: 1}}))
+		Eventually(func() []int64 { return statsdClient.gauge("trending.1h.hashtags.top") }).Should(ContainElement(int64(1)))
+		Eventually(func() []int64 { return statsdClient.gauge("trending.1h.hashtags.total") }).Should(ContainElement(int64(1)))
+		Eventually(func() []int64 { return statsdClient.gauge("trending.1h.mentions.top") }).Should(ContainElement(int64(0)))
+	})
+})
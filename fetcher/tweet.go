@@ -1,12 +1,76 @@
 package fetcher
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	// LocationExact marks tweets geotagged with the exact point they were sent from.
+	LocationExact = "exact"
+	// LocationPlace marks tweets whose point was derived from the tagged place.
+	LocationPlace = "place"
+)
+
+// TweetVersion is bumped whenever fields of Tweet change their meaning or
+// are removed, so that consumers can tell which fields to expect. Version 1
+// tweets only had Id, Text, User, UserId and their location.
+const TweetVersion = 2
 
 type Tweet struct {
-	Id          string
-	Text        string
-	User        string
+	// Version is the TweetVersion the tweet was built with.
+	Version   int
+	Id        string
+	Text      string
+	CreatedAt time.Time
+	// Language is the BCP 47 code Twitter detected, "und" if it couldn't.
+	Language string
+
+	// User is the screen name of the author.
+	User            string
+	UserId          string
+	UserName        string
+	ProfileImageURL string
+	Followers       int
+	Verified        bool
+
 	Coordinates Coordinates
+	// Location is either LocationExact or LocationPlace.
+	Location string
+	// Accuracy is the radius in meters around Coordinates the tweet was sent from.
+	Accuracy float64
+	// Place is the place the tweet is tagged with, if any.
+	Place *Place
+
+	Hashtags []string
+	// Mentions holds the screen names of mentioned users.
+	Mentions []string
+	// URLs holds the expanded links.
+	URLs  []string
+	Media []Media
+
+	Retweet bool
+	Quote   bool
+	Reply   bool
+	// Historical marks tweets sent before the session started, found to
+	// backfill it.
+	Historical bool
+}
+
+type Place struct {
+	Name        string
+	FullName    string
+	Country     string
+	CountryCode string
+}
+
+type Media struct {
+	// Type is one of "photo", "video" or "animated_gif".
+	Type         string
+	URL          string
+	ThumbnailURL string
 }
 
 type Coordinates struct {
@@ -15,5 +79,75 @@ type Coordinates struct {
 }
 
 func (c Coordinates) String() string {
-	return fmt.Sprintf("[%d,%d]", c.Long, c.Lat)
+	return fmt.Sprintf("[%f,%f]", c.Long, c.Lat)
+}
+
+// newTweet copies what clients show of a tweet. The location is left for
+// the caller to fill in.
+func newTweet(tweet *twitter.Tweet) *Tweet {
+	t := &Tweet{
+		Version:  TweetVersion,
+		Id:       tweet.IDStr,
+		Text:     tweet.Text,
+		Language: tweet.Lang,
+		Hashtags: []string{},
+		Mentions: []string{},
+		URLs:     []string{},
+		Media:    []Media{},
+		Retweet:  tweet.RetweetedStatus != nil,
+		Quote:    tweet.QuotedStatus != nil || tweet.QuotedStatusIDStr != "",
+		Reply:    tweet.InReplyToStatusIDStr != "",
+	}
+
+	if createdAt, err := time.Parse(time.RubyDate, tweet.CreatedAt); err == nil {
+		t.CreatedAt = createdAt.UTC()
+	}
+
+	if user := tweet.User; user != nil {
+		t.User = user.ScreenName
+		t.UserId = user.IDStr
+		t.UserName = user.Name
+		t.ProfileImageURL = user.ProfileImageURLHttps
+		t.Followers = user.FollowersCount
+		t.Verified = user.Verified
+	}
+
+	if place := tweet.Place; place != nil {
+		t.Place = &Place{
+			Name:        place.Name,
+			FullName:    place.FullName,
+			Country:     place.Country,
+			CountryCode: place.CountryCode,
+		}
+	}
+
+	if entities := tweet.Entities; entities != nil {
+		for _, hashtag := range entities.Hashtags {
+			t.Hashtags = append(t.Hashtags, hashtag.Text)
+		}
+		for _, mention := range entities.UserMentions {
+			t.Mentions = append(t.Mentions, mention.ScreenName)
+		}
+		for _, url := range entities.Urls {
+			t.URLs = append(t.URLs, url.ExpandedURL)
+		}
+	}
+
+	// Extended entities hold all the photos of a tweet, entities only the
+	// first one.
+	var media []twitter.MediaEntity
+	if tweet.ExtendedEntities != nil {
+		media = tweet.ExtendedEntities.Media
+	} else if tweet.Entities != nil {
+		media = tweet.Entities.Media
+	}
+	for _, m := range media {
+		t.Media = append(t.Media, Media{
+			Type:         m.Type,
+			URL:          m.MediaURLHttps,
+			ThumbnailURL: m.MediaURLHttps + ":thumb",
+		})
+	}
+
+	return t
 }
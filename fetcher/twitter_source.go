@@ -0,0 +1,259 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/dghubble/sling"
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	searchURL = "https://api.twitter.com/1.1/search/tweets.json"
+	filterURL = "https://stream.twitter.com/1.1/statuses/filter.json"
+	sampleURL = "https://stream.twitter.com/1.1/statuses/sample.json"
+
+	// streamConnectTimeout is how long Open waits for Twitter to answer the
+	// stream request.
+	streamConnectTimeout = 30 * time.Second
+)
+
+type twitterSource struct {
+	logger     log.Logger
+	client     *twitter.Client
+	httpClient *http.Client
+	upstream   *upstream
+}
+
+// NewTwitterSource streams live tweets from Twitter. httpClient has to sign
+// requests with the app's OAuth credentials. All streams opened from the
+// source share a single stream of Twitter, see upstream.
+func NewTwitterSource(logger log.Logger, httpClient *http.Client) Source {
+	s := &twitterSource{
+		logger:     logger.New("source", "twitter"),
+		client:     twitter.NewClient(httpClient),
+		httpClient: httpClient,
+	}
+	s.upstream = newUpstream(s.logger, s.connect)
+	return s
+}
+
+// Open subscribes the query to the shared stream, opening it again if the
+// query needs more than it delivers.
+func (s *twitterSource) Open(query Query) (Stream, error) {
+	var follow []int64
+	if !query.IsSample() {
+		var err error
+		follow, err = s.lookupFollow(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.upstream.subscribe(query, newStreamFilter(query, follow))
+}
+
+// connect makes the stream request itself rather than through go-twitter,
+// whose streams retry on their own and can't be stopped while connecting.
+// It waits for Twitter to answer, so that failures are reported as a
+// FetchError. Filter parameters are sent form-encoded in the body, as
+// Twitter expects for POST requests.
+func (s *twitterSource) connect(filter streamFilter) (*twitterStream, error) {
+	var req *http.Request
+	var err error
+	if filter.sample {
+		req, err = sling.New().Get(sampleURL).QueryStruct(sampleParams()).Request()
+	} else {
+		req, err = sling.New().Post(filterURL).BodyForm(filter.params()).Request()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	timeout := time.AfterFunc(streamConnectTimeout, cancel)
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if !timeout.Stop() {
+		// The request was cancelled, even if it got an answer just then.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, &FetchError{Kind: ErrorUnavailable, Message: "Twitter didn't answer in time"}
+	}
+	if err != nil {
+		cancel()
+		return nil, &FetchError{Kind: ErrorUnavailable, Message: fmt.Sprintf("Failed to connect to Twitter: %s", err)}
+	}
+	if fetchErr := responseError(resp); fetchErr != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, fetchErr
+	}
+	return newTwitterStream(resp.Body, cancel), nil
+}
+
+// lookupFollow resolves the screen names the query follows to user IDs.
+func (s *twitterSource) lookupFollow(query Query) ([]int64, error) {
+	if len(query.Follow) == 0 {
+		return nil, nil
+	}
+
+	names := query.screenNames()
+	users, resp, err := s.client.Users.Lookup(&twitter.UserLookupParams{ScreenName: names})
+	if resp != nil && resp.StatusCode == http.StatusNotFound || err == nil && len(users) == 0 {
+		return nil, &FetchError{Kind: ErrorInvalidQuery, Message: fmt.Sprintf("None of the users to follow exist: %s", strings.Join(names, ", "))}
+	}
+	if err != nil {
+		if resp != nil {
+			if fetchErr := responseError(resp); fetchErr != nil {
+				return nil, fetchErr
+			}
+		}
+		return nil, fmt.Errorf("Failed to look up users to follow: %s", err)
+	}
+	if len(users) < len(names) {
+		s.logger.Warn("Some users to follow don't exist", "requested", len(names), "found", len(users))
+	}
+
+	ids := make([]int64, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids, nil
+}
+
+// Search looks up recent tweets with the search API, which go-twitter
+// doesn't cover. Search can't match locations alone, so queries without
+// track terms or accounts to follow find nothing.
+func (s *twitterSource) Search(query Query, limit int) ([]*twitter.Tweet, error) {
+	if len(query.Track) == 0 && len(query.Follow) == 0 {
+		return nil, nil
+	}
+
+	found := make(map[int64]*twitter.Tweet)
+	for _, params := range query.searchQueries(limit) {
+		tweets, err := s.search(params.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tweet := range tweets {
+			if _, _, _, ok := tweetLocation(tweet); ok && query.matches(tweet) && query.matchesLanguage(tweet) {
+				found[tweet.ID] = tweet
+			}
+		}
+	}
+
+	tweets := make([]*twitter.Tweet, 0, len(found))
+	for _, tweet := range found {
+		tweets = append(tweets, tweet)
+	}
+	sort.Sort(tweetsByID(tweets))
+	if len(tweets) > limit {
+		tweets = tweets[len(tweets)-limit:]
+	}
+	return tweets, nil
+}
+
+func (s *twitterSource) search(params string) ([]*twitter.Tweet, error) {
+	resp, err := s.httpClient.Get(searchURL + "?" + params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Search failed with status %s", resp.Status)
+	}
+
+	var result struct {
+		Statuses []*twitter.Tweet `json:"statuses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Failed to decode search results: %s", err)
+	}
+	return result.Statuses, nil
+}
+
+// tweetsByID sorts tweets oldest first, as IDs grow with time.
+type tweetsByID []*twitter.Tweet
+
+func (t tweetsByID) Len() int           { return len(t) }
+func (t tweetsByID) Less(i, j int) bool { return t[i].ID < t[j].ID }
+func (t tweetsByID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// twitterStream reads the messages of a stream response, one per line, for
+// the upstream to route. Tweets Twitter delivers for only some parts of a
+// query are dropped by the match stage of its session, like those of any
+// other source. The stream ends once the response does.
+type twitterStream struct {
+	body     io.ReadCloser
+	cancel   context.CancelFunc
+	messages chan interface{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTwitterStream(body io.ReadCloser, cancel context.CancelFunc) *twitterStream {
+	s := &twitterStream{
+		body:     body,
+		cancel:   cancel,
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.receive()
+	return s
+}
+
+func (s *twitterStream) Messages() <-chan interface{} {
+	return s.messages
+}
+
+// Stop cancels the request and closes the response, as reading otherwise
+// blocks until Twitter sends the next message or keep-alive.
+func (s *twitterStream) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.cancel()
+		s.body.Close()
+	})
+}
+
+// receive ends once the response ends or the stream is stopped and closes
+// its messages. Sessions keep reading until then.
+func (s *twitterStream) receive() {
+	defer close(s.messages)
+	defer s.body.Close()
+
+	scanner := bufio.NewScanner(s.body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Twitter sends blank lines to keep the connection alive.
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		select {
+		case s.messages <- decodeRaw(line):
+		case <-s.done:
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		select {
+		case s.messages <- err:
+		case <-s.done:
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package fetcher
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dghubble/go-twitter/twitter"
+	log "github.com/inconshreveable/log15"
+)
+
+// streamFilter is what a stream of Twitter is opened with: either the
+// sample stream, or a filter stream of track terms, locations and the IDs
+// of accounts to follow. Blank languages mean any language.
+type streamFilter struct {
+	sample    bool
+	track     []string
+	locations []BoundingBox
+	follow    []int64
+	language  []string
+}
+
+// newStreamFilter builds the filter of a query whose accounts to follow
+// were resolved to follow.
+func newStreamFilter(query Query, follow []int64) streamFilter {
+	if query.IsSample() {
+		return streamFilter{sample: true}
+	}
+	return unionFilters([]streamFilter{{
+		track:     query.Track,
+		locations: query.Locations,
+		follow:    follow,
+		language:  query.Language,
+	}})
+}
+
+// unionFilters builds a filter matching whatever any of filters matches.
+// Filters have to be of the same kind.
+func unionFilters(filters []streamFilter) streamFilter {
+	track := map[string]bool{}
+	locations := map[BoundingBox]bool{}
+	follow := map[int64]bool{}
+	language := map[string]bool{}
+	anyLanguage := false
+	for _, filter := range filters {
+		for _, term := range filter.track {
+			track[strings.ToLower(strings.TrimSpace(term))] = true
+		}
+		for _, box := range filter.locations {
+			locations[box] = true
+		}
+		for _, id := range filter.follow {
+			follow[id] = true
+		}
+		for _, code := range filter.language {
+			language[strings.ToLower(strings.TrimSpace(code))] = true
+		}
+		anyLanguage = anyLanguage || len(filter.language) == 0
+	}
+
+	union := streamFilter{sample: len(filters) > 0 && filters[0].sample}
+	for term := range track {
+		union.track = append(union.track, term)
+	}
+	sort.Strings(union.track)
+	for box := range locations {
+		union.locations = append(union.locations, box)
+	}
+	sort.Sort(boxesByString(union.locations))
+	for id := range follow {
+		union.follow = append(union.follow, id)
+	}
+	sort.Sort(userIDs(union.follow))
+	if !anyLanguage {
+		for code := range language {
+			union.language = append(union.language, code)
+		}
+		sort.Strings(union.language)
+	}
+	return union
+}
+
+type boxesByString []BoundingBox
+
+func (b boxesByString) Len() int           { return len(b) }
+func (b boxesByString) Less(i, j int) bool { return b[i].String() < b[j].String() }
+func (b boxesByString) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type userIDs []int64
+
+func (u userIDs) Len() int           { return len(u) }
+func (u userIDs) Less(i, j int) bool { return u[i] < u[j] }
+func (u userIDs) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// covers reports whether a stream opened with f delivers every tweet one
+// opened with other does.
+func (f streamFilter) covers(other streamFilter) bool {
+	if f.sample || other.sample {
+		return f.sample == other.sample
+	}
+	if len(other.language) == 0 && len(f.language) > 0 {
+		return false
+	}
+
+	union := unionFilters([]streamFilter{f, other})
+	return len(union.track) == len(f.track) &&
+		len(union.locations) == len(f.locations) &&
+		len(union.follow) == len(f.follow) &&
+		len(union.language) == len(f.language)
+}
+
+func (f streamFilter) params() *twitter.StreamFilterParams {
+	return Query{Track: f.track, Locations: f.locations, Language: f.language}.filterParams(f.follow)
+}
+
+// upstream shares a single stream of Twitter among all sessions of a
+// source, as Twitter allows one stream per account and disconnects the
+// current one once another is opened. The stream is opened with the union
+// of the filters subscribed, and opened again whenever a subscription
+// needs more than it delivers. It isn't narrowed as subscriptions go, only
+// closed once the last one does. Tweets are routed to the subscriptions
+// whose query Twitter would have delivered them for, stream notices go to
+// all of them.
+//
+// Twitter can't stream a sample along with filtered tweets, so sample
+// subscriptions fail while there are filter ones, and the other way round.
+type upstream struct {
+	logger log.Logger
+	open   func(filter streamFilter) (*twitterStream, error)
+
+	// connectMutex makes subscriptions that need another stream wait for
+	// each other, so that a single one is opened at a time.
+	connectMutex sync.Mutex
+
+	mutex         sync.Mutex
+	subscriptions map[*subscription]struct{}
+	connection    *upstreamConnection
+	// resume is the filter of a stream that ended by itself, so that its
+	// subscriptions share a single new stream as they come back.
+	resume *streamFilter
+}
+
+type upstreamConnection struct {
+	filter streamFilter
+	stream *twitterStream
+}
+
+func newUpstream(logger log.Logger, open func(filter streamFilter) (*twitterStream, error)) *upstream {
+	return &upstream{
+		logger:        logger,
+		open:          open,
+		subscriptions: make(map[*subscription]struct{}),
+	}
+}
+
+// subscribe streams the tweets of query, whose filter is filter. The
+// current stream is replaced if it doesn't cover filter, and the
+// subscriptions of the current stream carry on with the new one. If that
+// can't be opened they end too, and connect again on their own.
+func (u *upstream) subscribe(query Query, filter streamFilter) (*subscription, error) {
+	s := newSubscription(u, query, filter)
+
+	u.connectMutex.Lock()
+	defer u.connectMutex.Unlock()
+
+	u.mutex.Lock()
+	if u.connection != nil && u.connection.filter.covers(filter) {
+		u.subscriptions[s] = struct{}{}
+		u.mutex.Unlock()
+		return s, nil
+	}
+	filters := []streamFilter{filter}
+	for other := range u.subscriptions {
+		if other.filter.sample != filter.sample {
+			u.mutex.Unlock()
+			return nil, &FetchError{Kind: ErrorUnavailable, Message: "Twitter can't stream a sample along with filtered tweets of other sessions"}
+		}
+		filters = append(filters, other.filter)
+	}
+	if u.resume != nil && u.resume.sample == filter.sample {
+		filters = append(filters, *u.resume)
+	}
+	replaced := u.connection
+	u.connection = nil
+	u.mutex.Unlock()
+
+	// Twitter disconnects the current stream anyway once another one is
+	// opened.
+	if replaced != nil {
+		replaced.stream.Stop()
+	}
+	union := unionFilters(filters)
+	u.logger.Info("Connecting to Twitter", "sample", union.sample, "track", len(union.track), "locations", len(union.locations), "follow", len(union.follow), "subscriptions", len(filters))
+	stream, err := u.open(union)
+
+	u.mutex.Lock()
+	if err != nil {
+		ended := u.takeSubscriptions()
+		if replaced != nil {
+			u.resume = &replaced.filter
+		}
+		u.mutex.Unlock()
+
+		for _, other := range ended {
+			other.end()
+		}
+		return nil, err
+	}
+	connection := &upstreamConnection{filter: union, stream: stream}
+	u.connection = connection
+	u.resume = nil
+	u.subscriptions[s] = struct{}{}
+	u.mutex.Unlock()
+
+	go u.route(connection)
+	return s, nil
+}
+
+// unsubscribe closes the stream once its last subscription is stopped.
+func (u *upstream) unsubscribe(s *subscription) {
+	u.mutex.Lock()
+	delete(u.subscriptions, s)
+	var closed *upstreamConnection
+	if len(u.subscriptions) == 0 && u.connection != nil {
+		closed = u.connection
+		u.connection = nil
+	}
+	u.mutex.Unlock()
+
+	if closed != nil {
+		closed.stream.Stop()
+	}
+}
+
+// route passes the messages of a stream on to its subscriptions until it
+// ends. The subscriptions end along with the stream unless it was replaced
+// or closed.
+func (u *upstream) route(connection *upstreamConnection) {
+	for message := range connection.stream.Messages() {
+		for _, s := range u.recipients(connection, message) {
+			s.send(message, connection.stream.done)
+		}
+	}
+
+	u.mutex.Lock()
+	if u.connection != connection {
+		u.mutex.Unlock()
+		return
+	}
+	u.connection = nil
+	u.resume = &connection.filter
+	ended := u.takeSubscriptions()
+	u.mutex.Unlock()
+
+	u.logger.Warn("Stream of Twitter ended", "subscriptions", len(ended))
+	for _, s := range ended {
+		s.end()
+	}
+}
+
+// recipients returns the subscriptions a message of connection goes to,
+// none once it was replaced.
+func (u *upstream) recipients(connection *upstreamConnection, message interface{}) []*subscription {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.connection != connection {
+		return nil
+	}
+
+	var tweet *twitter.Tweet
+	if raw, ok := message.(*rawMessage); ok {
+		tweet, _ = raw.message.(*twitter.Tweet)
+	}
+	recipients := make([]*subscription, 0, len(u.subscriptions))
+	for s := range u.subscriptions {
+		if tweet == nil || s.query.delivers(tweet) {
+			recipients = append(recipients, s)
+		}
+	}
+	return recipients
+}
+
+// takeSubscriptions removes every subscription. It has to be called with
+// the mutex held.
+func (u *upstream) takeSubscriptions() []*subscription {
+	taken := make([]*subscription, 0, len(u.subscriptions))
+	for s := range u.subscriptions {
+		taken = append(taken, s)
+		delete(u.subscriptions, s)
+	}
+	return taken
+}
+
+// subscription is the Stream of a single query on the shared stream. Its
+// messages are closed once it is stopped or the shared stream ends.
+type subscription struct {
+	upstream *upstream
+	query    Query
+	filter   streamFilter
+	messages chan interface{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// mutex guards sending messages against closing them.
+	mutex sync.Mutex
+	ended bool
+}
+
+func newSubscription(u *upstream, query Query, filter streamFilter) *subscription {
+	return &subscription{
+		upstream: u,
+		query:    query,
+		filter:   filter,
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *subscription) Messages() <-chan interface{} {
+	return s.messages
+}
+
+func (s *subscription) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.upstream.unsubscribe(s)
+		s.end()
+	})
+}
+
+// send blocks until the session takes message, the subscription is
+// stopped or abort is closed.
+func (s *subscription) send(message interface{}, abort <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ended {
+		return
+	}
+	select {
+	case s.messages <- message:
+	case <-s.done:
+	case <-abort:
+	}
+}
+
+func (s *subscription) end() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.ended {
+		s.ended = true
+		close(s.messages)
+	}
+}
@@ -0,0 +1,99 @@
+package fetcher
+
+import (
+	"fmt"
+	"time"
+)
+
+// windowBuckets is how many parts sliding windows are split into. Counts
+// leave a window one bucket at a time.
+const windowBuckets = 60
+
+// ring tells which bucket of a sliding window counts what happens now.
+type ring struct {
+	length time.Duration
+	// head is the current bucket, which started at headStart.
+	head      int
+	headStart time.Time
+}
+
+func (r *ring) bucketLength() time.Duration {
+	return r.length / windowBuckets
+}
+
+// advance moves the head to the bucket now falls in, calling clear with
+// every bucket that left the window.
+func (r *ring) advance(now time.Time, clear func(bucket int)) {
+	if r.headStart.IsZero() || now.Sub(r.headStart) >= r.length {
+		for i := 0; i < windowBuckets; i++ {
+			clear(i)
+		}
+		r.headStart = now.Truncate(r.bucketLength())
+		return
+	}
+	for now.Sub(r.headStart) >= r.bucketLength() {
+		r.head = (r.head + 1) % windowBuckets
+		clear(r.head)
+		r.headStart = r.headStart.Add(r.bucketLength())
+	}
+}
+
+// countWindow is a ring of buckets, each counting the keys added during a
+// part of the window.
+type countWindow struct {
+	ring
+	buckets []map[string]int64
+}
+
+func newCountWindow(length time.Duration) *countWindow {
+	w := &countWindow{
+		ring:    ring{length: length},
+		buckets: make([]map[string]int64, windowBuckets),
+	}
+	for i := range w.buckets {
+		w.clear(i)
+	}
+	return w
+}
+
+func (w *countWindow) clear(bucket int) {
+	w.buckets[bucket] = make(map[string]int64)
+}
+
+func (w *countWindow) add(now time.Time, key string) {
+	w.advance(now, w.clear)
+	w.buckets[w.head][key]++
+}
+
+// counts sums up the buckets by key.
+func (w *countWindow) counts(now time.Time) map[string]int64 {
+	w.advance(now, w.clear)
+
+	counts := make(map[string]int64)
+	for _, bucket := range w.buckets {
+		for key, count := range bucket {
+			counts[key] += count
+		}
+	}
+	return counts
+}
+
+func validateWindow(window time.Duration) error {
+	if window < windowBuckets*time.Second {
+		return fmt.Errorf("Windows have to be at least %s", windowBuckets*time.Second)
+	}
+	return nil
+}
+
+// windowName formats windows the way they are usually given, e.g. 5m
+// rather than 5m0s.
+func windowName(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return window.String()
+	}
+}
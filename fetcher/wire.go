@@ -0,0 +1,141 @@
+package fetcher
+
+import (
+	"encoding/json"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Envelopes of the stream notices, as they are sent by Twitter.
+type statusDeletionNotice struct {
+	Delete struct {
+		StatusDeletion *twitter.StatusDeletion `json:"status"`
+	} `json:"delete"`
+}
+
+type locationDeletionNotice struct {
+	ScrubGeo *twitter.LocationDeletion `json:"scrub_geo"`
+}
+
+type streamLimitNotice struct {
+	Limit *twitter.StreamLimit `json:"limit"`
+}
+
+type statusWithheldNotice struct {
+	StatusWithheld *twitter.StatusWithheld `json:"status_withheld"`
+}
+
+type userWithheldNotice struct {
+	UserWithheld *twitter.UserWithheld `json:"user_withheld"`
+}
+
+type streamDisconnectNotice struct {
+	StreamDisconnect *twitter.StreamDisconnect `json:"disconnect"`
+}
+
+type stallWarningNotice struct {
+	StallWarning *twitter.StallWarning `json:"warning"`
+}
+
+// rawMessage is a message along with the line Twitter sent for it, so that
+// recordings hold exactly what was received, fields go-twitter doesn't
+// decode included.
+type rawMessage struct {
+	message interface{}
+	line    []byte
+}
+
+// decodeRaw decodes a line into a rawMessage, or into the error decoding it.
+// The line is copied, as scanners reuse theirs.
+func decodeRaw(line []byte) interface{} {
+	message := decodeMessage(line)
+	if _, ok := message.(error); ok {
+		return message
+	}
+	return &rawMessage{message: message, line: append([]byte{}, line...)}
+}
+
+// decodeMessage turns a single line of a Twitter stream into the same value
+// go-twitter streams deliver for it.
+func decodeMessage(line []byte) interface{} {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(line, &data); err != nil {
+		return err
+	}
+
+	var (
+		message interface{}
+		err     error
+	)
+	switch {
+	case has(data, "retweet_count"):
+		tweet := new(twitter.Tweet)
+		err = json.Unmarshal(line, tweet)
+		message = tweet
+	case has(data, "delete"):
+		notice := new(statusDeletionNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.Delete.StatusDeletion
+	case has(data, "scrub_geo"):
+		notice := new(locationDeletionNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.ScrubGeo
+	case has(data, "limit"):
+		notice := new(streamLimitNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.Limit
+	case has(data, "status_withheld"):
+		notice := new(statusWithheldNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.StatusWithheld
+	case has(data, "user_withheld"):
+		notice := new(userWithheldNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.UserWithheld
+	case has(data, "disconnect"):
+		notice := new(streamDisconnectNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.StreamDisconnect
+	case has(data, "warning"):
+		notice := new(stallWarningNotice)
+		err = json.Unmarshal(line, notice)
+		message = notice.StallWarning
+	default:
+		return data
+	}
+
+	if err != nil {
+		return err
+	}
+	return message
+}
+
+// encodeMessage is the reverse of decodeMessage. It returns the line
+// Twitter sent for a message a stream delivered.
+func encodeMessage(message interface{}) ([]byte, error) {
+	switch v := message.(type) {
+	case *twitter.StatusDeletion:
+		notice := new(statusDeletionNotice)
+		notice.Delete.StatusDeletion = v
+		return json.Marshal(notice)
+	case *twitter.LocationDeletion:
+		return json.Marshal(&locationDeletionNotice{ScrubGeo: v})
+	case *twitter.StreamLimit:
+		return json.Marshal(&streamLimitNotice{Limit: v})
+	case *twitter.StatusWithheld:
+		return json.Marshal(&statusWithheldNotice{StatusWithheld: v})
+	case *twitter.UserWithheld:
+		return json.Marshal(&userWithheldNotice{UserWithheld: v})
+	case *twitter.StreamDisconnect:
+		return json.Marshal(&streamDisconnectNotice{StreamDisconnect: v})
+	case *twitter.StallWarning:
+		return json.Marshal(&stallWarningNotice{StallWarning: v})
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func has(data map[string]json.RawMessage, key string) bool {
+	_, ok := data[key]
+	return ok
+}
@@ -0,0 +1,18 @@
+package geocoder
+
+import "errors"
+
+var ErrNoGeocoder = errors.New("No maps API key is configured")
+
+// NewNone returns a geocoder for running without a maps API key. It fails
+// to geocode anything, so only tweets tagged with a place are counted by
+// country.
+func NewNone() Geocoder {
+	return &noGeocoder{}
+}
+
+type noGeocoder struct{}
+
+func (g *noGeocoder) Country(lat, lng float64) (string, error) {
+	return "", ErrNoGeocoder
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
-	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	log "github.com/inconshreveable/log15"
 	"github.com/quipo/statsd"
@@ -16,17 +21,51 @@ import (
 
 	"github.com/Altoros/tweets-fetcher/fetcher"
 	"github.com/Altoros/tweets-fetcher/geocoder"
+	"github.com/Altoros/tweets-fetcher/scheduler"
+	"github.com/Altoros/tweets-fetcher/series"
 	"github.com/Altoros/tweets-fetcher/server"
+	"github.com/Altoros/tweets-fetcher/store"
 )
 
 var (
-	defaultPort          = "8080"
-	defaultLogLevel      = log.LvlInfo
-	requiredEnvVariables = []string{
-		"TWITTER_CONSUMER_KEY",
-		"TWITTER_CONSUMER_SECRET",
-		"TWITTER_CONSUMER_ACCESS_TOKEN",
-		"TWITTER_CONSUMER_ACCESS_SECRET",
+	defaultPort                = "8080"
+	defaultLogLevel            = log.LvlInfo
+	defaultSource              = "twitter"
+	defaultFileSourceInterval  = time.Second
+	defaultGeneratorRate       = 5.0
+	defaultGeneratorBurstRate  = 50.0
+	defaultGeneratorBurstEvery = time.Minute
+	defaultGeneratorBurstLen   = 10 * time.Second
+	defaultRecordingsDir       = "recordings"
+	defaultSessionStorePath    = "sessions.json"
+	defaultSessionStoreService = "tweets-fetcher-state"
+	defaultGeocodeWhenFull     = fetcher.WhenFullSkip
+	defaultSessionBuffer       = fetcher.Backpressure{Size: 100, Policy: fetcher.BackpressureBlock}
+	defaultClientBuffer        = fetcher.Backpressure{Size: 256, Policy: fetcher.BackpressureDropOldest}
+	requiredEnvVariables       = map[string][]string{
+		"twitter": {
+			"TWITTER_CONSUMER_KEY",
+			"TWITTER_CONSUMER_SECRET",
+			"TWITTER_CONSUMER_ACCESS_TOKEN",
+			"TWITTER_CONSUMER_ACCESS_SECRET",
+		},
+		"file": {
+			"TWEETS_FILE",
+		},
+		"generator": {},
+	}
+	// sourcesWithPlaces make up tweets tagged with places, so they don't need
+	// a maps API key to count tweets by country.
+	sourcesWithPlaces = map[string]bool{
+		"generator": true,
+	}
+	// defaultSeriesMetrics are the metrics the app keeps series of: tweets
+	// per second, how many of them are located, geocoder latency and
+	// connected clients.
+	defaultSeriesMetrics = []string{"totalTweets", "tweetsWithLocation", "googleApiRequestTime", "clients.connected"}
+	// seriesRatios are served along with the metrics.
+	seriesRatios = map[string]series.Ratio{
+		"geolocatedRatio": {Numerator: "tweetsWithLocation", Denominator: "totalTweets"},
 	}
 
 	statsdServiceName = os.Getenv("CF_MONITORING_SERVICE_NAME")
@@ -42,7 +81,19 @@ func main() {
 
 	var err error
 
-	err = checkReqiredEnvVariables()
+	noRestore, args, err := parseFlags(os.Args[1:])
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(2)
+	}
+
+	replay, err := parseCommand(args)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(2)
+	}
+
+	err = checkReqiredEnvVariables(replay != nil)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -55,19 +106,88 @@ func main() {
 		os.Exit(1)
 	}
 
-	twitterClient := twitterClient(
-		os.Getenv("TWITTER_CONSUMER_KEY"),
-		os.Getenv("TWITTER_CONSUMER_SECRET"),
-		os.Getenv("TWITTER_CONSUMER_ACCESS_TOKEN"),
-		os.Getenv("TWITTER_CONSUMER_ACCESS_SECRET"),
-	)
+	recordingsDir := getRecordingsDir()
+	if replay != nil {
+		recordingsDir = replay.dir
+	}
 
-	fetcher := fetcher.New(logger, twitterClient, statsdClient, geoCoder(logger))
+	geocoding := getGeocodeOptions()
+	sessionBuffer := getBackpressure("SESSION", defaultSessionBuffer)
+	clientBuffer := getBackpressure("CLIENT", defaultClientBuffer)
+	trending, err := getTrendingOptions()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	heatmap, err := getHeatmapOptions()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	seriesConfig, err := getSeriesConfig()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	for _, validate := range []func() error{geocoding.Validate, sessionBuffer.Validate, clientBuffer.Validate, trending.Validate, heatmap.Validate, seriesConfig.Validate} {
+		err = validate()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Metrics are kept in memory as well, so the app can chart them without
+	// Graphite.
+	seriesStore := series.New(seriesConfig)
+	statsdClient = series.Tee(statsdClient, seriesStore)
 
-	server := server.New(logger, fetcher)
+	// Replays don't touch the sessions kept for the live app.
+	var sessionStore store.Store
+	if replay == nil {
+		sessionStore, err = getSessionStore()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	tweetsFetcher := fetcher.New(logger, tweetsSource(logger), statsdClient, geoCoder(logger), fetcher.Config{
+		RecordingsDir: recordingsDir,
+		Geocoding:     geocoding,
+		Buffer:        sessionBuffer,
+		Trending:      trending,
+		Heatmap:       heatmap,
+		Store:         sessionStore,
+	})
+
+	tweetsScheduler := scheduler.New(logger, tweetsFetcher, statsdClient, scheduler.Config{})
+
+	server := server.New(logger, tweetsFetcher, tweetsScheduler, seriesStore, statsdClient, clientBuffer)
 	errChan := make(chan error)
 	go server.Start(errChan, getPort())
 
+	if replay == nil && !noRestore {
+		restored, err := tweetsFetcher.Restore()
+		if err != nil {
+			logger.Error("Failed to restore sessions", "err", err)
+		} else {
+			logger.Info("Restored sessions", "count", restored)
+		}
+	}
+
+	if replay != nil {
+		logger.Info("Replaying recording", "file", replay.path, "speed", replay.speed)
+		_, err = tweetsFetcher.Fetch("default", fetcher.Query{
+			Mode:   fetcher.ModeReplay,
+			Replay: &fetcher.ReplayOptions{File: filepath.Base(replay.path), Speed: replay.speed},
+		})
+		if err != nil {
+			logger.Error("Failed to replay recording", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGTERM)
 
@@ -80,6 +200,56 @@ func main() {
 	}
 }
 
+// parseFlags parses the flags given before the command. --no-restore
+// starts the app without resuming the sessions it was running before.
+func parseFlags(args []string) (noRestore bool, rest []string, err error) {
+	flags := flag.NewFlagSet("tweets-fetcher", flag.ContinueOnError)
+	flags.BoolVar(&noRestore, "no-restore", false, "don't resume the sessions saved before the app stopped")
+	if err := flags.Parse(args); err != nil {
+		return false, nil, err
+	}
+	return noRestore, flags.Args(), nil
+}
+
+// replayCommand holds the arguments of `tweets-fetcher replay`.
+type replayCommand struct {
+	path  string
+	dir   string
+	speed float64
+}
+
+// parseCommand parses the command line. Without arguments the app serves
+// live tweets, `replay [--speed 10x] file.jsonl` plays back a recording in
+// the default session instead.
+func parseCommand(args []string) (*replayCommand, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if args[0] != "replay" {
+		return nil, fmt.Errorf("Unknown command %s, usage: tweets-fetcher [--no-restore] [replay [--speed 10x] file.jsonl]", args[0])
+	}
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.String("speed", "1x", "how much faster than recorded to replay, e.g. 10x")
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 1 {
+		return nil, errors.New("Usage: tweets-fetcher replay [--speed 10x] file.jsonl")
+	}
+
+	command := &replayCommand{path: flags.Arg(0), dir: filepath.Dir(flags.Arg(0))}
+	var err error
+	command.speed, err = fetcher.ParseSpeed(*speed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(command.path); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
 func getPort() string {
 	if os.Getenv("PORT") == "" {
 		return defaultPort
@@ -96,20 +266,235 @@ func getloggerLvl() log.Lvl {
 	return lvl
 }
 
-func checkReqiredEnvVariables() error {
-	for _, variable := range requiredEnvVariables {
-		if os.Getenv(variable) == "" {
-			return fmt.Errorf("Env variable %s must be set", variable)
+func getSource() string {
+	if os.Getenv("TWEETS_SOURCE") == "" {
+		return defaultSource
+	}
+	return os.Getenv("TWEETS_SOURCE")
+}
+
+func getFileSourceInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("TWEETS_FILE_INTERVAL"))
+	if err != nil {
+		return defaultFileSourceInterval
+	}
+	return interval
+}
+
+func getGeneratorOptions() fetcher.GeneratorOptions {
+	options := fetcher.GeneratorOptions{
+		Rate:        defaultGeneratorRate,
+		BurstRate:   defaultGeneratorBurstRate,
+		BurstEvery:  defaultGeneratorBurstEvery,
+		BurstLength: defaultGeneratorBurstLen,
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("GENERATOR_RATE"), 64); err == nil {
+		options.Rate = rate
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("GENERATOR_BURST_RATE"), 64); err == nil {
+		options.BurstRate = rate
+	}
+	if every, err := time.ParseDuration(os.Getenv("GENERATOR_BURST_EVERY")); err == nil {
+		options.BurstEvery = every
+	}
+	if length, err := time.ParseDuration(os.Getenv("GENERATOR_BURST_LENGTH")); err == nil {
+		options.BurstLength = length
+	}
+	return options
+}
+
+func getGeocodeOptions() fetcher.GeocodeOptions {
+	options := fetcher.GeocodeOptions{
+		WhenFull: defaultGeocodeWhenFull,
+	}
+	if workers, err := strconv.Atoi(os.Getenv("GEOCODE_WORKERS")); err == nil {
+		options.Workers = workers
+	}
+	if size, err := strconv.Atoi(os.Getenv("GEOCODE_QUEUE_SIZE")); err == nil {
+		options.QueueSize = size
+	}
+	if unordered, err := strconv.ParseBool(os.Getenv("GEOCODE_UNORDERED")); err == nil {
+		options.Unordered = unordered
+	}
+	if waiting, err := strconv.Atoi(os.Getenv("GEOCODE_MAX_WAITING")); err == nil {
+		options.MaxWaiting = waiting
+	}
+	if whenFull := os.Getenv("GEOCODE_WHEN_FULL"); whenFull != "" {
+		options.WhenFull = whenFull
+	}
+	return options
+}
+
+// getBackpressure reads the buffer of a hop from <hop>_BUFFER_SIZE and
+// <hop>_BUFFER_POLICY.
+func getBackpressure(hop string, defaults fetcher.Backpressure) fetcher.Backpressure {
+	buffer := defaults
+	if size, err := strconv.Atoi(os.Getenv(hop + "_BUFFER_SIZE")); err == nil {
+		buffer.Size = size
+	}
+	if policy := os.Getenv(hop + "_BUFFER_POLICY"); policy != "" {
+		buffer.Policy = policy
+	}
+	return buffer
+}
+
+// getTrendingOptions reads TRENDING_WINDOWS, a comma separated list of
+// durations, TRENDING_SIZE, TRENDING_CAPACITY and TRENDING_INTERVAL.
+func getTrendingOptions() (fetcher.TrendingOptions, error) {
+	options := fetcher.TrendingOptions{}
+	windows, err := getDurations("TRENDING_WINDOWS")
+	if err != nil {
+		return options, err
+	}
+	options.Windows = windows
+	if size, err := strconv.Atoi(os.Getenv("TRENDING_SIZE")); err == nil {
+		options.Size = size
+	}
+	if capacity, err := strconv.Atoi(os.Getenv("TRENDING_CAPACITY")); err == nil {
+		options.Capacity = capacity
+	}
+	if interval, err := time.ParseDuration(os.Getenv("TRENDING_INTERVAL")); err == nil {
+		options.Interval = interval
+	}
+	return options, nil
+}
+
+// getHeatmapOptions reads HEATMAP_PRECISIONS, a comma separated list of
+// geohash lengths, HEATMAP_WINDOWS, a comma separated list of durations,
+// and HEATMAP_INTERVAL.
+func getHeatmapOptions() (fetcher.HeatmapOptions, error) {
+	options := fetcher.HeatmapOptions{}
+	if precisions := os.Getenv("HEATMAP_PRECISIONS"); precisions != "" {
+		for _, value := range strings.Split(precisions, ",") {
+			precision, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return options, fmt.Errorf("Invalid HEATMAP_PRECISIONS: %s", err)
+			}
+			options.Precisions = append(options.Precisions, precision)
+		}
+	}
+	windows, err := getDurations("HEATMAP_WINDOWS")
+	if err != nil {
+		return options, err
+	}
+	options.Windows = windows
+	if interval, err := time.ParseDuration(os.Getenv("HEATMAP_INTERVAL")); err == nil {
+		options.Interval = interval
+	}
+	return options, nil
+}
+
+// getSeriesConfig reads SERIES_RESOLUTIONS, a comma separated list of
+// steps and how long to keep them, e.g. 1s:10m,1m:24h, and SERIES_METRICS,
+// a comma separated list of the metrics to keep.
+func getSeriesConfig() (series.Config, error) {
+	config := series.Config{Metrics: defaultSeriesMetrics, Ratios: seriesRatios}
+	if resolutions := os.Getenv("SERIES_RESOLUTIONS"); resolutions != "" {
+		for _, value := range strings.Split(resolutions, ",") {
+			parts := strings.SplitN(strings.TrimSpace(value), ":", 2)
+			if len(parts) != 2 {
+				return config, fmt.Errorf("Invalid SERIES_RESOLUTIONS: %q isn't step:retention", value)
+			}
+			step, err := time.ParseDuration(parts[0])
+			if err != nil {
+				return config, fmt.Errorf("Invalid SERIES_RESOLUTIONS: %s", err)
+			}
+			retention, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid SERIES_RESOLUTIONS: %s", err)
+			}
+			config.Resolutions = append(config.Resolutions, series.Resolution{Step: step, Retention: retention})
+		}
+	}
+	if metrics := os.Getenv("SERIES_METRICS"); metrics != "" {
+		config.Metrics = nil
+		for _, metric := range strings.Split(metrics, ",") {
+			config.Metrics = append(config.Metrics, strings.TrimSpace(metric))
+		}
+	}
+	return config, nil
+}
+
+// getDurations reads a comma separated list of durations from the
+// environment variable name.
+func getDurations(name string) ([]time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	var durations []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		duration, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", name, err)
+		}
+		durations = append(durations, duration)
+	}
+	return durations, nil
+}
+
+// getSessionStore picks where sessions are kept by SESSION_STORE: "file"
+// saves them to SESSION_STORE_PATH, "volume" to the volume service named
+// SESSION_STORE_SERVICE and "none" doesn't keep them.
+func getSessionStore() (store.Store, error) {
+	switch os.Getenv("SESSION_STORE") {
+	case "", "file":
+		path := os.Getenv("SESSION_STORE_PATH")
+		if path == "" {
+			path = defaultSessionStorePath
+		}
+		return store.NewFile(path), nil
+	case "volume":
+		service := os.Getenv("SESSION_STORE_SERVICE")
+		if service == "" {
+			service = defaultSessionStoreService
+		}
+		return store.NewVolume(os.Getenv("VCAP_SERVICES"), service)
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown SESSION_STORE %s", os.Getenv("SESSION_STORE"))
+	}
+}
+
+func getRecordingsDir() string {
+	if os.Getenv("RECORDINGS_DIR") == "" {
+		return defaultRecordingsDir
+	}
+	return os.Getenv("RECORDINGS_DIR")
+}
+
+// checkReqiredEnvVariables checks the configuration of the tweets source,
+// which replays don't need.
+func checkReqiredEnvVariables(replay bool) error {
+	variables, ok := requiredEnvVariables[getSource()]
+	if !ok {
+		return fmt.Errorf("Unknown TWEETS_SOURCE %s", getSource())
+	}
+
+	if !replay {
+		if err := checkEnvVariables(variables); err != nil {
+			return err
 		}
 	}
 
-	if os.Getenv("GOOGLE_MAPS_KEY") == "" && os.Getenv("BING_MAPS_KEY") == "" {
+	if os.Getenv("GOOGLE_MAPS_KEY") == "" && os.Getenv("BING_MAPS_KEY") == "" && !replay && !sourcesWithPlaces[getSource()] {
 		return errors.New("Either GOOGLE_MAPS_KEY or BING_MAPS_KEY env variable should be set")
 	}
 
 	return nil
 }
 
+func checkEnvVariables(variables []string) error {
+	for _, variable := range variables {
+		if os.Getenv(variable) == "" {
+			return fmt.Errorf("Env variable %s must be set", variable)
+		}
+	}
+	return nil
+}
+
 func statsdClient(logger log.Logger) statsd.Statsd {
 	appEnv, err := cfenv.Current()
 	if err != nil {
@@ -132,14 +517,52 @@ func statsdClient(logger log.Logger) statsd.Statsd {
 	return statsd.NewStatsdClient(addr, prefix)
 }
 
-func twitterClient(consumerKey, consumerSecret, accessToken, accessSecret string) *twitter.Client {
+func tweetsSource(logger log.Logger) fetcher.Source {
+	if err := checkEnvVariables(requiredEnvVariables[getSource()]); err != nil {
+		logger.Warn("Only replays are available", "err", err)
+		return &unavailableSource{err: err}
+	}
+
+	switch getSource() {
+	case "file":
+		logger.Info("Replaying tweets from file", "file", os.Getenv("TWEETS_FILE"))
+		return fetcher.NewFileSource(os.Getenv("TWEETS_FILE"), getFileSourceInterval())
+	case "generator":
+		options := getGeneratorOptions()
+		logger.Info("Generating tweets", "rate", options.Rate, "burstRate", options.BurstRate, "burstEvery", options.BurstEvery)
+		return fetcher.NewGeneratorSource(options)
+	default:
+		logger.Info("Streaming tweets from Twitter")
+		return fetcher.NewTwitterSource(logger, twitterHTTPClient(
+			os.Getenv("TWITTER_CONSUMER_KEY"),
+			os.Getenv("TWITTER_CONSUMER_SECRET"),
+			os.Getenv("TWITTER_CONSUMER_ACCESS_TOKEN"),
+			os.Getenv("TWITTER_CONSUMER_ACCESS_SECRET"),
+		))
+	}
+}
+
+// unavailableSource stands in for a tweets source that isn't configured,
+// so that recordings can still be replayed.
+type unavailableSource struct {
+	err error
+}
+
+func (s *unavailableSource) Open(query fetcher.Query) (fetcher.Stream, error) {
+	return nil, s.err
+}
+
+func twitterHTTPClient(consumerKey, consumerSecret, accessToken, accessSecret string) *http.Client {
 	config := oauth1.NewConfig(consumerKey, consumerSecret)
 	token := oauth1.NewToken(accessToken, accessSecret)
-	httpClient := config.Client(oauth1.NoContext, token)
-	return twitter.NewClient(httpClient)
+	return config.Client(oauth1.NoContext, token)
 }
 
 func geoCoder(logger log.Logger) geocoder.Geocoder {
+	if os.Getenv("BING_MAPS_KEY") == "" && os.Getenv("GOOGLE_MAPS_KEY") == "" {
+		logger.Warn("No maps API key, only tweets tagged with a place are counted by country")
+		return geocoder.NewNone()
+	}
 	if os.Getenv("BING_MAPS_KEY") != "" {
 		logger.Info("Using Bing maps to geocode")
 		return geocoder.NewBing(os.Getenv("BING_MAPS_KEY"))
@@ -152,6 +575,4 @@ func geoCoder(logger log.Logger) geocoder.Geocoder {
 		}
 		return geocoder.NewGoogle(googleMapsClient)
 	}
-
-	return nil
 }
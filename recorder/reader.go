@@ -0,0 +1,71 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// Reader reads back the records of a single recording file.
+type Reader struct {
+	file    *os.File
+	gzip    *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// Open opens a recording file, which is decompressed if its name ends with
+// .gz.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{file: file}
+
+	var input io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		r.gzip, err = gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		input = r.gzip
+	}
+
+	r.scanner = bufio.NewScanner(input)
+	r.scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return r, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the recording.
+func (r *Reader) Next() (*Record, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record := new(Record)
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *Reader) Close() error {
+	if r.gzip != nil {
+		r.gzip.Close()
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,197 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Options control when recordings are split into several files.
+type Options struct {
+	// MaxSize starts a new file once the current one holds this many bytes
+	// of records, before compression. Zero disables it.
+	MaxSize int64
+	// MaxAge starts a new file once the current one has been written to for
+	// this long. Zero disables it.
+	MaxAge time.Duration
+	// Gzip compresses the files.
+	Gzip bool
+}
+
+// Record is a single line of a recording: a raw stream message along with
+// the query it was received for.
+type Record struct {
+	Query      string          `json:"query"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Message    json.RawMessage `json:"message"`
+	// Dropped marks tweets that didn't match the query, which replays
+	// leave out.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// Status describes a running recording.
+type Status struct {
+	Options
+	Started time.Time
+	File    string
+	Files   []string
+	Records int64
+}
+
+// Recorder writes records as newline-delimited JSON to a series of files.
+type Recorder struct {
+	mutex   sync.Mutex
+	dir     string
+	prefix  string
+	options Options
+	started time.Time
+	records int64
+	files   []string
+
+	file   *os.File
+	gzip   *gzip.Writer
+	writer io.Writer
+	size   int64
+	opened time.Time
+}
+
+// New starts a recording in dir. File names start with prefix and the time
+// they were opened at.
+func New(dir, prefix string, options Options) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		dir:     dir,
+		prefix:  unsafeFileNameChars.ReplaceAllString(prefix, "_"),
+		options: options,
+		started: time.Now(),
+	}
+	if err = r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.writer == nil {
+		return fmt.Errorf("Recording to %s is closed", r.file.Name())
+	}
+
+	if r.rotationDue(int64(len(line)) + 1) {
+		if err = r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.writer.Write(append(line, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	r.records++
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.writer == nil {
+		return nil
+	}
+	return r.close()
+}
+
+func (r *Recorder) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	files := make([]string, len(r.files))
+	copy(files, r.files)
+
+	return Status{
+		Options: r.options,
+		Started: r.started,
+		File:    files[len(files)-1],
+		Files:   files,
+		Records: r.records,
+	}
+}
+
+func (r *Recorder) rotationDue(next int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.options.MaxSize > 0 && r.size+next > r.options.MaxSize {
+		return true
+	}
+	if r.options.MaxAge > 0 && time.Since(r.opened) >= r.options.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *Recorder) open() error {
+	name := fmt.Sprintf("%s-%s-%03d.jsonl", r.prefix, r.started.UTC().Format("20060102T150405"), len(r.files))
+	if r.options.Gzip {
+		name += ".gz"
+	}
+	path := filepath.Join(r.dir, name)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = file
+	r.gzip = nil
+	if r.options.Gzip {
+		r.gzip = gzip.NewWriter(file)
+		w = r.gzip
+	}
+
+	r.file = file
+	r.writer = w
+	r.size = 0
+	r.opened = time.Now()
+	r.files = append(r.files, path)
+	return nil
+}
+
+func (r *Recorder) close() error {
+	var err error
+	if r.gzip != nil {
+		err = r.gzip.Close()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.writer = nil
+	return err
+}
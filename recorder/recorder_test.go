@@ -0,0 +1,134 @@
+package recorder_test
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/recorder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func record(text string) *recorder.Record {
+	return &recorder.Record{
+		Query:      "beer",
+		ReceivedAt: time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC),
+		Message:    []byte(`{"text": "` + text + `"}`),
+	}
+}
+
+var _ = Describe("Recorder", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "recordings")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("writes records as JSON lines", func() {
+		rec, err := recorder.New(dir, "default", recorder.Options{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rec.Write(record("first"))).To(Succeed())
+		Expect(rec.Write(record("second"))).To(Succeed())
+		Expect(rec.Close()).To(Succeed())
+
+		status := rec.Status()
+		Expect(status.Records).To(Equal(int64(2)))
+		Expect(status.Files).To(HaveLen(1))
+		Expect(filepath.Base(status.File)).To(HavePrefix("default-"))
+
+		content, err := ioutil.ReadFile(status.File)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(MatchJSON(`{"query": "beer", "received_at": "2016-09-06T09:20:58Z", "message": {"text": "first"}}`))
+	})
+
+	It("starts a new file once the current one is too big", func() {
+		rec, err := recorder.New(dir, "default", recorder.Options{MaxSize: 100})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			Expect(rec.Write(record("tweet"))).To(Succeed())
+		}
+		Expect(rec.Close()).To(Succeed())
+
+		Expect(rec.Status().Files).To(HaveLen(3))
+	})
+
+	It("starts a new file once the current one is too old", func() {
+		rec, err := recorder.New(dir, "default", recorder.Options{MaxAge: time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rec.Write(record("first"))).To(Succeed())
+		time.Sleep(2 * time.Millisecond)
+		Expect(rec.Write(record("second"))).To(Succeed())
+		Expect(rec.Close()).To(Succeed())
+
+		Expect(rec.Status().Files).To(HaveLen(2))
+	})
+
+	It("compresses files", func() {
+		rec, err := recorder.New(dir, "default", recorder.Options{Gzip: true})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rec.Write(record("first"))).To(Succeed())
+		Expect(rec.Close()).To(Succeed())
+
+		file, err := os.Open(rec.Status().File)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		reader, err := gzip.NewReader(file)
+		Expect(err).NotTo(HaveOccurred())
+		content, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(ContainSubstring(`"first"`))
+	})
+
+	It("keeps file names safe", func() {
+		rec, err := recorder.New(dir, "../session", recorder.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		defer rec.Close()
+
+		Expect(filepath.Dir(rec.Status().File)).To(Equal(dir))
+	})
+
+	It("reads back compressed recordings", func() {
+		rec, err := recorder.New(dir, "default", recorder.Options{Gzip: true})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rec.Write(record("first"))).To(Succeed())
+		Expect(rec.Write(record("second"))).To(Succeed())
+		Expect(rec.Close()).To(Succeed())
+
+		reader, err := recorder.Open(rec.Status().File)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+
+		first, err := reader.Next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.Query).To(Equal("beer"))
+		Expect(first.ReceivedAt.Equal(record("first").ReceivedAt)).To(BeTrue())
+		Expect(first.Message).To(MatchJSON(`{"text": "first"}`))
+
+		second, err := reader.Next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Message).To(MatchJSON(`{"text": "second"}`))
+
+		_, err = reader.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+})
@@ -0,0 +1,56 @@
+package scheduler_test
+
+import (
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/scheduler"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cron", func() {
+	// Tuesday.
+	now := time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC)
+
+	next := func(spec string, after time.Time) time.Time {
+		cron, err := scheduler.ParseCron(spec)
+		Expect(err).NotTo(HaveOccurred())
+		return cron.Next(after)
+	}
+
+	It("finds the next matching minute", func() {
+		Expect(next("* * * * *", now)).To(Equal(time.Date(2016, 9, 6, 9, 21, 0, 0, time.UTC)))
+		Expect(next("*/15 * * * *", now)).To(Equal(time.Date(2016, 9, 6, 9, 30, 0, 0, time.UTC)))
+		Expect(next("0 9-17 * * *", now)).To(Equal(time.Date(2016, 9, 6, 10, 0, 0, 0, time.UTC)))
+		Expect(next("30 8 * * *", now)).To(Equal(time.Date(2016, 9, 7, 8, 30, 0, 0, time.UTC)))
+		Expect(next("0 0 1 1 *", now)).To(Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(next("@hourly", now)).To(Equal(time.Date(2016, 9, 6, 10, 0, 0, 0, time.UTC)))
+	})
+
+	It("matches days of the week", func() {
+		Expect(next("0 9 * * 1-5", now)).To(Equal(time.Date(2016, 9, 7, 9, 0, 0, 0, time.UTC)))
+		Expect(next("0 9 * * 6,7", now)).To(Equal(time.Date(2016, 9, 10, 9, 0, 0, 0, time.UTC)))
+		Expect(next("0 9 * * 7", now)).To(Equal(time.Date(2016, 9, 11, 9, 0, 0, 0, time.UTC)))
+	})
+
+	It("matches either day field when both are given", func() {
+		Expect(next("0 9 15 * 5", now)).To(Equal(time.Date(2016, 9, 9, 9, 0, 0, 0, time.UTC)))
+	})
+
+	It("matches both day fields when either starts with *", func() {
+		// The first Monday on an odd day.
+		Expect(next("0 9 */2 * 1", now)).To(Equal(time.Date(2016, 9, 19, 9, 0, 0, 0, time.UTC)))
+	})
+
+	It("returns the zero time for dates that don't exist", func() {
+		Expect(next("0 0 30 2 *", now).IsZero()).To(BeTrue())
+	})
+
+	It("rejects invalid expressions", func() {
+		for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+			_, err := scheduler.ParseCron(spec)
+			Expect(err).To(HaveOccurred(), spec)
+		}
+	})
+})
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+)
+
+// Schedule is a list of queries a session fetches one after another.
+type Schedule struct {
+	Steps []Step
+	// Repeat starts over with the first step once the last one stopped.
+	Repeat bool `json:",omitempty"`
+}
+
+// Step fetches a query until one of its stop conditions is met: For has
+// passed, Tweets were delivered or Until is reached, whichever comes first.
+// A step without any of them runs until the schedule is cancelled.
+type Step struct {
+	Query fetcher.Query
+	// At is a cron expression the step waits for before it starts, e.g.
+	// "0 9 * * 1-5". Blank starts it as soon as the previous one stopped.
+	At     string     `json:",omitempty"`
+	For    string     `json:",omitempty"`
+	Tweets int64      `json:",omitempty"`
+	Until  *time.Time `json:",omitempty"`
+
+	cron     *Cron
+	duration time.Duration
+}
+
+// Validate checks every step and compiles their queries, cron expressions
+// and durations.
+func (s *Schedule) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("Schedule has to have steps")
+	}
+
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if err := step.compile(); err != nil {
+			return fmt.Errorf("Step %d: %s", i+1, err)
+		}
+		if s.Repeat && step.Until != nil {
+			return fmt.Errorf("Step %d: Repeated steps can't stop at a fixed time", i+1)
+		}
+	}
+	return nil
+}
+
+func (s *Step) compile() error {
+	if err := s.Query.Compile(); err != nil {
+		return err
+	}
+	if err := s.Query.Validate(); err != nil {
+		return err
+	}
+
+	if s.At != "" {
+		cron, err := ParseCron(s.At)
+		if err != nil {
+			return err
+		}
+		s.cron = cron
+	}
+	if s.For != "" {
+		duration, err := time.ParseDuration(s.For)
+		if err != nil {
+			return fmt.Errorf("Invalid duration %q", s.For)
+		}
+		if duration <= 0 {
+			return errors.New("Duration has to be positive")
+		}
+		s.duration = duration
+	}
+	if s.Tweets < 0 {
+		return errors.New("Tweets to stop after can't be negative")
+	}
+	return nil
+}
+
+// deadline returns when the step started at started has to stop, and
+// which condition stops it then. It returns the zero time if the step
+// doesn't stop at any time.
+func (s *Step) deadline(started time.Time) (time.Time, string) {
+	var deadline time.Time
+	reason := ""
+	if s.duration > 0 {
+		deadline, reason = started.Add(s.duration), StopDuration
+	}
+	if s.Until != nil && (deadline.IsZero() || s.Until.Before(deadline)) {
+		deadline, reason = *s.Until, StopUntil
+	}
+	return deadline, reason
+}
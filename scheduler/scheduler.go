@@ -0,0 +1,390 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+)
+
+const (
+	// StateWaiting schedules wait for the cron expression of their next step.
+	StateWaiting = "waiting"
+	// StateRunning schedules fetch the query of their current step.
+	StateRunning = "running"
+	// StateFinished schedules stopped their last step and its session.
+	StateFinished = "finished"
+	// StateCancelled schedules were cancelled, leaving their session as it
+	// was.
+	StateCancelled = "cancelled"
+	// StateInterrupted schedules gave up because their session was stopped
+	// or fetched something else outside of the schedule.
+	StateInterrupted = "interrupted"
+	// StateFailed schedules couldn't start a step.
+	StateFailed = "failed"
+)
+
+// Conditions that stop a step.
+const (
+	StopDuration = "duration"
+	StopTweets   = "tweets"
+	StopUntil    = "until"
+)
+
+// Config holds the settings of a scheduler.
+type Config struct {
+	// PollInterval is how often the tweets of running steps are counted, 1s
+	// by default.
+	PollInterval time.Duration
+}
+
+// Status tells where a schedule is at. Step counts from 1.
+type Status struct {
+	Session   string
+	State     string
+	Step      int
+	Steps     int
+	StartsAt  *time.Time `json:",omitempty"`
+	StartedAt *time.Time `json:",omitempty"`
+	Tweets    int64
+	Err       string `json:",omitempty"`
+}
+
+// Scheduler runs schedules of queries in sessions of a fetcher, one
+// schedule per session.
+type Scheduler interface {
+	// Schedule starts running schedule in the session, cancelling the
+	// session's current schedule. It fails if the schedule isn't valid.
+	Schedule(session string, schedule Schedule) (Status, error)
+	// Cancel stops running the session's schedule, leaving the session as it
+	// is unless a step was still starting it. It returns false if the
+	// session doesn't run a schedule.
+	Cancel(session string) bool
+	Status(session string) (Status, bool)
+	Statuses() []Status
+	StopAll()
+}
+
+type scheduler struct {
+	logger       log.Logger
+	fetcher      fetcher.Fetcher
+	statsdClient statsd.Statsd
+	config       Config
+
+	mutex sync.Mutex
+	runs  map[string]*run
+}
+
+func New(logger log.Logger, tweetsFetcher fetcher.Fetcher, statsdClient statsd.Statsd, config Config) Scheduler {
+	if config.PollInterval == 0 {
+		config.PollInterval = time.Second
+	}
+	return &scheduler{
+		logger:       logger.New("module", "scheduler"),
+		fetcher:      tweetsFetcher,
+		statsdClient: statsdClient,
+		config:       config,
+		runs:         make(map[string]*run),
+	}
+}
+
+func (s *scheduler) Schedule(id string, schedule Schedule) (Status, error) {
+	if err := schedule.Validate(); err != nil {
+		return Status{}, err
+	}
+
+	r := &run{
+		scheduler: s,
+		id:        id,
+		schedule:  schedule,
+		logger:    s.logger.New("session", id),
+		cancelled: make(chan struct{}),
+		done:      make(chan struct{}),
+		status:    Status{Session: id, State: StateRunning, Steps: len(schedule.Steps)},
+	}
+
+	s.mutex.Lock()
+	current, ok := s.runs[id]
+	s.runs[id] = r
+	s.mutex.Unlock()
+
+	// The current run ends before the new one starts, without holding up
+	// the other sessions meanwhile.
+	if ok {
+		current.cancel()
+	}
+
+	r.logger.Info("Schedule started", "steps", len(schedule.Steps), "repeat", schedule.Repeat)
+	s.incr("schedule.started")
+	go r.run()
+	return r.Status(), nil
+}
+
+func (s *scheduler) Cancel(id string) bool {
+	s.mutex.Lock()
+	r, ok := s.runs[id]
+	s.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	return r.cancel()
+}
+
+func (s *scheduler) Status(id string) (Status, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.runs[id]
+	if !ok {
+		return Status{}, false
+	}
+	return r.Status(), true
+}
+
+func (s *scheduler) Statuses() []Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]string, 0, len(s.runs))
+	for id := range s.runs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	statuses := make([]Status, 0, len(ids))
+	for _, id := range ids {
+		statuses = append(statuses, s.runs[id].Status())
+	}
+	return statuses
+}
+
+func (s *scheduler) StopAll() {
+	s.mutex.Lock()
+	runs := make([]*run, 0, len(s.runs))
+	for _, r := range s.runs {
+		runs = append(runs, r)
+	}
+	s.mutex.Unlock()
+
+	for _, r := range runs {
+		r.cancel()
+	}
+}
+
+func (s *scheduler) incr(metric string) {
+	if err := s.statsdClient.Incr(metric, 1); err != nil {
+		s.logger.Warn("Failed to emit metric "+metric, "err", err)
+	}
+}
+
+// run is a schedule running in a session.
+type run struct {
+	scheduler *scheduler
+	id        string
+	schedule  Schedule
+	logger    log.Logger
+	cancelled chan struct{}
+	done      chan struct{}
+	// cancelOnce lets the run be cancelled from several goroutines.
+	cancelOnce sync.Once
+	// session is the one the current step started.
+	session fetcher.Session
+
+	mutex  sync.Mutex
+	status Status
+}
+
+func (r *run) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := r.status
+	if status.State == StateRunning && r.session != nil {
+		status.Tweets = r.session.Tweets()
+	}
+	return status
+}
+
+// cancel stops the run and waits for it to end. It returns false if the
+// run had ended already.
+func (r *run) cancel() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+
+	r.cancelOnce.Do(func() { close(r.cancelled) })
+	<-r.done
+	return true
+}
+
+func (r *run) run() {
+	defer close(r.done)
+
+	for {
+		for i := range r.schedule.Steps {
+			if !r.step(i, &r.schedule.Steps[i]) {
+				return
+			}
+		}
+		if !r.schedule.Repeat {
+			break
+		}
+	}
+
+	r.stopSession()
+	r.end(StateFinished, nil)
+}
+
+// step waits for the step's start time if it has one, then fetches its
+// query until it has to stop. It returns false if the schedule ended.
+func (r *run) step(i int, step *Step) bool {
+	if step.cron != nil {
+		startsAt := step.cron.Next(time.Now())
+		if startsAt.IsZero() {
+			r.end(StateFailed, fmt.Errorf("Step %d never starts, %q doesn't match any time", i+1, step.At))
+			return false
+		}
+
+		// Nothing is fetched while waiting.
+		r.stopSession()
+		r.update(func(status *Status) {
+			*status = Status{Session: r.id, State: StateWaiting, Step: i + 1, Steps: status.Steps, StartsAt: &startsAt}
+		})
+		r.logger.Info("Schedule waiting", "step", i+1, "startsAt", startsAt)
+		r.scheduler.incr("schedule.steps.waiting")
+
+		timer := time.NewTimer(startsAt.Sub(time.Now()))
+		select {
+		case <-timer.C:
+		case <-r.cancelled:
+			timer.Stop()
+			r.end(StateCancelled, nil)
+			return false
+		}
+	}
+
+	// Sessions of steps aren't kept to be restored, as the schedule
+	// wouldn't be.
+	session, err := r.scheduler.fetcher.FetchTransient(r.id, step.Query)
+	if err != nil {
+		r.stopSession()
+		r.end(StateFailed, err)
+		return false
+	}
+	r.mutex.Lock()
+	r.session = session
+	r.mutex.Unlock()
+
+	// A step that started while the schedule was cancelled doesn't keep
+	// fetching.
+	select {
+	case <-r.cancelled:
+		r.stopSession()
+		r.end(StateCancelled, nil)
+		return false
+	default:
+	}
+
+	started := time.Now()
+	r.update(func(status *Status) {
+		*status = Status{Session: r.id, State: StateRunning, Step: i + 1, Steps: status.Steps, StartedAt: &started}
+	})
+	r.logger.Info("Schedule step started", "step", i+1, "query", step.Query.String())
+	r.scheduler.incr("schedule.steps.started")
+
+	reason, state := r.watch(session, step, started)
+	if state != "" {
+		r.end(state, nil)
+		return false
+	}
+
+	r.logger.Info("Schedule step stopped", "step", i+1, "reason", reason, "tweets", session.Tweets())
+	r.scheduler.incr("schedule.steps.stopped." + reason)
+	return true
+}
+
+// watch waits until one of the step's stop conditions is met and returns
+// it. If the schedule has to end instead, the state it ends in is
+// returned.
+func (r *run) watch(session fetcher.Session, step *Step, started time.Time) (reason string, state string) {
+	var deadline <-chan time.Time
+	at, atReason := step.deadline(started)
+	if !at.IsZero() {
+		timer := time.NewTimer(at.Sub(time.Now()))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ticker := time.NewTicker(r.scheduler.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadline:
+			return atReason, ""
+		case <-r.cancelled:
+			return "", StateCancelled
+		case <-ticker.C:
+			if current, ok := r.scheduler.fetcher.Session(r.id); !ok || current != session {
+				return "", StateInterrupted
+			}
+			if step.Tweets > 0 && session.Tweets() >= step.Tweets {
+				return StopTweets, ""
+			}
+		}
+	}
+}
+
+// stopSession stops the session of the last step, unless it was replaced
+// outside of the schedule.
+func (r *run) stopSession() {
+	r.mutex.Lock()
+	session := r.session
+	r.session = nil
+	if session != nil {
+		r.status.Tweets = session.Tweets()
+	}
+	r.mutex.Unlock()
+
+	if session == nil {
+		return
+	}
+	if current, ok := r.scheduler.fetcher.Session(r.id); ok && current == session {
+		r.scheduler.fetcher.Stop(r.id)
+	}
+}
+
+func (r *run) update(change func(*Status)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	change(&r.status)
+}
+
+func (r *run) end(state string, err error) {
+	r.mutex.Lock()
+	if r.session != nil {
+		r.status.Tweets = r.session.Tweets()
+	}
+	r.status.State = state
+	r.status.StartsAt = nil
+	if err != nil {
+		r.status.Err = err.Error()
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
+		r.logger.Error("Schedule "+state, "step", r.status.Step, "err", err)
+	} else {
+		r.logger.Info("Schedule "+state, "step", r.status.Step)
+	}
+	r.scheduler.incr("schedule." + state)
+}
@@ -0,0 +1,384 @@
+package scheduler_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/recorder"
+	"github.com/Altoros/tweets-fetcher/scheduler"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSession struct {
+	id     string
+	query  fetcher.Query
+	tweets int64
+}
+
+func (fs *fakeSession) ID() string                         { return fs.id }
+func (fs *fakeSession) Query() fetcher.Query               { return fs.query }
+func (fs *fakeSession) Messages() chan *fetcher.Message    { return make(chan *fetcher.Message) }
+func (fs *fakeSession) Recording() (recorder.Status, bool) { return recorder.Status{}, false }
+func (fs *fakeSession) Replay() (fetcher.Replay, bool)     { return nil, false }
+func (fs *fakeSession) State() fetcher.State               { return fetcher.StateStreaming }
+func (fs *fakeSession) Tweets() int64                      { return atomic.LoadInt64(&fs.tweets) }
+func (fs *fakeSession) Trending() []fetcher.Trending       { return nil }
+func (fs *fakeSession) Heatmap(window string, precision int) (fetcher.HeatmapFrame, bool) {
+	return fetcher.HeatmapFrame{}, false
+}
+func (fs *fakeSession) Countries() fetcher.CountryStats { return fetcher.CountryStats{} }
+
+func (fs *fakeSession) deliver(tweets int64) {
+	atomic.AddInt64(&fs.tweets, tweets)
+}
+
+// fakeFetcher keeps the queries it was asked to fetch in order, and the
+// sessions it would keep in the store. Fetch waits for release if set.
+type fakeFetcher struct {
+	mutex    sync.Mutex
+	sessions map[string]*fakeSession
+	fetched  []string
+	kept     map[string]bool
+	err      error
+	release  chan struct{}
+}
+
+func newFakeFetcher() *fakeFetcher {
+	return &fakeFetcher{sessions: make(map[string]*fakeSession), kept: make(map[string]bool)}
+}
+
+func (ff *fakeFetcher) Fetch(id string, query fetcher.Query) (fetcher.Session, error) {
+	return ff.fetch(id, query, false)
+}
+
+func (ff *fakeFetcher) FetchTransient(id string, query fetcher.Query) (fetcher.Session, error) {
+	return ff.fetch(id, query, true)
+}
+
+func (ff *fakeFetcher) fetch(id string, query fetcher.Query, transient bool) (fetcher.Session, error) {
+	if ff.release != nil {
+		<-ff.release
+	}
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	if ff.err != nil {
+		return nil, ff.err
+	}
+	session := &fakeSession{id: id, query: query}
+	ff.sessions[id] = session
+	ff.fetched = append(ff.fetched, query.String())
+	ff.kept[id] = !transient
+	return session, nil
+}
+
+// fail makes fetching fail with err from then on.
+func (ff *fakeFetcher) fail(err error) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	ff.err = err
+}
+
+func (ff *fakeFetcher) Stop(id string) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	delete(ff.sessions, id)
+	delete(ff.kept, id)
+}
+
+func (ff *fakeFetcher) isKept(id string) bool {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	return ff.kept[id]
+}
+
+func (ff *fakeFetcher) StopAll() {}
+
+func (ff *fakeFetcher) Session(id string) (fetcher.Session, bool) {
+	session, ok := ff.session(id)
+	if !ok {
+		return nil, false
+	}
+	return session, true
+}
+
+func (ff *fakeFetcher) session(id string) (*fakeSession, bool) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	session, ok := ff.sessions[id]
+	return session, ok
+}
+
+func (ff *fakeFetcher) queries() []string {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	return append([]string{}, ff.fetched...)
+}
+
+func (ff *fakeFetcher) Sessions() []fetcher.Session { return nil }
+func (ff *fakeFetcher) StartRecording(id string, options recorder.Options) (recorder.Status, error) {
+	return recorder.Status{}, nil
+}
+func (ff *fakeFetcher) StopRecording(id string) (recorder.Status, error) {
+	return recorder.Status{}, nil
+}
+func (ff *fakeFetcher) OnSessionStart(listener func(fetcher.Session))    {}
+func (ff *fakeFetcher) OnStateChange(listener func(fetcher.StateChange)) {}
+func (ff *fakeFetcher) Restore() (int, error)                            { return 0, nil }
+
+type fakeStatsd struct {
+	statsd.NoopClient
+	mutex    sync.Mutex
+	counters map[string]int64
+}
+
+func (fs *fakeStatsd) Incr(stat string, count int64) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.counters[stat] += count
+	return nil
+}
+
+func (fs *fakeStatsd) counter(stat string) int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.counters[stat]
+}
+
+func track(terms ...string) fetcher.Query {
+	return fetcher.Query{Track: terms}
+}
+
+var _ = Describe("Scheduler", func() {
+	var (
+		tweetFetcher   *fakeFetcher
+		statsdClient   *fakeStatsd
+		tweetScheduler scheduler.Scheduler
+	)
+
+	BeforeEach(func() {
+		logger := log.New()
+		logger.SetHandler(log.DiscardHandler())
+
+		tweetFetcher = newFakeFetcher()
+		statsdClient = &fakeStatsd{counters: make(map[string]int64)}
+		tweetScheduler = scheduler.New(logger, tweetFetcher, statsdClient, scheduler.Config{PollInterval: 5 * time.Millisecond})
+	})
+
+	AfterEach(func() {
+		tweetScheduler.StopAll()
+	})
+
+	state := func(id string) func() string {
+		return func() string {
+			status, _ := tweetScheduler.Status(id)
+			return status.State
+		}
+	}
+
+	It("runs steps one after another until their time is up", func() {
+		_, err := tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("kubecon"), For: "20ms"},
+			{Query: track("golang"), For: "20ms"},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(state("demo")).Should(Equal(scheduler.StateFinished))
+		Expect(tweetFetcher.queries()).To(Equal([]string{"kubecon", "golang"}))
+		_, ok := tweetFetcher.Session("demo")
+		Expect(ok).To(BeFalse())
+
+		Expect(statsdClient.counter("schedule.started")).To(Equal(int64(1)))
+		Expect(statsdClient.counter("schedule.steps.started")).To(Equal(int64(2)))
+		Expect(statsdClient.counter("schedule.steps.stopped.duration")).To(Equal(int64(2)))
+		Expect(statsdClient.counter("schedule.finished")).To(Equal(int64(1)))
+	})
+
+	It("stops steps after enough tweets", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("golang"), Tweets: 500},
+			{Query: fetcher.Query{Mode: fetcher.ModeSample}},
+		}})
+
+		var session *fakeSession
+		Eventually(func() bool {
+			var ok bool
+			session, ok = tweetFetcher.session("demo")
+			return ok
+		}).Should(BeTrue())
+
+		session.deliver(499)
+		Eventually(func() int64 {
+			status, _ := tweetScheduler.Status("demo")
+			return status.Tweets
+		}).Should(Equal(int64(499)))
+		Consistently(tweetFetcher.queries, "20ms").Should(HaveLen(1))
+
+		session.deliver(1)
+		Eventually(tweetFetcher.queries).Should(Equal([]string{"golang", "a sample of all tweets"}))
+		Expect(statsdClient.counter("schedule.steps.stopped.tweets")).To(Equal(int64(1)))
+
+		// The last step has nothing to stop it.
+		status, _ := tweetScheduler.Status("demo")
+		Expect(status.State).To(Equal(scheduler.StateRunning))
+		Expect(status.Step).To(Equal(2))
+		Expect(status.Steps).To(Equal(2))
+	})
+
+	It("stops steps at a wall-clock time", func() {
+		until := time.Now().Add(20 * time.Millisecond)
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("golang"), For: "1h", Until: &until},
+		}})
+
+		Eventually(state("demo")).Should(Equal(scheduler.StateFinished))
+		Expect(statsdClient.counter("schedule.steps.stopped.until")).To(Equal(int64(1)))
+	})
+
+	It("repeats schedules", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Repeat: true, Steps: []scheduler.Step{
+			{Query: track("kubecon"), For: "5ms"},
+			{Query: track("golang"), For: "5ms"},
+		}})
+
+		Eventually(func() int { return len(tweetFetcher.queries()) }).Should(BeNumerically(">=", 4))
+		Expect(tweetFetcher.queries()[:4]).To(Equal([]string{"kubecon", "golang", "kubecon", "golang"}))
+	})
+
+	It("waits for the start time of steps", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("golang"), For: "5ms"},
+			{Query: track("kubecon"), At: "0 0 1 1 *"},
+		}})
+
+		Eventually(state("demo")).Should(Equal(scheduler.StateWaiting))
+		status, _ := tweetScheduler.Status("demo")
+		Expect(status.Step).To(Equal(2))
+		Expect(status.StartsAt.Month()).To(Equal(time.January))
+		Expect(status.StartsAt.After(time.Now())).To(BeTrue())
+
+		// Nothing runs while waiting.
+		_, ok := tweetFetcher.Session("demo")
+		Expect(ok).To(BeFalse())
+		Expect(tweetFetcher.queries()).To(Equal([]string{"golang"}))
+	})
+
+	It("leaves the session running when cancelled", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("golang"), For: "1h"},
+		}})
+		Eventually(tweetFetcher.queries).Should(HaveLen(1))
+
+		Expect(tweetScheduler.Cancel("demo")).To(BeTrue())
+		Expect(state("demo")()).To(Equal(scheduler.StateCancelled))
+		_, ok := tweetFetcher.Session("demo")
+		Expect(ok).To(BeTrue())
+
+		Expect(tweetScheduler.Cancel("demo")).To(BeFalse())
+		Expect(tweetScheduler.Cancel("other")).To(BeFalse())
+	})
+
+	It("stops the session of a step that started while cancelling", func() {
+		tweetFetcher.release = make(chan struct{})
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+
+		cancelled := make(chan bool)
+		go func() { cancelled <- tweetScheduler.Cancel("demo") }()
+		Consistently(cancelled).ShouldNot(Receive())
+		Expect(tweetScheduler.Statuses()).To(HaveLen(1))
+
+		close(tweetFetcher.release)
+		Eventually(cancelled).Should(Receive(BeTrue()))
+		Expect(state("demo")()).To(Equal(scheduler.StateCancelled))
+		_, ok := tweetFetcher.Session("demo")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("replaces the session's schedule", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("kubecon")}}})
+
+		Eventually(tweetFetcher.queries).Should(ContainElement("kubecon"))
+		Expect(statsdClient.counter("schedule.cancelled")).To(Equal(int64(1)))
+		Expect(tweetScheduler.Statuses()).To(HaveLen(1))
+	})
+
+	It("gives up when the session is stopped elsewhere", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+		Eventually(tweetFetcher.queries).Should(HaveLen(1))
+
+		tweetFetcher.Stop("demo")
+		Eventually(state("demo")).Should(Equal(scheduler.StateInterrupted))
+	})
+
+	It("fails when a step can't start", func() {
+		tweetFetcher.err = errors.New("Connection refused")
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+
+		Eventually(state("demo")).Should(Equal(scheduler.StateFailed))
+		status, _ := tweetScheduler.Status("demo")
+		Expect(status.Err).To(Equal("Connection refused"))
+		Expect(statsdClient.counter("schedule.failed")).To(Equal(int64(1)))
+	})
+
+	It("stops the session of the last step when the next one can't start", func() {
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{
+			{Query: track("golang"), Tweets: 1},
+			{Query: track("docker")},
+		}})
+		var session *fakeSession
+		Eventually(func() bool {
+			var ok bool
+			session, ok = tweetFetcher.session("demo")
+			return ok
+		}).Should(BeTrue())
+
+		tweetFetcher.fail(errors.New("Connection refused"))
+		session.deliver(1)
+		Eventually(state("demo")).Should(Equal(scheduler.StateFailed))
+		_, ok := tweetFetcher.Session("demo")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("doesn't keep the sessions of steps to be restored", func() {
+		tweetFetcher.Fetch("demo", track("kubecon"))
+		Expect(tweetFetcher.isKept("demo")).To(BeTrue())
+
+		tweetScheduler.Schedule("demo", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+		Eventually(tweetFetcher.queries).Should(HaveLen(2))
+		Expect(tweetFetcher.isKept("demo")).To(BeFalse())
+	})
+
+	It("rejects invalid schedules", func() {
+		schedules := []scheduler.Schedule{
+			{},
+			{Steps: []scheduler.Step{{Query: fetcher.Query{}}}},
+			{Steps: []scheduler.Step{{Query: track("golang"), For: "soon"}}},
+			{Steps: []scheduler.Step{{Query: track("golang"), For: "-1m"}}},
+			{Steps: []scheduler.Step{{Query: track("golang"), At: "every monday"}}},
+			{Steps: []scheduler.Step{{Query: track("golang"), Tweets: -1}}},
+			{Repeat: true, Steps: []scheduler.Step{{Query: track("golang"), Until: &time.Time{}}}},
+		}
+		for _, schedule := range schedules {
+			_, err := tweetScheduler.Schedule("demo", schedule)
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(tweetScheduler.Statuses()).To(BeEmpty())
+	})
+})
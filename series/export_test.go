@@ -0,0 +1,10 @@
+package series
+
+import "time"
+
+// NewWithClock exposes stores to tests, with now standing in for the clock.
+func NewWithClock(config Config, now func() time.Time) Store {
+	s := New(config).(*store)
+	s.now = now
+	return s
+}
@@ -0,0 +1,481 @@
+package series
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of series.
+const (
+	// KindRate series are counters, served in counts per second.
+	KindRate = "rate"
+	// KindGauge series keep their last value until it changes.
+	KindGauge = "gauge"
+	// KindPercentile series are percentiles of timings in milliseconds,
+	// served as <metric>.p50, <metric>.p90 and <metric>.p99.
+	KindPercentile = "percentile"
+	// KindRatio series divide the counts of one counter by another's.
+	KindRatio = "ratio"
+)
+
+const (
+	// maxSamples is how many timings each point keeps at most to take
+	// percentiles from.
+	maxSamples = 100
+	// maxPoints is how many points a query returns at most.
+	maxPoints = 5000
+)
+
+var (
+	ErrUnknownMetric = errors.New("Unknown metric")
+	ErrTooManyPoints = fmt.Errorf("Queries can't return more than %d points, pick a bigger step", maxPoints)
+)
+
+// Percentiles are the percentiles timings are served as.
+var Percentiles = []int{50, 90, 99}
+
+// DefaultResolutions keep a point per second for 10 minutes, per 10
+// seconds for 2 hours and per minute for a day.
+var DefaultResolutions = []Resolution{
+	{Step: time.Second, Retention: 10 * time.Minute},
+	{Step: 10 * time.Second, Retention: 2 * time.Hour},
+	{Step: time.Minute, Retention: 24 * time.Hour},
+}
+
+// Resolution is how far apart the points of series are and how long they
+// are kept.
+type Resolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+func (r Resolution) String() string {
+	return fmt.Sprintf("%s:%s", r.Step, r.Retention)
+}
+
+func (r Resolution) points() int {
+	return int(r.Retention / r.Step)
+}
+
+// Ratio names the counters a ratio divides.
+type Ratio struct {
+	Numerator   string
+	Denominator string
+}
+
+// Config holds the settings of a store.
+type Config struct {
+	// Resolutions are kept for every series, finest first. Blank means
+	// DefaultResolutions.
+	Resolutions []Resolution
+	// Metrics are the metrics kept. Blank means all of them.
+	Metrics []string
+	// Ratios are served by their name along with the metrics.
+	Ratios map[string]Ratio
+}
+
+func (c Config) Validate() error {
+	var previous Resolution
+	for _, resolution := range c.Resolutions {
+		if resolution.Step <= 0 || resolution.Retention < resolution.Step {
+			return fmt.Errorf("Invalid series resolution %s: the step has to be positive and no longer than the retention", resolution)
+		}
+		if resolution.points() > 100000 {
+			return fmt.Errorf("Invalid series resolution %s: it keeps more than 100000 points", resolution)
+		}
+		if resolution.Step <= previous.Step {
+			return errors.New("Series resolutions have to go from fine to coarse")
+		}
+		previous = resolution
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if len(c.Resolutions) == 0 {
+		c.Resolutions = DefaultResolutions
+	}
+	return c
+}
+
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series holds the points of a metric between two times, Step apart.
+// Points of gauges and percentiles are left out of steps nothing was
+// recorded in, as are points of ratios whose counters were 0.
+type Series struct {
+	Metric string
+	Kind   string
+	Step   string
+	Points []Point
+}
+
+// Store keeps series of metrics in memory, at a few resolutions each.
+type Store interface {
+	// Count adds to a counter.
+	Count(metric string, value int64)
+	Gauge(metric string, value float64)
+	Timing(metric string, value time.Duration)
+	// Query returns the points of a metric from from up to to, step apart.
+	// Steps finer than the resolution kept for from are coarsened, a zero
+	// step picks that resolution. It fails with ErrUnknownMetric if nothing
+	// was recorded for the metric.
+	Query(metric string, from, to time.Time, step time.Duration) (Series, error)
+	// Metrics lists the series that can be queried.
+	Metrics() []string
+}
+
+type store struct {
+	config Config
+	kept   map[string]bool
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	metrics map[string]*metric
+	random  *rand.Rand
+}
+
+func New(config Config) Store {
+	config = config.withDefaults()
+
+	s := &store{
+		config:  config,
+		now:     time.Now,
+		metrics: make(map[string]*metric),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if len(config.Metrics) > 0 {
+		s.kept = make(map[string]bool)
+		for _, name := range config.Metrics {
+			s.kept[name] = true
+		}
+	}
+	return s
+}
+
+func (s *store) Count(name string, value int64) {
+	s.record(name, KindRate, func(p *point) {
+		p.sum += float64(value)
+	})
+}
+
+func (s *store) Gauge(name string, value float64) {
+	s.record(name, KindGauge, func(p *point) {
+		p.last = value
+		p.set = true
+	})
+}
+
+func (s *store) Timing(name string, value time.Duration) {
+	ms := float64(value) / float64(time.Millisecond)
+	s.record(name, KindPercentile, func(p *point) {
+		// Reservoir sampling keeps every timing equally likely to be kept.
+		p.seen++
+		if len(p.samples) < maxSamples {
+			p.samples = append(p.samples, ms)
+		} else if i := s.random.Int63n(p.seen); i < maxSamples {
+			p.samples[i] = ms
+		}
+	})
+}
+
+// record applies change to the current point of the metric at every
+// resolution. Metrics recorded as one kind ignore the others.
+func (s *store) record(name string, kind string, change func(*point)) {
+	if s.kept != nil && !s.kept[name] {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.metrics[name]
+	if !ok {
+		m = newMetric(kind, s.config.Resolutions)
+		s.metrics[name] = m
+	}
+	if m.kind != kind {
+		return
+	}
+
+	now := s.now()
+	for _, r := range m.rings {
+		change(r.current(now))
+	}
+}
+
+func (s *store) Metrics() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := []string{}
+	for name, m := range s.metrics {
+		if m.kind != KindPercentile {
+			names = append(names, name)
+			continue
+		}
+		for _, percentile := range Percentiles {
+			names = append(names, fmt.Sprintf("%s.p%d", name, percentile))
+		}
+	}
+	for name, ratio := range s.config.Ratios {
+		if s.metrics[ratio.Numerator] != nil && s.metrics[ratio.Denominator] != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *store) Query(name string, from, to time.Time, step time.Duration) (Series, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ratio, ok := s.config.Ratios[name]; ok {
+		numerator, denominator := s.metrics[ratio.Numerator], s.metrics[ratio.Denominator]
+		if numerator == nil || denominator == nil || numerator.kind != KindRate || denominator.kind != KindRate {
+			return Series{}, ErrUnknownMetric
+		}
+		return s.queryRatio(name, numerator, denominator, from, to, step)
+	}
+
+	base, percentile := splitPercentile(name)
+	m, ok := s.metrics[base]
+	if !ok || (percentile > 0) != (m.kind == KindPercentile) {
+		return Series{}, ErrUnknownMetric
+	}
+
+	r, step, err := s.resolution(m, from, to, step)
+	if err != nil {
+		return Series{}, err
+	}
+
+	var resolve func(points []*point) (float64, bool)
+	switch m.kind {
+	case KindRate:
+		resolve = func(points []*point) (float64, bool) {
+			return sum(points) / step.Seconds(), true
+		}
+	case KindGauge:
+		last, set := r.before(from)
+		resolve = func(points []*point) (float64, bool) {
+			for _, p := range points {
+				if p.set {
+					last, set = p.last, true
+				}
+			}
+			return last, set
+		}
+	case KindPercentile:
+		resolve = func(points []*point) (float64, bool) {
+			return percentileOf(points, percentile)
+		}
+	}
+
+	return Series{
+		Metric: name,
+		Kind:   m.kind,
+		Step:   step.String(),
+		Points: r.points(from, to, step, resolve),
+	}, nil
+}
+
+func (s *store) queryRatio(name string, numerator, denominator *metric, from, to time.Time, step time.Duration) (Series, error) {
+	r, step, err := s.resolution(denominator, from, to, step)
+	if err != nil {
+		return Series{}, err
+	}
+	n := numerator.rings[r.index]
+
+	// The numerator is summed over the same steps as the denominator.
+	var numerators []float64
+	n.points(from, to, step, func(points []*point) (float64, bool) {
+		numerators = append(numerators, sum(points))
+		return 0, true
+	})
+	i := -1
+	points := r.points(from, to, step, func(points []*point) (float64, bool) {
+		i++
+		total := sum(points)
+		if total == 0 {
+			return 0, false
+		}
+		return numerators[i] / total, true
+	})
+
+	return Series{Metric: name, Kind: KindRatio, Step: step.String(), Points: points}, nil
+}
+
+// resolution picks the finest ring of the metric that still keeps from,
+// and the step to serve it at.
+func (s *store) resolution(m *metric, from, to time.Time, step time.Duration) (*ring, time.Duration, error) {
+	if to.Before(from) {
+		return nil, 0, errors.New("Series can't end before they start")
+	}
+
+	r := m.rings[len(m.rings)-1]
+	for _, candidate := range m.rings {
+		if !from.Before(s.now().Add(-candidate.resolution.Retention)) {
+			r = candidate
+			break
+		}
+	}
+
+	if step < r.resolution.Step {
+		step = r.resolution.Step
+	}
+	if to.Sub(from)/step >= maxPoints {
+		return nil, 0, ErrTooManyPoints
+	}
+	return r, step, nil
+}
+
+// splitPercentile splits a name such as latency.p90 into the metric and
+// the percentile, which is 0 if the name isn't a percentile.
+func splitPercentile(name string) (string, int) {
+	i := strings.LastIndex(name, ".p")
+	if i < 0 {
+		return name, 0
+	}
+	percentile, err := strconv.Atoi(name[i+2:])
+	if err != nil {
+		return name, 0
+	}
+	for _, p := range Percentiles {
+		if p == percentile {
+			return name[:i], percentile
+		}
+	}
+	return name, 0
+}
+
+type metric struct {
+	kind  string
+	rings []*ring
+}
+
+func newMetric(kind string, resolutions []Resolution) *metric {
+	m := &metric{kind: kind}
+	for i, resolution := range resolutions {
+		m.rings = append(m.rings, newRing(i, resolution))
+	}
+	return m
+}
+
+// ring holds the points of a metric at a resolution. Each point sits at
+// its step since the epoch modulo the number of points kept, so it's
+// overwritten once it's older than the retention.
+type ring struct {
+	index      int
+	resolution Resolution
+	slots      []point
+}
+
+type point struct {
+	// step is the step since the epoch the point is for. Points with
+	// another step than the one asked for are stale.
+	step int64
+	// sum holds the counts of counters.
+	sum float64
+	// last holds the value of gauges, if set.
+	last float64
+	set  bool
+	// samples hold some of the timings recorded, seen counts all of them.
+	samples []float64
+	seen    int64
+}
+
+func newRing(index int, resolution Resolution) *ring {
+	r := &ring{index: index, resolution: resolution, slots: make([]point, resolution.points())}
+	for i := range r.slots {
+		r.slots[i].step = -1
+	}
+	return r
+}
+
+func (r *ring) stepOf(t time.Time) int64 {
+	return t.UnixNano() / int64(r.resolution.Step)
+}
+
+func (r *ring) at(step int64) *point {
+	return &r.slots[step%int64(len(r.slots))]
+}
+
+// current returns the point of now, clearing it if it's stale.
+func (r *ring) current(now time.Time) *point {
+	step := r.stepOf(now)
+	p := r.at(step)
+	if p.step != step {
+		*p = point{step: step}
+	}
+	return p
+}
+
+// points resolves a point for every step from from up to to out of the
+// ring's points during that step.
+func (r *ring) points(from, to time.Time, step time.Duration, resolve func([]*point) (float64, bool)) []Point {
+	points := []Point{}
+	for t := from.Truncate(step); !t.After(to); t = t.Add(step) {
+		var during []*point
+		for s := r.stepOf(t); s < r.stepOf(t.Add(step)); s++ {
+			if p := r.at(s); p.step == s {
+				during = append(during, p)
+			}
+		}
+		if value, ok := resolve(during); ok {
+			points = append(points, Point{Time: t, Value: value})
+		}
+	}
+	return points
+}
+
+// before returns the last gauge value set before t, if the ring still
+// keeps it.
+func (r *ring) before(t time.Time) (float64, bool) {
+	latest := int64(-1)
+	value := 0.0
+	limit := r.stepOf(t)
+	for i := range r.slots {
+		p := &r.slots[i]
+		if p.set && p.step < limit && p.step > latest {
+			latest, value = p.step, p.last
+		}
+	}
+	return value, latest >= 0
+}
+
+func sum(points []*point) float64 {
+	total := 0.0
+	for _, p := range points {
+		total += p.sum
+	}
+	return total
+}
+
+// percentileOf takes the nearest-rank percentile of the timings sampled
+// in points.
+func percentileOf(points []*point, percentile int) (float64, bool) {
+	var samples []float64
+	for _, p := range points {
+		samples = append(samples, p.samples...)
+	}
+	if len(samples) == 0 {
+		return 0, false
+	}
+	sort.Float64s(samples)
+	rank := int(math.Ceil(float64(percentile) / 100 * float64(len(samples))))
+	if rank < 1 {
+		rank = 1
+	}
+	return samples[rank-1], true
+}
@@ -0,0 +1,13 @@
+package series_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSeries(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Series Suite")
+}
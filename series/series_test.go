@@ -0,0 +1,162 @@
+package series_test
+
+import (
+	"time"
+
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/series"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		start time.Time
+		now   time.Time
+		store series.Store
+	)
+
+	BeforeEach(func() {
+		start = time.Date(2016, 9, 6, 9, 20, 0, 0, time.UTC)
+		now = start
+		store = series.NewWithClock(series.Config{
+			Resolutions: []series.Resolution{
+				{Step: time.Second, Retention: time.Minute},
+				{Step: 10 * time.Second, Retention: time.Hour},
+			},
+			Ratios: map[string]series.Ratio{
+				"geolocatedRatio": {Numerator: "tweetsWithLocation", Denominator: "totalTweets"},
+			},
+		}, func() time.Time { return now })
+	})
+
+	values := func(s series.Series) []float64 {
+		values := []float64{}
+		for _, point := range s.Points {
+			values = append(values, point.Value)
+		}
+		return values
+	}
+
+	It("serves counters as rates", func() {
+		store.Count("totalTweets", 2)
+		now = now.Add(time.Second)
+		store.Count("totalTweets", 1)
+		store.Count("totalTweets", 3)
+
+		s, err := store.Query("totalTweets", start, start.Add(2*time.Second), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Kind).To(Equal(series.KindRate))
+		Expect(s.Step).To(Equal("1s"))
+		Expect(values(s)).To(Equal([]float64{2, 4, 0}))
+		Expect(s.Points[0].Time).To(Equal(start))
+
+		s, _ = store.Query("totalTweets", start, start.Add(time.Second), 2*time.Second)
+		Expect(values(s)).To(Equal([]float64{3}))
+	})
+
+	It("serves older points at a coarser resolution", func() {
+		store.Count("totalTweets", 20)
+		now = now.Add(5 * time.Minute)
+
+		s, err := store.Query("totalTweets", start, start.Add(15*time.Second), time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Step).To(Equal("10s"))
+		Expect(values(s)).To(Equal([]float64{2, 0}))
+	})
+
+	It("keeps gauges until they change", func() {
+		store.Gauge("clients.connected", 3)
+		now = now.Add(2 * time.Second)
+		store.Gauge("clients.connected", 1)
+
+		s, _ := store.Query("clients.connected", start.Add(time.Second), start.Add(3*time.Second), 0)
+		Expect(s.Kind).To(Equal(series.KindGauge))
+		Expect(values(s)).To(Equal([]float64{3, 1, 1}))
+	})
+
+	It("serves percentiles of timings", func() {
+		for i := 1; i <= 10; i++ {
+			store.Timing("googleApiRequestTime", time.Duration(i*10)*time.Millisecond)
+		}
+
+		s, err := store.Query("googleApiRequestTime.p90", start, start, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Kind).To(Equal(series.KindPercentile))
+		Expect(values(s)).To(Equal([]float64{90}))
+
+		s, _ = store.Query("googleApiRequestTime.p50", start, start.Add(time.Second), 0)
+		Expect(values(s)).To(Equal([]float64{50}))
+
+		_, err = store.Query("googleApiRequestTime", start, start, 0)
+		Expect(err).To(Equal(series.ErrUnknownMetric))
+	})
+
+	It("divides counters for ratios", func() {
+		store.Count("totalTweets", 4)
+		store.Count("tweetsWithLocation", 1)
+		now = now.Add(2 * time.Second)
+		store.Count("totalTweets", 2)
+
+		s, err := store.Query("geolocatedRatio", start, start.Add(2*time.Second), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Kind).To(Equal(series.KindRatio))
+		// Steps without tweets have no ratio.
+		Expect(values(s)).To(Equal([]float64{0.25, 0}))
+	})
+
+	It("lists metrics", func() {
+		store.Count("totalTweets", 1)
+		store.Count("tweetsWithLocation", 1)
+		store.Timing("googleApiRequestTime", time.Millisecond)
+
+		Expect(store.Metrics()).To(Equal([]string{
+			"geolocatedRatio",
+			"googleApiRequestTime.p50", "googleApiRequestTime.p90", "googleApiRequestTime.p99",
+			"totalTweets", "tweetsWithLocation",
+		}))
+	})
+
+	It("keeps only the metrics asked for", func() {
+		store = series.NewWithClock(series.Config{Metrics: []string{"totalTweets"}}, func() time.Time { return now })
+		store.Count("totalTweets", 1)
+		store.Count("countries.Germany", 1)
+
+		Expect(store.Metrics()).To(Equal([]string{"totalTweets"}))
+	})
+
+	It("rejects unknown metrics and bad ranges", func() {
+		store.Count("totalTweets", 1)
+
+		_, err := store.Query("missing", start, start, 0)
+		Expect(err).To(Equal(series.ErrUnknownMetric))
+		_, err = store.Query("totalTweets", start, start.Add(-time.Second), 0)
+		Expect(err).To(HaveOccurred())
+		_, err = store.Query("totalTweets", start, start.Add(24*time.Hour), time.Second)
+		Expect(err).To(Equal(series.ErrTooManyPoints))
+	})
+
+	It("rejects invalid resolutions", func() {
+		Expect(series.Config{Resolutions: []series.Resolution{{Step: 0, Retention: time.Minute}}}.Validate()).To(HaveOccurred())
+		Expect(series.Config{Resolutions: []series.Resolution{{Step: time.Minute, Retention: time.Second}}}.Validate()).To(HaveOccurred())
+		Expect(series.Config{Resolutions: []series.Resolution{
+			{Step: time.Minute, Retention: time.Hour},
+			{Step: time.Second, Retention: time.Minute},
+		}}.Validate()).To(HaveOccurred())
+		Expect(series.Config{Resolutions: series.DefaultResolutions}.Validate()).NotTo(HaveOccurred())
+	})
+
+	It("records what is sent to statsd", func() {
+		client := series.Tee(&statsd.NoopClient{}, store)
+		client.Incr("totalTweets", 2)
+		client.Gauge("clients.connected", 1)
+		client.PrecisionTiming("pipeline.geocode.time", 5*time.Millisecond)
+
+		Expect(store.Metrics()).To(ContainElement("totalTweets"))
+		Expect(store.Metrics()).To(ContainElement("clients.connected"))
+		s, _ := store.Query("pipeline.geocode.time.p99", start, start, 0)
+		Expect(values(s)).To(Equal([]float64{5}))
+	})
+})
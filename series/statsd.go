@@ -0,0 +1,48 @@
+package series
+
+import (
+	"time"
+
+	"github.com/quipo/statsd"
+)
+
+// Tee records the counters, gauges and timings sent to client in store as
+// well, so they can be shown even if client is a statsd.NoopClient.
+func Tee(client statsd.Statsd, store Store) statsd.Statsd {
+	return &teeClient{Statsd: client, store: store}
+}
+
+type teeClient struct {
+	statsd.Statsd
+	store Store
+}
+
+func (c *teeClient) Incr(stat string, count int64) error {
+	c.store.Count(stat, count)
+	return c.Statsd.Incr(stat, count)
+}
+
+func (c *teeClient) Decr(stat string, count int64) error {
+	c.store.Count(stat, -count)
+	return c.Statsd.Decr(stat, count)
+}
+
+func (c *teeClient) Timing(stat string, delta int64) error {
+	c.store.Timing(stat, time.Duration(delta)*time.Millisecond)
+	return c.Statsd.Timing(stat, delta)
+}
+
+func (c *teeClient) PrecisionTiming(stat string, delta time.Duration) error {
+	c.store.Timing(stat, delta)
+	return c.Statsd.PrecisionTiming(stat, delta)
+}
+
+func (c *teeClient) Gauge(stat string, value int64) error {
+	c.store.Gauge(stat, float64(value))
+	return c.Statsd.Gauge(stat, value)
+}
+
+func (c *teeClient) FGauge(stat string, value float64) error {
+	c.store.Gauge(stat, value)
+	return c.Statsd.FGauge(stat, value)
+}
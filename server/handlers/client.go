@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,10 +20,54 @@ const (
 
 type Client struct {
 	connection       *websocket.Conn
-	send             chan *fetcher.Tweet
+	send             chan *fetcher.Message
 	err              chan error
 	done             chan bool
 	handledSendClose chan bool
+	// unregistered is closed once the client is unregistered, so that a
+	// message waiting for room in send gives up.
+	unregistered chan struct{}
+	// sendMutex lets one message at a time into send, and none once send
+	// is closed.
+	sendMutex sync.Mutex
+	// heatmap is set for clients sent heatmap cells instead of tweets. It
+	// starts out as all the cells of the frame they asked for.
+	heatmap *fetcher.HeatmapFrame
+}
+
+// filter returns what the client is sent of a message, or nil if the
+// client isn't sent the message at all. Heatmap clients are sent the
+// cells of their own frame instead of tweets.
+func (c *Client) filter(message *fetcher.Message) *fetcher.Message {
+	switch message.Type {
+	case fetcher.MessageTweet, fetcher.MessageRetraction:
+		if c.heatmap != nil {
+			return nil
+		}
+	case fetcher.MessageHeatmap:
+		if c.heatmap == nil {
+			return nil
+		}
+		for _, frame := range message.Heatmap {
+			if frame.Window == c.heatmap.Window && frame.Precision == c.heatmap.Precision {
+				return &fetcher.Message{Type: fetcher.MessageHeatmap, Heatmap: []fetcher.HeatmapFrame{frame}}
+			}
+		}
+		return nil
+	}
+	return message
+}
+
+// reset returns the heatmap message that clears the client's cells, for
+// when its session starts over.
+func (c *Client) reset() *fetcher.Message {
+	frame := fetcher.HeatmapFrame{
+		Window:    c.heatmap.Window,
+		Precision: c.heatmap.Precision,
+		Cells:     []fetcher.HeatmapCell{},
+		Snapshot:  true,
+	}
+	return &fetcher.Message{Type: fetcher.MessageHeatmap, Heatmap: []fetcher.HeatmapFrame{frame}}
 }
 
 func (c *Client) write(mt int, payload []byte) error {
@@ -36,6 +81,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.connection.Close()
+		close(c.handledSendClose)
 	}()
 
 	for {
@@ -48,7 +94,6 @@ func (c *Client) writePump() {
 				} else {
 					c.done <- true
 				}
-				c.handledSendClose <- true
 				return
 			}
 
@@ -0,0 +1,16 @@
+package handlers
+
+import "github.com/Altoros/tweets-fetcher/fetcher"
+
+// NewClient exposes clients to tests. They aren't connected, so nothing
+// reads what they are sent until Receive is called.
+func NewClient() *Client {
+	handledSendClose := make(chan bool)
+	close(handledSendClose)
+	return &Client{handledSendClose: handledSendClose}
+}
+
+// Receive returns the channel the client is sent messages on.
+func (c *Client) Receive() chan *fetcher.Message {
+	return c.send
+}
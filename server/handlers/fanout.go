@@ -1,52 +1,238 @@
 package handlers
 
 import (
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
 	"github.com/Altoros/tweets-fetcher/fetcher"
 )
 
+const (
+	// historySize is how many recent tweets of a session are replayed to
+	// clients connecting after the session started.
+	historySize = 100
+
+	defaultClientBufferSize = 256
+)
+
 type Fanout interface {
-	Register(*Client)
+	Attach(session string, input chan *fetcher.Message)
+	Notify(session string, msg *fetcher.Message)
+	Register(session string, client *Client)
 	Unregister(*Client)
-	Run()
+	UnregisterSession(session string)
 	UnregisterAll()
 }
 
 type fanout struct {
-	input   chan *fetcher.Tweet
-	clients map[*Client]bool
+	logger       log.Logger
+	statsdClient statsd.Statsd
+	buffer       fetcher.Backpressure
+
+	mutex   sync.RWMutex
+	clients map[*Client]string
+	history map[string][]*fetcher.Message
 }
 
-func NewFanout(input chan *fetcher.Tweet) Fanout {
+// NewFanout delivers messages to clients through buffers configured by
+// buffer. A blank buffer holds 256 messages and drops the oldest ones, so
+// that slow clients don't hold up the others.
+func NewFanout(logger log.Logger, statsdClient statsd.Statsd, buffer fetcher.Backpressure) Fanout {
+	if buffer.Size == 0 && buffer.Policy == "" {
+		buffer = fetcher.Backpressure{Size: defaultClientBufferSize, Policy: fetcher.BackpressureDropOldest}
+	}
 	return &fanout{
-		input:   input,
-		clients: make(map[*Client]bool),
+		logger:       logger.New("module", "fanout"),
+		statsdClient: statsdClient,
+		buffer:       buffer,
+		clients:      make(map[*Client]string),
+		history:      make(map[string][]*fetcher.Message),
 	}
 }
 
-func (f *fanout) Register(client *Client) {
-	f.clients[client] = true
+// Attach starts delivering messages from input to the clients subscribed to
+// session. Delivery stops once input is closed, so a session restarted with
+// a new query can be attached again without touching its clients. Heatmap
+// clients are told to clear their cells, as the new session counts anew.
+func (f *fanout) Attach(session string, input chan *fetcher.Message) {
+	f.mutex.Lock()
+	delete(f.history, session)
+	clients := f.subscribed(session)
+	f.mutex.Unlock()
+
+	for _, client := range clients {
+		if client.heatmap != nil {
+			f.send(client, client.reset())
+		}
+	}
+
+	go func() {
+		for msg := range input {
+			f.mutex.Lock()
+			f.remember(session, msg)
+			clients := f.subscribed(session)
+			f.mutex.Unlock()
+
+			for _, client := range clients {
+				if filtered := client.filter(msg); filtered != nil {
+					f.send(client, filtered)
+				}
+			}
+		}
+	}()
+}
+
+// Notify sends msg to the clients subscribed to session, but doesn't keep
+// it for clients connecting later.
+func (f *fanout) Notify(session string, msg *fetcher.Message) {
+	f.mutex.RLock()
+	clients := f.subscribed(session)
+	f.mutex.RUnlock()
+
+	for _, client := range clients {
+		if filtered := client.filter(msg); filtered != nil {
+			f.send(client, filtered)
+		}
+	}
+}
+
+// Register subscribes client to session and gives it a send buffer, which
+// starts out with the latest tweets of the session that fit, or with all
+// the cells of the frame for heatmap clients.
+func (f *fanout) Register(session string, client *Client) {
+	f.mutex.Lock()
+	client.send = f.buffer.Channel()
+	client.unregistered = make(chan struct{})
+	f.clients[client] = session
+	f.gaugeClients()
+
+	history := f.history[session]
+	if len(history) > f.buffer.Size {
+		history = history[len(history)-f.buffer.Size:]
+	}
+	// Messages attached meanwhile wait for the history, which already
+	// has the ones attached before.
+	client.sendMutex.Lock()
+	f.mutex.Unlock()
+	defer client.sendMutex.Unlock()
+
+	if client.heatmap != nil {
+		f.deliver(client, &fetcher.Message{Type: fetcher.MessageHeatmap, Heatmap: []fetcher.HeatmapFrame{*client.heatmap}})
+		return
+	}
+	for _, msg := range history {
+		f.deliver(client, msg)
+	}
 }
 
 func (f *fanout) Unregister(client *Client) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.unregister(client)
+}
+
+func (f *fanout) UnregisterSession(session string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for client, subscription := range f.clients {
+		if subscription == session {
+			f.unregister(client)
+		}
+	}
+	delete(f.history, session)
+}
+
+func (f *fanout) UnregisterAll() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for client, _ := range f.clients {
+		f.unregister(client)
+	}
+	f.history = make(map[string][]*fetcher.Message)
+}
+
+func (f *fanout) unregister(client *Client) {
 	if _, ok := f.clients[client]; ok {
+		close(client.unregistered)
+		client.sendMutex.Lock()
 		close(client.send)
+		client.sendMutex.Unlock()
+
 		delete(f.clients, client)
 		<-client.handledSendClose
+		f.gaugeClients()
 	}
 }
 
-func (f *fanout) Run() {
-	go func() {
-		for msg := range f.input {
-			for client, _ := range f.clients {
-				client.send <- msg
-			}
+// subscribed returns the clients subscribed to session.
+func (f *fanout) subscribed(session string) []*Client {
+	var clients []*Client
+	for client, subscription := range f.clients {
+		if subscription == session {
+			clients = append(clients, client)
 		}
-	}()
+	}
+	return clients
 }
 
-func (f *fanout) UnregisterAll() {
-	for client, _ := range f.clients {
-		f.Unregister(client)
+// gaugeClients emits how many clients are connected as clients.connected.
+func (f *fanout) gaugeClients() {
+	err := f.statsdClient.Gauge("clients.connected", int64(len(f.clients)))
+	if err != nil {
+		f.logger.Warn("Failed to emit metric clients.connected", "err", err)
 	}
 }
+
+func (f *fanout) send(client *Client, msg *fetcher.Message) {
+	client.sendMutex.Lock()
+	defer client.sendMutex.Unlock()
+
+	f.deliver(client, msg)
+}
+
+// deliver puts msg into the client's buffer unless the client has been
+// unregistered. The caller holds the client's sendMutex.
+func (f *fanout) deliver(client *Client, msg *fetcher.Message) {
+	select {
+	case <-client.unregistered:
+		return
+	default:
+	}
+
+	_, dropped := f.buffer.Send(client.send, msg, client.unregistered)
+	if dropped > 0 {
+		err := f.statsdClient.Incr("backpressure.client.dropped", int64(dropped))
+		if err != nil {
+			f.logger.Warn("Failed to emit metric backpressure.client.dropped", "err", err)
+		}
+	}
+}
+
+// remember keeps the latest tweets of a session and drops the ones that get
+// retracted, so they aren't replayed to clients connecting later.
+func (f *fanout) remember(session string, msg *fetcher.Message) {
+	history := f.history[session]
+
+	switch msg.Type {
+	case fetcher.MessageTweet:
+		history = append(history, msg)
+		if len(history) > historySize {
+			history = history[len(history)-historySize:]
+		}
+	case fetcher.MessageRetraction:
+		kept := history[:0]
+		for _, remembered := range history {
+			if !msg.Retraction.Retracts(remembered.Tweet) {
+				kept = append(kept, remembered)
+			}
+		}
+		history = kept
+	}
+
+	f.history[session] = history
+}
@@ -0,0 +1,97 @@
+package handlers_test
+
+import (
+	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
+
+	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/server/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fanout", func() {
+	var logger log.Logger
+
+	BeforeEach(func() {
+		logger = log.New()
+		logger.SetHandler(log.DiscardHandler())
+	})
+
+	tweet := func(id string) *fetcher.Message {
+		return &fetcher.Message{Type: fetcher.MessageTweet, Tweet: &fetcher.Tweet{Id: id}}
+	}
+
+	It("unregisters clients that never read when blocking", func() {
+		fanout := handlers.NewFanout(logger, &statsd.NoopClient{}, fetcher.Backpressure{Size: 1, Policy: fetcher.BackpressureBlock})
+		stuck := handlers.NewClient()
+		fanout.Register("default", stuck)
+
+		input := make(chan *fetcher.Message)
+		fanout.Attach("default", input)
+		defer close(input)
+		input <- tweet("10")
+		input <- tweet("11")
+		Consistently(stuck.Receive()).Should(HaveLen(1))
+
+		unregistered := make(chan struct{})
+		go func() {
+			fanout.Unregister(stuck)
+			close(unregistered)
+		}()
+		Eventually(unregistered).Should(BeClosed())
+
+		client := handlers.NewClient()
+		fanout.Register("default", client)
+		input <- tweet("12")
+		var message *fetcher.Message
+		Eventually(client.Receive()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("11"))
+		Eventually(client.Receive()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("12"))
+		fanout.UnregisterAll()
+	})
+
+	It("replays the history to clients before newer messages", func() {
+		fanout := handlers.NewFanout(logger, &statsd.NoopClient{}, fetcher.Backpressure{})
+		input := make(chan *fetcher.Message)
+		fanout.Attach("default", input)
+		defer close(input)
+		input <- tweet("10")
+
+		client := handlers.NewClient()
+		fanout.Register("default", client)
+		input <- tweet("11")
+
+		var message *fetcher.Message
+		Eventually(client.Receive()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("10"))
+		Eventually(client.Receive()).Should(Receive(&message))
+		Expect(message.Tweet.Id).To(Equal("11"))
+		fanout.UnregisterAll()
+	})
+
+	It("notifies the clients of the session without replaying it", func() {
+		fanout := handlers.NewFanout(logger, &statsd.NoopClient{}, fetcher.Backpressure{})
+		client := handlers.NewClient()
+		fanout.Register("default", client)
+		other := handlers.NewClient()
+		fanout.Register("other", other)
+
+		change := fetcher.StateChange{Session: "default", From: fetcher.StateConnecting, To: fetcher.StateStreaming}
+		fanout.Notify("default", change.Message())
+
+		var message *fetcher.Message
+		Eventually(client.Receive()).Should(Receive(&message))
+		Expect(message.Type).To(Equal(fetcher.MessageStatus))
+		Expect(message.Status.Kind).To(Equal(fetcher.StatusState))
+		Expect(message.Status.State).To(Equal(fetcher.StateStreaming))
+		Consistently(other.Receive()).ShouldNot(Receive())
+
+		later := handlers.NewClient()
+		fanout.Register("default", later)
+		Consistently(later.Receive()).ShouldNot(Receive())
+		fanout.UnregisterAll()
+	})
+})
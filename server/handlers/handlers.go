@@ -1,15 +1,25 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/inconshreveable/log15"
 
 	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/recorder"
+	"github.com/Altoros/tweets-fetcher/scheduler"
+	"github.com/Altoros/tweets-fetcher/series"
 )
 
 var (
@@ -22,7 +32,13 @@ var (
 	homeTemplate *template.Template
 )
 
-func New(logger log.Logger, fetcher fetcher.Fetcher, fanout Fanout, templatesPath string) http.Handler {
+const (
+	defaultSession = "default"
+	// defaultSeriesRange is how far back series go unless asked for.
+	defaultSeriesRange = 10 * time.Minute
+)
+
+func New(logger log.Logger, fetcher fetcher.Fetcher, scheduler scheduler.Scheduler, fanout Fanout, series series.Store, templatesPath string) http.Handler {
 	var err error
 
 	mux := http.NewServeMux()
@@ -31,9 +47,11 @@ func New(logger log.Logger, fetcher fetcher.Fetcher, fanout Fanout, templatesPat
 		panic(err)
 	}
 	handler := &fetcherHandler{
-		logger:  logger,
-		fetcher: fetcher,
-		fanout:  fanout,
+		logger:    logger,
+		fetcher:   fetcher,
+		scheduler: scheduler,
+		fanout:    fanout,
+		series:    series,
 	}
 	AttachRoutes(mux, handler)
 	return mux
@@ -44,15 +62,30 @@ func AttachRoutes(mux *http.ServeMux, handler *fetcherHandler) {
 	mux.HandleFunc("/query", handler.query)
 	mux.HandleFunc("/fetch", handler.fetch)
 	mux.HandleFunc("/stop", handler.stop)
+	mux.HandleFunc("/sessions", handler.sessions)
+	mux.HandleFunc("/recording/start", handler.startRecording)
+	mux.HandleFunc("/recording/stop", handler.stopRecording)
+	mux.HandleFunc("/replay/pause", handler.pauseReplay)
+	mux.HandleFunc("/replay/resume", handler.resumeReplay)
+	mux.HandleFunc("/replay/seek", handler.seekReplay)
+	mux.HandleFunc("/trending", handler.trending)
+	mux.HandleFunc("/api/heatmap", handler.heatmap)
+	mux.HandleFunc("/api/stats/countries", handler.countries)
+	mux.HandleFunc("/api/series", handler.timeSeries)
+	mux.HandleFunc("/schedule", handler.schedule)
+	mux.HandleFunc("/schedule/cancel", handler.cancelSchedule)
+	mux.HandleFunc("/schedules", handler.schedules)
 	mux.HandleFunc("/tweets", handler.tweets)
 	staticHandler := http.FileServer(http.Dir("static"))
 	mux.Handle("/static/", http.StripPrefix("/static/", staticHandler))
 }
 
 type fetcherHandler struct {
-	logger  log.Logger
-	fetcher fetcher.Fetcher
-	fanout  Fanout
+	logger    log.Logger
+	fetcher   fetcher.Fetcher
+	scheduler scheduler.Scheduler
+	fanout    Fanout
+	series    series.Store
 }
 
 func (h *fetcherHandler) home(w http.ResponseWriter, r *http.Request) {
@@ -73,13 +106,60 @@ func (h *fetcherHandler) home(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sessionResponse describes an active session. Description is the query in
+// a form suitable for showing to people, State tells whether the session is
+// streaming or trying to connect.
+type sessionResponse struct {
+	Id          string
+	Query       fetcher.Query
+	Description string
+	State       fetcher.State
+	Recording   *recorder.Status
+	Replay      *fetcher.ReplayStatus `json:",omitempty"`
+}
+
+func newSessionResponse(session fetcher.Session) *sessionResponse {
+	response := &sessionResponse{
+		Id:          session.ID(),
+		Query:       session.Query(),
+		Description: session.Query().String(),
+		State:       session.State(),
+	}
+	if status, ok := session.Recording(); ok {
+		response.Recording = &status
+	}
+	if replay, ok := session.Replay(); ok {
+		status := replay.Status()
+		response.Replay = &status
+	}
+	return response
+}
+
+// query responds with the session's active filters, or null if the session
+// isn't fetching anything.
 func (h *fetcherHandler) query(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(h.fetcher.CurrentQuery()))
+	var response *sessionResponse
+	if session, ok := h.fetcher.Session(sessionID(r)); ok {
+		response = newSessionResponse(session)
+	}
+	h.writeJSON(w, response)
+}
+
+func (h *fetcherHandler) sessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []*sessionResponse{}
+	for _, session := range h.fetcher.Sessions() {
+		sessions = append(sessions, newSessionResponse(session))
+	}
+	h.writeJSON(w, sessions)
 }
 
 func (h *fetcherHandler) fetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	if r.Body == nil {
-		http.Error(w, "Request body is empty", http.StatusBadRequest)
+		h.writeFetchError(w, &fetcher.FetchError{Kind: fetcher.ErrorInvalidQuery, Message: "Request body is empty"})
 		return
 	}
 
@@ -87,23 +167,374 @@ func (h *fetcherHandler) fetch(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		h.logger.Error("Error reading request body", "err", err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
 	defer r.Body.Close()
 
-	query := string(body)
-	if query == "" {
-		http.Error(w, "Query can't be blank", http.StatusBadRequest)
+	query, err := parseQuery(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		h.writeFetchError(w, &fetcher.FetchError{Kind: fetcher.ErrorInvalidQuery, Message: err.Error()})
+		return
 	}
 
-	h.fetcher.Fetch(query)
+	_, err = h.fetcher.Fetch(sessionID(r), query)
+	if err != nil {
+		h.writeFetchError(w, err)
+	}
+}
+
+// fetchErrorResponse is the body of failed /fetch requests. RetryAfter is
+// in seconds.
+type fetchErrorResponse struct {
+	Error      string
+	Message    string
+	RetryAfter int `json:",omitempty"`
+}
+
+// fetchErrorStatuses maps the kinds of fetcher.FetchError to HTTP statuses.
+var fetchErrorStatuses = map[string]int{
+	fetcher.ErrorInvalidQuery: http.StatusBadRequest,
+	fetcher.ErrorUnauthorized: http.StatusBadGateway,
+	fetcher.ErrorRateLimited:  http.StatusTooManyRequests,
+	fetcher.ErrorUnavailable:  http.StatusServiceUnavailable,
+}
+
+func (h *fetcherHandler) writeFetchError(w http.ResponseWriter, err error) {
+	fetchErr, ok := err.(*fetcher.FetchError)
+	if !ok {
+		fetchErr = &fetcher.FetchError{Kind: fetcher.ErrorUnavailable, Message: err.Error()}
+	}
+	status, ok := fetchErrorStatuses[fetchErr.Kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	response := fetchErrorResponse{
+		Error:   fetchErr.Kind,
+		Message: fetchErr.Message,
+	}
+	if fetchErr.RetryAfter > 0 {
+		response.RetryAfter = int(fetchErr.RetryAfter / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfter))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	h.writeJSON(w, response)
 }
 
 func (h *fetcherHandler) stop(w http.ResponseWriter, r *http.Request) {
-	h.fetcher.Stop()
-	h.fanout.UnregisterAll()
+	id := sessionID(r)
+	h.fetcher.Stop(id)
+	h.fanout.UnregisterSession(id)
 }
 
+// recordingRequest holds recorder.Options with MaxAge given as a duration
+// string, e.g. "1h".
+type recordingRequest struct {
+	MaxSize int64
+	MaxAge  string
+	Gzip    bool
+}
+
+func (h *fetcherHandler) startRecording(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request recordingRequest
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Invalid recording options: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	options := recorder.Options{
+		MaxSize: request.MaxSize,
+		Gzip:    request.Gzip,
+	}
+	if request.MaxAge != "" {
+		maxAge, err := time.ParseDuration(request.MaxAge)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid recording options: %s", err), http.StatusBadRequest)
+			return
+		}
+		options.MaxAge = maxAge
+	}
+
+	status, err := h.fetcher.StartRecording(sessionID(r), options)
+	if err != nil {
+		h.recordingError(w, err)
+		return
+	}
+	h.writeJSON(w, status)
+}
+
+func (h *fetcherHandler) stopRecording(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.fetcher.StopRecording(sessionID(r))
+	if err != nil {
+		h.recordingError(w, err)
+		return
+	}
+	h.writeJSON(w, status)
+}
+
+func (h *fetcherHandler) recordingError(w http.ResponseWriter, err error) {
+	switch err {
+	case fetcher.ErrSessionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case fetcher.ErrAlreadyRecording, fetcher.ErrNotRecording:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		h.logger.Error("Error recording session", "err", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}
+}
+
+func (h *fetcherHandler) pauseReplay(w http.ResponseWriter, r *http.Request) {
+	h.controlReplay(w, r, func(replay fetcher.Replay) {
+		replay.Pause()
+	})
+}
+
+func (h *fetcherHandler) resumeReplay(w http.ResponseWriter, r *http.Request) {
+	h.controlReplay(w, r, func(replay fetcher.Replay) {
+		replay.Resume()
+	})
+}
+
+// seekReplay moves the replay to the position given as a duration string,
+// e.g. /replay/seek?to=1m30s.
+func (h *fetcherHandler) seekReplay(w http.ResponseWriter, r *http.Request) {
+	position, err := time.ParseDuration(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid position: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	h.controlReplay(w, r, func(replay fetcher.Replay) {
+		replay.Seek(position)
+	})
+}
+
+// controlReplay applies control to the requested session's replay and
+// responds with the replay's status.
+func (h *fetcherHandler) controlReplay(w http.ResponseWriter, r *http.Request, control func(fetcher.Replay)) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := h.fetcher.Session(sessionID(r))
+	if !ok {
+		http.Error(w, fetcher.ErrSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	replay, ok := session.Replay()
+	if !ok {
+		http.Error(w, "Session isn't replaying a recording", http.StatusConflict)
+		return
+	}
+
+	control(replay)
+	h.writeJSON(w, replay.Status())
+}
+
+// trending responds with the session's top terms for every window, or for
+// the one asked for, e.g. /trending?window=5m.
+func (h *fetcherHandler) trending(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fetcher.Session(sessionID(r))
+	if !ok {
+		http.Error(w, fetcher.ErrSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	trending := session.Trending()
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		h.writeJSON(w, trending)
+		return
+	}
+	for _, t := range trending {
+		if t.Window == window {
+			h.writeJSON(w, t)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("Unknown window %q", window), http.StatusBadRequest)
+}
+
+// heatmap responds with the geohash cells of the session's tweets at a
+// precision over a window, e.g. /api/heatmap?precision=4&window=1h. Both
+// default to the first ones configured.
+func (h *fetcherHandler) heatmap(w http.ResponseWriter, r *http.Request) {
+	frame, status, err := h.heatmapFrame(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	h.writeJSON(w, frame)
+}
+
+// heatmapFrame looks up the heatmap frame a request asks for. On failure
+// it returns the status to respond with.
+func (h *fetcherHandler) heatmapFrame(r *http.Request) (fetcher.HeatmapFrame, int, error) {
+	session, ok := h.fetcher.Session(sessionID(r))
+	if !ok {
+		return fetcher.HeatmapFrame{}, http.StatusNotFound, fetcher.ErrSessionNotFound
+	}
+
+	precision := 0
+	if value := r.URL.Query().Get("precision"); value != "" {
+		var err error
+		precision, err = strconv.Atoi(value)
+		if err != nil || precision <= 0 {
+			return fetcher.HeatmapFrame{}, http.StatusBadRequest, fmt.Errorf("Invalid precision %q", value)
+		}
+	}
+	window := r.URL.Query().Get("window")
+
+	frame, ok := session.Heatmap(window, precision)
+	if !ok {
+		return fetcher.HeatmapFrame{}, http.StatusBadRequest, fmt.Errorf("Unknown heatmap window %q or precision %d", window, precision)
+	}
+	return frame, http.StatusOK, nil
+}
+
+// countries responds with where the session's live tweets were sent from,
+// most tweets first.
+func (h *fetcherHandler) countries(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fetcher.Session(sessionID(r))
+	if !ok {
+		http.Error(w, fetcher.ErrSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	h.writeJSON(w, session.Countries())
+}
+
+// timeSeries responds with the points of a metric, e.g.
+// /api/series?metric=totalTweets&from=-1h&step=1m, or lists the metrics
+// without one. from and to are RFC 3339 times, Unix seconds or durations
+// relative to now, the last 10 minutes by default.
+func (h *fetcherHandler) timeSeries(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	metric := params.Get("metric")
+	if metric == "" {
+		h.writeJSON(w, h.series.Metrics())
+		return
+	}
+
+	now := time.Now()
+	from, err := parseSeriesTime(params.Get("from"), now, now.Add(-defaultSeriesRange))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid from: %s", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseSeriesTime(params.Get("to"), now, now)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid to: %s", err), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if value := params.Get("step"); value != "" {
+		step, err = time.ParseDuration(value)
+		if err != nil || step <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid step %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.series.Query(metric, from, to, step)
+	if err == series.ErrUnknownMetric {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.writeJSON(w, result)
+}
+
+// schedule responds with the status of the session's schedule, or starts
+// the schedule given as JSON when POSTed.
+func (h *fetcherHandler) schedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		var response *scheduler.Status
+		if status, ok := h.scheduler.Status(sessionID(r)); ok {
+			response = &status
+		}
+		h.writeJSON(w, response)
+		return
+	}
+
+	if r.Body == nil {
+		http.Error(w, "Request body is empty", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var schedule scheduler.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	status, err := h.scheduler.Schedule(sessionID(r), schedule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.writeJSON(w, status)
+}
+
+func (h *fetcherHandler) cancelSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := sessionID(r)
+	if !h.scheduler.Cancel(id) {
+		http.Error(w, "Session isn't running a schedule", http.StatusNotFound)
+		return
+	}
+	status, _ := h.scheduler.Status(id)
+	h.writeJSON(w, status)
+}
+
+func (h *fetcherHandler) schedules(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.scheduler.Statuses())
+}
+
+// tweets streams the session's messages over a websocket. With
+// mode=heatmap clients are sent the cells of a heatmap frame as they change
+// instead of tweets, taking the same parameters as /api/heatmap.
 func (h *fetcherHandler) tweets(w http.ResponseWriter, r *http.Request) {
+	var heatmap *fetcher.HeatmapFrame
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "tweets":
+	case "heatmap":
+		frame, status, err := h.heatmapFrame(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		heatmap = &frame
+	default:
+		http.Error(w, fmt.Sprintf("Unknown mode %q", mode), http.StatusBadRequest)
+		return
+	}
+
 	connection, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Error("Error upgrading websocket", "err", err)
@@ -111,16 +542,17 @@ func (h *fetcherHandler) tweets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.logger.Info("New client connected")
+	id := sessionID(r)
+	h.logger.Info("New client connected", "session", id)
 
 	client := &Client{
 		connection:       connection,
-		send:             make(chan *fetcher.Tweet, 256),
-		err:              make(chan error),
-		done:             make(chan bool),
+		err:              make(chan error, 2),
+		done:             make(chan bool, 1),
 		handledSendClose: make(chan bool),
+		heatmap:          heatmap,
 	}
-	h.fanout.Register(client)
+	h.fanout.Register(id, client)
 	defer h.fanout.Unregister(client)
 
 	go client.writePump()
@@ -135,3 +567,65 @@ func (h *fetcherHandler) tweets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (h *fetcherHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		h.logger.Error("Error encoding response", "err", err)
+	}
+}
+
+// parseQuery accepts either a JSON encoded fetcher.Query or, for plain
+// bodies, a query expression.
+func parseQuery(contentType string, body []byte) (fetcher.Query, error) {
+	var query fetcher.Query
+
+	if strings.HasPrefix(contentType, "application/json") {
+		if err := json.Unmarshal(body, &query); err != nil {
+			return query, fmt.Errorf("Invalid query: %s", err)
+		}
+	} else {
+		if len(strings.TrimSpace(string(body))) == 0 {
+			return query, errors.New("Query can't be blank")
+		}
+		query.Expression = string(body)
+	}
+
+	if err := query.Compile(); err != nil {
+		return query, err
+	}
+	return query, query.Validate()
+}
+
+// parseSeriesTime parses an RFC 3339 time, Unix seconds, a duration
+// relative to now such as -10m, or now itself. Blank values are
+// defaultTime.
+func parseSeriesTime(value string, now time.Time, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+	if value == "now" {
+		return now, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if offset, err := time.ParseDuration(value); err == nil {
+		return now.Add(offset), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time, Unix seconds nor a duration", value)
+	}
+	return t, nil
+}
+
+// sessionID returns the session a request refers to. Requests that don't
+// name one share the default session, as the home page does.
+func sessionID(r *http.Request) string {
+	if id := r.URL.Query().Get("session"); id != "" {
+		return id
+	}
+	return defaultSession
+}
@@ -2,62 +2,276 @@ package handlers_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
 	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/recorder"
+	"github.com/Altoros/tweets-fetcher/scheduler"
+	"github.com/Altoros/tweets-fetcher/series"
 	"github.com/Altoros/tweets-fetcher/server/handlers"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+type fakeSession struct {
+	id        string
+	query     fetcher.Query
+	recording *recorder.Status
+	replay    *fakeReplay
+	state     fetcher.State
+	trending  []fetcher.Trending
+	heatmap   []fetcher.HeatmapFrame
+	countries fetcher.CountryStats
+}
+
+func (fs *fakeSession) ID() string {
+	return fs.id
+}
+
+func (fs *fakeSession) Query() fetcher.Query {
+	return fs.query
+}
+
+func (fs *fakeSession) Messages() chan *fetcher.Message {
+	return make(chan *fetcher.Message)
+}
+
+func (fs *fakeSession) Recording() (recorder.Status, bool) {
+	if fs.recording == nil {
+		return recorder.Status{}, false
+	}
+	return *fs.recording, true
+}
+
+func (fs *fakeSession) State() fetcher.State {
+	return fs.state
+}
+
+func (fs *fakeSession) Tweets() int64 {
+	return 0
+}
+
+func (fs *fakeSession) Trending() []fetcher.Trending {
+	return fs.trending
+}
+
+// Heatmap looks the frame up in heatmap, the first one standing in for
+// blank parameters.
+func (fs *fakeSession) Heatmap(window string, precision int) (fetcher.HeatmapFrame, bool) {
+	for _, frame := range fs.heatmap {
+		if (window == "" || frame.Window == window) && (precision == 0 || frame.Precision == precision) {
+			return frame, true
+		}
+	}
+	return fetcher.HeatmapFrame{}, false
+}
+
+func (fs *fakeSession) Countries() fetcher.CountryStats {
+	return fs.countries
+}
+
+func (fs *fakeSession) Replay() (fetcher.Replay, bool) {
+	if fs.replay == nil {
+		return nil, false
+	}
+	return fs.replay, true
+}
+
+type fakeReplay struct {
+	status fetcher.ReplayStatus
+}
+
+func (fr *fakeReplay) Pause() {
+	fr.status.Paused = true
+}
+
+func (fr *fakeReplay) Resume() {
+	fr.status.Paused = false
+}
+
+func (fr *fakeReplay) Seek(position time.Duration) {
+	fr.status.Position = position
+}
+
+func (fr *fakeReplay) Status() fetcher.ReplayStatus {
+	return fr.status
+}
+
 type fakeFetcher struct {
-	query string
+	sessions map[string]*fakeSession
+	err      error
 }
 
-func (ff *fakeFetcher) Fetch(query string) {
-	ff.query = query
+func (ff *fakeFetcher) Fetch(id string, query fetcher.Query) (fetcher.Session, error) {
+	if ff.err != nil {
+		return nil, ff.err
+	}
+	session := &fakeSession{id: id, query: query, state: fetcher.StateStreaming}
+	if query.IsReplay() {
+		session.replay = &fakeReplay{status: fetcher.ReplayStatus{File: query.Replay.File, Speed: query.Replay.Speed}}
+	}
+	ff.sessions[id] = session
+	return session, nil
 }
 
-func (ff *fakeFetcher) Stop() {
-	ff.query = ""
+func (ff *fakeFetcher) FetchTransient(id string, query fetcher.Query) (fetcher.Session, error) {
+	return ff.Fetch(id, query)
 }
 
-func (ff *fakeFetcher) Tweets() chan *fetcher.Tweet {
-	return make(chan *fetcher.Tweet)
+func (ff *fakeFetcher) Stop(id string) {
+	delete(ff.sessions, id)
 }
 
-func (ff *fakeFetcher) CurrentQuery() string {
-	return ff.query
+func (ff *fakeFetcher) StopAll() {
+	ff.sessions = make(map[string]*fakeSession)
 }
 
-type fakeFanout struct {
+func (ff *fakeFetcher) Session(id string) (fetcher.Session, bool) {
+	session, ok := ff.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	return session, true
 }
 
-func (ffo *fakeFanout) Register(client *handlers.Client) {
+func (ff *fakeFetcher) Sessions() []fetcher.Session {
+	sessions := []fetcher.Session{}
+	for _, session := range ff.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (ff *fakeFetcher) StartRecording(id string, options recorder.Options) (recorder.Status, error) {
+	session, ok := ff.sessions[id]
+	if !ok {
+		return recorder.Status{}, fetcher.ErrSessionNotFound
+	}
+	if session.recording != nil {
+		return recorder.Status{}, fetcher.ErrAlreadyRecording
+	}
+	session.recording = &recorder.Status{Options: options, File: "recordings/" + id + ".jsonl"}
+	return *session.recording, nil
+}
+
+func (ff *fakeFetcher) StopRecording(id string) (recorder.Status, error) {
+	session, ok := ff.sessions[id]
+	if !ok {
+		return recorder.Status{}, fetcher.ErrSessionNotFound
+	}
+	if session.recording == nil {
+		return recorder.Status{}, fetcher.ErrNotRecording
+	}
+	status := *session.recording
+	session.recording = nil
+	return status, nil
+}
+
+func (ff *fakeFetcher) OnSessionStart(listener func(fetcher.Session)) {
+}
+
+func (ff *fakeFetcher) OnStateChange(listener func(fetcher.StateChange)) {
+}
+
+func (ff *fakeFetcher) Restore() (int, error) {
+	return 0, nil
+}
+
+func (ff *fakeFetcher) query(id string) fetcher.Query {
+	session, ok := ff.sessions[id]
+	if !ok {
+		return fetcher.Query{}
+	}
+	return session.query
+}
+
+type fakeScheduler struct {
+	schedules map[string]scheduler.Schedule
+	statuses  map[string]scheduler.Status
+}
+
+func (fs *fakeScheduler) Schedule(id string, schedule scheduler.Schedule) (scheduler.Status, error) {
+	if err := schedule.Validate(); err != nil {
+		return scheduler.Status{}, err
+	}
+	fs.schedules[id] = schedule
+	fs.statuses[id] = scheduler.Status{Session: id, State: scheduler.StateRunning, Step: 1, Steps: len(schedule.Steps)}
+	return fs.statuses[id], nil
+}
+
+func (fs *fakeScheduler) Cancel(id string) bool {
+	status, ok := fs.statuses[id]
+	if !ok || status.State != scheduler.StateRunning {
+		return false
+	}
+	status.State = scheduler.StateCancelled
+	fs.statuses[id] = status
+	return true
+}
+
+func (fs *fakeScheduler) Status(id string) (scheduler.Status, bool) {
+	status, ok := fs.statuses[id]
+	return status, ok
+}
+
+func (fs *fakeScheduler) Statuses() []scheduler.Status {
+	statuses := []scheduler.Status{}
+	for _, status := range fs.statuses {
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (fs *fakeScheduler) StopAll() {
+}
+
+type fakeFanout struct{}
+
+func (ffo *fakeFanout) Attach(session string, input chan *fetcher.Message) {
+}
+
+func (ffo *fakeFanout) Notify(session string, msg *fetcher.Message) {
+}
+
+func (ffo *fakeFanout) Register(session string, client *handlers.Client) {
 }
 
 func (ffo *fakeFanout) Unregister(client *handlers.Client) {
 }
 
-func (ffo *fakeFanout) Run() {
+func (ffo *fakeFanout) UnregisterSession(session string) {
 }
 
 func (ffo *fakeFanout) UnregisterAll() {
 }
 
+func track(terms ...string) fetcher.Query {
+	return fetcher.Query{Track: terms}
+}
+
 var _ = Describe("Fetcher handlers", func() {
-	var api http.Handler
-	fetcher := &fakeFetcher{}
-	fanout := &fakeFanout{}
+	var (
+		api            http.Handler
+		tweetFetcher   *fakeFetcher
+		tweetScheduler *fakeScheduler
+		fanout         *fakeFanout
+		seriesStore    series.Store
+	)
 
 	BeforeEach(func() {
+		tweetFetcher = &fakeFetcher{sessions: make(map[string]*fakeSession)}
+		tweetScheduler = &fakeScheduler{schedules: make(map[string]scheduler.Schedule), statuses: make(map[string]scheduler.Status)}
+		fanout = &fakeFanout{}
 		logger := log.New()
 		logger.SetHandler(log.DiscardHandler())
-		api = handlers.New(logger, fetcher, fanout, "../../templates")
+		seriesStore = series.New(series.Config{})
+		api = handlers.New(logger, tweetFetcher, tweetScheduler, fanout, seriesStore, "../../templates")
 	})
 
 	Describe("home", func() {
@@ -87,16 +301,136 @@ var _ = Describe("Fetcher handlers", func() {
 			req, err := http.NewRequest("GET", "/query", nil)
 			Expect(err).NotTo(HaveOccurred())
 
-			fetcher.query = "test"
+			tweetFetcher.Fetch("default", track("test"))
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(MatchJSON(`{
+				"Id": "default",
+				"Query": {"Mode": "", "Track": ["test"], "Locations": null, "Language": null, "Follow": null},
+				"Description": "test",
+				"State": "streaming",
+				"Recording": null
+			}`))
+		})
+
+		It("returns the state of the session", func() {
+			req, err := http.NewRequest("GET", "/query", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			tweetFetcher.Fetch("default", track("test"))
+			tweetFetcher.sessions["default"].state = fetcher.StateBackingOff
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(ContainSubstring(`"State":"backing-off"`))
+		})
+
+		It("returns the expression along with the track terms derived from it", func() {
+			req, err := http.NewRequest("GET", "/query", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			query := fetcher.Query{Expression: "golang -job"}
+			Expect(query.Compile()).To(Succeed())
+			tweetFetcher.Fetch("default", query)
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(ContainSubstring(`"Expression":"golang -job","Track":["golang"]`))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Description":"golang -job"`))
+		})
+
+		It("returns query of the requested session", func() {
+			req, err := http.NewRequest("GET", "/query?session=other", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			tweetFetcher.Fetch("default", track("test"))
+			tweetFetcher.Fetch("other", track("other test"))
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(ContainSubstring(`"Description":"other test"`))
+		})
+
+		It("reports sample mode", func() {
+			req, err := http.NewRequest("GET", "/query", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			tweetFetcher.Fetch("default", fetcher.Query{Mode: fetcher.ModeSample})
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(ContainSubstring(`"Mode":"sample"`))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Description":"a sample of all tweets"`))
+		})
+
+		It("returns null if session doesn't exist", func() {
+			req, err := http.NewRequest("GET", "/query?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON("null"))
+		})
+	})
+
+	Describe("sessions", func() {
+		It("lists active sessions", func() {
+			req, err := http.NewRequest("GET", "/sessions", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			tweetFetcher.Fetch("default", track("test"))
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`[{
+				"Id": "default",
+				"Query": {"Mode": "", "Track": ["test"], "Locations": null, "Language": null, "Follow": null},
+				"Description": "test",
+				"State": "streaming",
+				"Recording": null
+			}]`))
+		})
+	})
+
+	Describe("stop", func() {
+		It("stops only the requested session", func() {
+			req, err := http.NewRequest("POST", "/stop?session=other", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			tweetFetcher.Fetch("default", track("test"))
+			tweetFetcher.Fetch("other", track("other test"))
 
 			rr := httptest.NewRecorder()
 			api.ServeHTTP(rr, req)
 
-			Expect(rr.Body.String()).To(Equal("test"))
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions).To(HaveKey("default"))
+			Expect(tweetFetcher.sessions).NotTo(HaveKey("other"))
 		})
 	})
 
 	Describe("fetch", func() {
+		It("returns MethodNotAllowed if not POST", func() {
+			req, err := http.NewRequest("GET", "/fetch", bytes.NewBufferString("golang"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(tweetFetcher.sessions).To(BeEmpty())
+		})
+
 		It("returns 400 if no query provided", func() {
 			req, err := http.NewRequest("POST", "/fetch", nil)
 			Expect(err).NotTo(HaveOccurred())
@@ -105,7 +439,7 @@ var _ = Describe("Fetcher handlers", func() {
 			api.ServeHTTP(rr, req)
 
 			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
-			Expect(rr.Body.String()).To(Equal("Request body is empty\n"))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Error": "invalid-query", "Message": "Request body is empty"}`))
 		})
 
 		It("returns 400 if query is empty", func() {
@@ -118,7 +452,45 @@ var _ = Describe("Fetcher handlers", func() {
 			api.ServeHTTP(rr, req)
 
 			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
-			Expect(rr.Body.String()).To(Equal("Query can't be blank\n"))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Error": "invalid-query", "Message": "Query can't be blank"}`))
+		})
+
+		It("reports sessions that failed to start", func() {
+			tweetFetcher.err = &fetcher.FetchError{Kind: fetcher.ErrorRateLimited, Message: "Twitter is rate limiting the app: 420", RetryAfter: 90 * time.Second}
+			req, err := http.NewRequest("POST", "/fetch", bytes.NewBufferString("test"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusTooManyRequests))
+			Expect(rr.Header().Get("Retry-After")).To(Equal("90"))
+			Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(rr.Body.String()).To(MatchJSON(`{
+				"Error": "rate-limited",
+				"Message": "Twitter is rate limiting the app: 420",
+				"RetryAfter": 90
+			}`))
+		})
+
+		It("maps failures to start onto statuses", func() {
+			statuses := map[string]int{
+				fetcher.ErrorInvalidQuery: http.StatusBadRequest,
+				fetcher.ErrorUnauthorized: http.StatusBadGateway,
+				fetcher.ErrorUnavailable:  http.StatusServiceUnavailable,
+			}
+			for kind, status := range statuses {
+				tweetFetcher.err = &fetcher.FetchError{Kind: kind, Message: "failed"}
+				req, err := http.NewRequest("POST", "/fetch", bytes.NewBufferString("test"))
+				Expect(err).NotTo(HaveOccurred())
+
+				rr := httptest.NewRecorder()
+				api.ServeHTTP(rr, req)
+
+				Ω(rr.Code).Should(Equal(status))
+				Expect(rr.Body.String()).To(ContainSubstring(`"Error":"` + kind + `"`))
+				Expect(rr.Header().Get("Retry-After")).To(BeEmpty())
+			}
 		})
 
 		It("updates fetcher's current query if query specified", func() {
@@ -131,7 +503,688 @@ var _ = Describe("Fetcher handlers", func() {
 			api.ServeHTTP(rr, req)
 
 			Ω(rr.Code).Should(Equal(http.StatusOK))
-			Expect(fetcher.query).To(Equal("query"))
+			Expect(tweetFetcher.query("default").Expression).To(Equal("query"))
+			Expect(tweetFetcher.query("default").Track).To(Equal([]string{"query"}))
+		})
+
+		It("starts the session named in the request", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString("query")
+			req, err := http.NewRequest("POST", "/fetch?session=other", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("other").Track).To(Equal([]string{"query"}))
+			Expect(tweetFetcher.query("default")).To(Equal(fetcher.Query{}))
+		})
+
+		It("accepts JSON encoded queries with locations", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Track": ["beer"], "Locations": [{"SouthWest": {"Lat": 52.33, "Long": 13.08}, "NorthEast": {"Lat": 52.67, "Long": 13.76}}]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default")).To(Equal(fetcher.Query{
+				Track: []string{"beer"},
+				Locations: []fetcher.BoundingBox{{
+					SouthWest: fetcher.Coordinates{Lat: 52.33, Long: 13.08},
+					NorthEast: fetcher.Coordinates{Lat: 52.67, Long: 13.76},
+				}},
+			}))
+		})
+
+		It("accepts language and accounts to follow", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Follow": ["@golang"], "Language": ["en"]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default")).To(Equal(fetcher.Query{
+				Follow:   []string{"@golang"},
+				Language: []string{"en"},
+			}))
+		})
+
+		It("accepts sample mode", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Mode": "sample"}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default").IsSample()).To(BeTrue())
+		})
+
+		It("returns 400 if sample mode is given track terms", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Mode": "sample", "Track": ["beer"]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Error":"invalid-query"`))
+		})
+
+		It("returns 400 if only language is given", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Language": ["en"]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Error": "invalid-query", "Message": "Query can't be blank"}`))
+		})
+
+		It("returns 400 if JSON encoded query is invalid", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Locations": [{"SouthWest": {"Lat": 52.67, "Long": 13.76}, "NorthEast": {"Lat": 52.33, "Long": 13.08}}]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Error":"invalid-query"`))
+			Expect(rr.Body.String()).To(ContainSubstring("must go from south-west to north-east"))
+		})
+
+		It("accepts query expressions", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`golang AND (docker OR kubernetes) -job`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default").Track).To(Equal([]string{"golang docker", "golang kubernetes"}))
+		})
+
+		It("returns 400 with the position of expression errors", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`golang AND (docker OR`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Error": "invalid-query", "Message": "Invalid expression: expected a word, phrase or \"(\" instead of end of expression at position 22"}`))
+		})
+
+		It("accepts JSON encoded expressions", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Expression": "\"craft beer\" -ipa", "Language": ["en"]}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default").Track).To(Equal([]string{"craft beer"}))
+		})
+
+		It("returns 400 if expression only excludes words", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`-job`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Error":"invalid-query"`))
+		})
+
+		It("accepts backfill", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Track": ["beer"], "Backfill": 50}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default").Backfill).To(Equal(50))
+		})
+
+		It("returns 400 if backfill is too big", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Track": ["beer"], "Backfill": 1000}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Error": "invalid-query", "Message": "Backfill has to be between 0 and 100"}`))
+		})
+
+		It("accepts replay mode", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Mode": "replay", "Replay": {"File": "default.jsonl", "Speed": 10}}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.query("default").Replay).To(Equal(&fetcher.ReplayOptions{File: "default.jsonl", Speed: 10}))
+		})
+
+		It("returns 400 if replay is given a path", func() {
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"Mode": "replay", "Replay": {"File": "../secrets.jsonl"}}`)
+			req, err := http.NewRequest("POST", "/fetch", buffer)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Error":"invalid-query"`))
+		})
+	})
+
+	Describe("recording", func() {
+		It("starts recording the session with given options", func() {
+			tweetFetcher.Fetch("default", track("test"))
+
+			buffer := &bytes.Buffer{}
+			buffer.WriteString(`{"MaxSize": 1024, "MaxAge": "1h", "Gzip": true}`)
+			req, err := http.NewRequest("POST", "/recording/start", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions["default"].recording.Options).To(Equal(recorder.Options{
+				MaxSize: 1024,
+				MaxAge:  time.Hour,
+				Gzip:    true,
+			}))
+		})
+
+		It("starts recording without options", func() {
+			tweetFetcher.Fetch("default", track("test"))
+
+			req, err := http.NewRequest("POST", "/recording/start", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions["default"].recording).NotTo(BeNil())
+		})
+
+		It("returns 404 if session doesn't exist", func() {
+			req, err := http.NewRequest("POST", "/recording/start?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("returns 409 if session isn't being recorded", func() {
+			tweetFetcher.Fetch("default", track("test"))
+
+			req, err := http.NewRequest("POST", "/recording/stop", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusConflict))
+		})
+
+		It("stops recording", func() {
+			tweetFetcher.Fetch("default", track("test"))
+			tweetFetcher.StartRecording("default", recorder.Options{})
+
+			req, err := http.NewRequest("POST", "/recording/stop", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions["default"].recording).To(BeNil())
+		})
+	})
+
+	Describe("trending", func() {
+		BeforeEach(func() {
+			tweetFetcher.Fetch("default", track("golang"))
+			tweetFetcher.sessions["default"].trending = []fetcher.Trending{
+				{Window: "1m", Hashtags: []fetcher.Trend{{Term: "gophercon", Count: 3}}, Mentions: []fetcher.Trend{}, Words: []fetcher.Trend{}},
+				{Window: "5m", Hashtags: []fetcher.Trend{{Term: "gophercon", Count: 7}}, Mentions: []fetcher.Trend{}, Words: []fetcher.Trend{{Term: "denver", Count: 2}}},
+			}
+		})
+
+		It("returns the top terms of every window", func() {
+			req, err := http.NewRequest("GET", "/trending", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`[
+				{"Window": "1m", "Hashtags": [{"Term": "gophercon", "Count": 3}], "Mentions": [], "Words": []},
+				{"Window": "5m", "Hashtags": [{"Term": "gophercon", "Count": 7}], "Mentions": [], "Words": [{"Term": "denver", "Count": 2}]}
+			]`))
+		})
+
+		It("returns the top terms of a window", func() {
+			req, err := http.NewRequest("GET", "/trending?window=5m", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Window": "5m", "Hashtags": [{"Term": "gophercon", "Count": 7}], "Mentions": [], "Words": [{"Term": "denver", "Count": 2}]}`))
+		})
+
+		It("returns 400 for unknown windows", func() {
+			req, err := http.NewRequest("GET", "/trending?window=1d", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+		})
+
+		It("returns 404 if session doesn't exist", func() {
+			req, err := http.NewRequest("GET", "/trending?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("heatmap", func() {
+		BeforeEach(func() {
+			tweetFetcher.Fetch("default", track("golang"))
+			tweetFetcher.sessions["default"].heatmap = []fetcher.HeatmapFrame{
+				{Window: "5m", Precision: 3, Snapshot: true, Cells: []fetcher.HeatmapCell{{Geohash: "u33", Lat: 52.73, Long: 13.36, Count: 4}}},
+				{Window: "1h", Precision: 4, Snapshot: true, Cells: []fetcher.HeatmapCell{{Geohash: "9xj6", Lat: 39.64, Long: -104.94, Count: 2}}},
+			}
+		})
+
+		It("returns the cells of the first frame by default", func() {
+			req, err := http.NewRequest("GET", "/api/heatmap", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Window": "5m", "Precision": 3, "Snapshot": true, "Cells": [{"Geohash": "u33", "Lat": 52.73, "Long": 13.36, "Count": 4}]}`))
+		})
+
+		It("returns the cells of the frame asked for", func() {
+			req, err := http.NewRequest("GET", "/api/heatmap?precision=4&window=1h", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Window": "1h", "Precision": 4, "Snapshot": true, "Cells": [{"Geohash": "9xj6", "Lat": 39.64, "Long": -104.94, "Count": 2}]}`))
+		})
+
+		It("returns 400 for unknown or invalid parameters", func() {
+			for _, path := range []string{"/api/heatmap?precision=7", "/api/heatmap?precision=fine", "/api/heatmap?window=1d"} {
+				req, err := http.NewRequest("GET", path, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				rr := httptest.NewRecorder()
+				api.ServeHTTP(rr, req)
+
+				Ω(rr.Code).Should(Equal(http.StatusBadRequest), path)
+			}
+		})
+
+		It("returns 404 if session doesn't exist", func() {
+			req, err := http.NewRequest("GET", "/api/heatmap?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("rejects websocket clients asking for unknown frames or modes", func() {
+			for _, path := range []string{"/tweets?mode=heatmap&window=1d", "/tweets?mode=cells"} {
+				req, err := http.NewRequest("GET", path, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				rr := httptest.NewRecorder()
+				api.ServeHTTP(rr, req)
+
+				Ω(rr.Code).Should(Equal(http.StatusBadRequest), path)
+			}
+		})
+	})
+
+	Describe("country stats", func() {
+		It("returns where the session's tweets were sent from", func() {
+			tweetFetcher.Fetch("default", track("golang"))
+			tweetFetcher.sessions["default"].countries = fetcher.CountryStats{
+				Countries: []fetcher.CountryCount{{Country: "Germany", Tweets: 3, Share: 0.75, Rate: 0.05}, {Country: "France", Tweets: 1, Share: 0.25}},
+				Geocoded:  4,
+				Failures:  2,
+			}
+
+			req, err := http.NewRequest("GET", "/api/stats/countries", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{
+				"Countries": [
+					{"Country": "Germany", "Tweets": 3, "Share": 0.75, "Rate": 0.05},
+					{"Country": "France", "Tweets": 1, "Share": 0.25, "Rate": 0}
+				],
+				"Geocoded": 4,
+				"Failures": 2,
+				"Skipped": 0
+			}`))
+		})
+
+		It("returns 404 if session doesn't exist", func() {
+			req, err := http.NewRequest("GET", "/api/stats/countries?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("time series", func() {
+		BeforeEach(func() {
+			seriesStore.Count("totalTweets", 3)
+			seriesStore.Gauge("clients.connected", 2)
+		})
+
+		It("lists the metrics", func() {
+			req, err := http.NewRequest("GET", "/api/series", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`["clients.connected", "totalTweets"]`))
+		})
+
+		It("returns the points of a metric", func() {
+			req, err := http.NewRequest("GET", "/api/series?metric=totalTweets&from=-10s&to=now&step=10s", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			var result series.Series
+			Expect(json.Unmarshal(rr.Body.Bytes(), &result)).To(Succeed())
+			Expect(result.Metric).To(Equal("totalTweets"))
+			Expect(result.Kind).To(Equal(series.KindRate))
+			Expect(result.Step).To(Equal("10s"))
+			total := 0.0
+			for _, point := range result.Points {
+				total += point.Value
+			}
+			Expect(total).To(BeNumerically("~", 0.3))
+		})
+
+		It("returns 404 for unknown metrics", func() {
+			req, err := http.NewRequest("GET", "/api/series?metric=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("returns 400 for invalid parameters", func() {
+			for _, query := range []string{"from=yesterday", "to=later", "step=-1s", "from=now&to=-1h"} {
+				req, err := http.NewRequest("GET", "/api/series?metric=totalTweets&"+query, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				rr := httptest.NewRecorder()
+				api.ServeHTTP(rr, req)
+
+				Ω(rr.Code).Should(Equal(http.StatusBadRequest), query)
+			}
+		})
+	})
+
+	Describe("schedule", func() {
+		It("starts the schedule for the session", func() {
+			buffer := bytes.NewBufferString(`{"Steps": [{"Query": {"Track": ["kubecon"]}, "For": "10m"}, {"Query": {"Mode": "sample"}, "At": "0 9 * * 1-5"}]}`)
+			req, err := http.NewRequest("POST", "/schedule?session=demo", buffer)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Session": "demo", "State": "running", "Step": 1, "Steps": 2, "Tweets": 0}`))
+
+			schedule := tweetScheduler.schedules["demo"]
+			Expect(schedule.Steps).To(HaveLen(2))
+			Expect(schedule.Steps[0].Query.Track).To(Equal([]string{"kubecon"}))
+			Expect(schedule.Steps[0].For).To(Equal("10m"))
+			Expect(schedule.Steps[1].At).To(Equal("0 9 * * 1-5"))
+		})
+
+		It("returns 400 for invalid schedules", func() {
+			for _, body := range []string{`{"Steps": [`, `{"Steps": []}`, `{"Steps": [{"Query": {"Track": ["golang"]}, "At": "soon"}]}`} {
+				req, err := http.NewRequest("POST", "/schedule", bytes.NewBufferString(body))
+				Expect(err).NotTo(HaveOccurred())
+
+				rr := httptest.NewRecorder()
+				api.ServeHTTP(rr, req)
+
+				Ω(rr.Code).Should(Equal(http.StatusBadRequest), body)
+			}
+		})
+
+		It("returns the status of the session's schedule", func() {
+			tweetScheduler.Schedule("default", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+
+			req, err := http.NewRequest("GET", "/schedule", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"Session": "default", "State": "running", "Step": 1, "Steps": 1, "Tweets": 0}`))
+		})
+
+		It("returns null if the session has no schedule", func() {
+			req, err := http.NewRequest("GET", "/schedule?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`null`))
+		})
+
+		It("lists schedules", func() {
+			tweetScheduler.Schedule("default", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+
+			req, err := http.NewRequest("GET", "/schedules", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`[{"Session": "default", "State": "running", "Step": 1, "Steps": 1, "Tweets": 0}]`))
+		})
+
+		It("cancels the session's schedule", func() {
+			tweetScheduler.Schedule("default", scheduler.Schedule{Steps: []scheduler.Step{{Query: track("golang")}}})
+
+			req, err := http.NewRequest("POST", "/schedule/cancel", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetScheduler.statuses["default"].State).To(Equal(scheduler.StateCancelled))
+
+			rr = httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("replay", func() {
+		replay := func() fetcher.Query {
+			return fetcher.Query{Mode: fetcher.ModeReplay, Replay: &fetcher.ReplayOptions{File: "default.jsonl", Speed: 10}}
+		}
+
+		It("pauses and resumes the replay", func() {
+			tweetFetcher.Fetch("default", replay())
+
+			req, err := http.NewRequest("POST", "/replay/pause", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(MatchJSON(`{"File": "default.jsonl", "Speed": 10, "Paused": true, "Finished": false, "Position": 0}`))
+
+			req, err = http.NewRequest("POST", "/replay/resume", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr = httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions["default"].replay.status.Paused).To(BeFalse())
+		})
+
+		It("seeks to the given position", func() {
+			tweetFetcher.Fetch("default", replay())
+
+			req, err := http.NewRequest("POST", "/replay/seek?to=1m30s", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusOK))
+			Expect(tweetFetcher.sessions["default"].replay.status.Position).To(Equal(90 * time.Second))
+		})
+
+		It("returns 400 if position is invalid", func() {
+			tweetFetcher.Fetch("default", replay())
+
+			req, err := http.NewRequest("POST", "/replay/seek?to=soon", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusBadRequest))
+		})
+
+		It("returns 404 if session doesn't exist", func() {
+			req, err := http.NewRequest("POST", "/replay/pause?session=missing", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("returns 409 if session isn't a replay", func() {
+			tweetFetcher.Fetch("default", track("test"))
+
+			req, err := http.NewRequest("POST", "/replay/pause", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Ω(rr.Code).Should(Equal(http.StatusConflict))
+		})
+
+		It("reports the replay status with the query", func() {
+			tweetFetcher.Fetch("default", replay())
+
+			req, err := http.NewRequest("GET", "/query", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+
+			Expect(rr.Body.String()).To(ContainSubstring(`"Description":"replay of default.jsonl at 10x"`))
+			Expect(rr.Body.String()).To(ContainSubstring(`"Replay":{"File":"default.jsonl","Speed":10,"Paused":false`))
 		})
 	})
 })
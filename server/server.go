@@ -4,15 +4,20 @@ import (
 	"net/http"
 
 	log "github.com/inconshreveable/log15"
+	"github.com/quipo/statsd"
 
 	"github.com/Altoros/tweets-fetcher/fetcher"
+	"github.com/Altoros/tweets-fetcher/scheduler"
+	"github.com/Altoros/tweets-fetcher/series"
 	"github.com/Altoros/tweets-fetcher/server/handlers"
 )
 
 type server struct {
-	logger  log.Logger
-	fetcher fetcher.Fetcher
-	fanout  handlers.Fanout
+	logger    log.Logger
+	fetcher   fetcher.Fetcher
+	scheduler scheduler.Scheduler
+	fanout    handlers.Fanout
+	series    series.Store
 }
 
 type Server interface {
@@ -20,19 +25,32 @@ type Server interface {
 	Stop()
 }
 
-func New(logger log.Logger, fetcher fetcher.Fetcher) Server {
-	fanout := handlers.NewFanout(fetcher.Tweets())
-	fanout.Run()
+// New serves the sessions of tweetsFetcher, the schedules of
+// tweetsScheduler and the series of seriesStore, passing messages to each
+// client through a buffer configured by clientBuffer.
+func New(logger log.Logger, tweetsFetcher fetcher.Fetcher, tweetsScheduler scheduler.Scheduler, seriesStore series.Store, statsdClient statsd.Statsd, clientBuffer fetcher.Backpressure) Server {
+	fanout := handlers.NewFanout(logger, statsdClient, clientBuffer)
+	// Sessions started by the server's own API as well as those started
+	// elsewhere, e.g. by the replay command, are delivered to clients.
+	tweetsFetcher.OnSessionStart(func(session fetcher.Session) {
+		fanout.Attach(session.ID(), session.Messages())
+	})
+	// Clients learn when their session connects, backs off or stops.
+	tweetsFetcher.OnStateChange(func(change fetcher.StateChange) {
+		fanout.Notify(change.Session, change.Message())
+	})
 	return &server{
-		logger:  logger.New("module", "server"),
-		fetcher: fetcher,
-		fanout:  fanout,
+		logger:    logger.New("module", "server"),
+		fetcher:   tweetsFetcher,
+		scheduler: tweetsScheduler,
+		fanout:    fanout,
+		series:    seriesStore,
 	}
 }
 
 func (s *server) Start(errCh chan error, port string) {
 	s.logger.Info("Starting server", "port", port)
-	mux := handlers.New(s.logger, s.fetcher, s.fanout, "templates")
+	mux := handlers.New(s.logger, s.fetcher, s.scheduler, s.fanout, s.series, "templates")
 	err := http.ListenAndServe(":"+port, mux)
 	if err != nil {
 		errCh <- err
@@ -41,5 +59,6 @@ func (s *server) Start(errCh chan error, port string) {
 
 func (s *server) Stop() {
 	s.logger.Info("Stopping server")
+	s.scheduler.StopAll()
 	s.fanout.UnregisterAll()
 }
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Store keeps the definitions of active sessions, so that they can be
+// resumed after the app restarts.
+type Store interface {
+	// Save replaces the saved sessions with sessions.
+	Save(sessions []Session) error
+	// Load returns the saved sessions, none if nothing was saved yet.
+	Load() ([]Session, error)
+}
+
+// Session is the definition of a session. Query holds the JSON encoded
+// fetcher.Query.
+type Session struct {
+	Id      string
+	Query   json.RawMessage
+	SavedAt time.Time
+}
@@ -0,0 +1,91 @@
+package store_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Altoros/tweets-fetcher/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File store", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "store")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("loads the sessions saved last", func() {
+		s := store.NewFile(filepath.Join(dir, "state", "sessions.json"))
+		savedAt := time.Date(2016, 9, 6, 9, 20, 58, 0, time.UTC)
+
+		Expect(s.Save([]store.Session{{Id: "old", Query: json.RawMessage(`{"Track":["wine"]}`), SavedAt: savedAt}})).To(Succeed())
+		Expect(s.Save([]store.Session{{Id: "default", Query: json.RawMessage(`{"Track":["beer"]}`), SavedAt: savedAt}})).To(Succeed())
+
+		sessions, err := store.NewFile(filepath.Join(dir, "state", "sessions.json")).Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sessions).To(HaveLen(1))
+		Expect(sessions[0].Id).To(Equal("default"))
+		Expect(sessions[0].Query).To(MatchJSON(`{"Track":["beer"]}`))
+		Expect(sessions[0].SavedAt.Equal(savedAt)).To(BeTrue())
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "state"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("loads nothing before anything was saved", func() {
+		sessions, err := store.NewFile(filepath.Join(dir, "sessions.json")).Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sessions).To(BeEmpty())
+	})
+
+	It("fails to load corrupt files", func() {
+		path := filepath.Join(dir, "sessions.json")
+		Expect(ioutil.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+
+		_, err := store.NewFile(path).Load()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Volume store", func() {
+	It("saves to the volume mounted for the service", func() {
+		dir, err := ioutil.TempDir("", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		vcapServices := `{"nfs": [{
+			"name": "tweets-state",
+			"volume_mounts": [{"container_dir": "` + dir + `", "mode": "rw"}]
+		}]}`
+		s, err := store.NewVolume(vcapServices, "tweets-state")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(s.Save([]store.Session{{Id: "default", Query: json.RawMessage(`{}`)}})).To(Succeed())
+		_, err = os.Stat(filepath.Join(dir, "tweets-fetcher-sessions.json"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("fails without the service", func() {
+		_, err := store.NewVolume(`{"nfs": []}`, "tweets-state")
+		Expect(err).To(MatchError("Couldn't find volume service 'tweets-state'"))
+	})
+
+	It("fails for read-only volumes", func() {
+		vcapServices := `{"nfs": [{"name": "tweets-state", "volume_mounts": [{"container_dir": "/data", "mode": "r"}]}]}`
+		_, err := store.NewVolume(vcapServices, "tweets-state")
+		Expect(err).To(MatchError("Service 'tweets-state' has no writable volume mounts"))
+	})
+})
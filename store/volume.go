@@ -0,0 +1,52 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// volumeFileName is the name of the file sessions are saved to on volumes.
+const volumeFileName = "tweets-fetcher-sessions.json"
+
+// NewVolume saves sessions to the Cloud Foundry volume service bound to
+// the app as serviceName, which keeps them across restages. vcapServices is
+// the content of VCAP_SERVICES.
+func NewVolume(vcapServices string, serviceName string) (Store, error) {
+	dir, err := volumeDir(vcapServices, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(filepath.Join(dir, volumeFileName)), nil
+}
+
+// volumeDir finds where the volume service is mounted in the container.
+// go-cfenv doesn't know about volume mounts, so VCAP_SERVICES is parsed
+// here.
+func volumeDir(vcapServices string, serviceName string) (string, error) {
+	var services map[string][]struct {
+		Name         string `json:"name"`
+		VolumeMounts []struct {
+			ContainerDir string `json:"container_dir"`
+			Mode         string `json:"mode"`
+		} `json:"volume_mounts"`
+	}
+	if err := json.Unmarshal([]byte(vcapServices), &services); err != nil {
+		return "", fmt.Errorf("Failed to parse VCAP_SERVICES: %s", err)
+	}
+
+	for _, instances := range services {
+		for _, service := range instances {
+			if service.Name != serviceName {
+				continue
+			}
+			for _, mount := range service.VolumeMounts {
+				if mount.Mode == "rw" {
+					return mount.ContainerDir, nil
+				}
+			}
+			return "", fmt.Errorf("Service '%s' has no writable volume mounts", serviceName)
+		}
+	}
+	return "", fmt.Errorf("Couldn't find volume service '%s'", serviceName)
+}